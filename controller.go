@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/lapi"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/metrics"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/web"
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// bouncerRunner runs the bouncers and their metrics providers in the
+// errgroup, and restarts them when the LAPI settings change.
+type bouncerRunner struct {
+	g              *errgroup.Group
+	ctx            context.Context
+	logger         *logrus.Logger
+	decisionCache  *decisions.Cache
+	live           *lapi.Live
+	metricsHandler *metrics.MetricsHandler
+	failurePolicy  *remediation.FailurePolicy
+	health         *lapi.Health
+
+	// stop cancels the running bouncer, and done is released once its
+	// goroutines have returned
+	stop context.CancelFunc
+	done sync.WaitGroup
+}
+
+// bouncers are the initialized CrowdSec bouncers for each LAPI endpoint, in
+// order of preference.
+type bouncers struct {
+	mode      string
+	interval  time.Duration
+	endpoints []lapi.Endpoint
+	// clients send the usage metrics of each endpoint
+	clients []*apiclient.ApiClient
+	// fetchers look decisions up in live mode
+	fetchers []lapi.Fetcher
+	live     lapi.LiveOptions
+	filter   *decisions.Filter
+}
+
+// newBouncers initializes a CrowdSec bouncer for each LAPI endpoint, in order
+// of preference. In stream mode, they keep the decision cache local and only
+// request deltas from LAPI at the configured interval. In live mode, they
+// look each client IP up in LAPI, and LAPI is checked at that interval.
+func newBouncers(pluginConfig *config.PluginConfig) (*bouncers, error) {
+	filter := pluginConfig.DecisionFilter()
+	set := &bouncers{
+		mode:     pluginConfig.Mode,
+		interval: pluginConfig.StreamUpdateInterval,
+		live: lapi.LiveOptions{
+			CacheTTL:         pluginConfig.Live.CacheTTL,
+			NegativeCacheTTL: pluginConfig.Live.NegativeCacheTTL,
+			Timeout:          pluginConfig.Live.Timeout,
+			Filter:           filter,
+		},
+		filter: filter,
+	}
+	insecureSkipVerify := pluginConfig.InsecureSkipVerify
+	for _, endpoint := range pluginConfig.Endpoints {
+		// the metrics provider reuses the bouncer's client, and so its TLS
+		// settings
+		if pluginConfig.Mode == config.ModeLive {
+			bouncer := &csbouncer.LiveBouncer{
+				APIKey:             pluginConfig.LAPIKey(),
+				APIUrl:             endpoint,
+				UserAgent:          info.BOUNCER_USER_AGENT,
+				CertPath:           pluginConfig.CertPath,
+				KeyPath:            pluginConfig.KeyPath,
+				CAPath:             pluginConfig.CACertPath,
+				InsecureSkipVerify: &insecureSkipVerify,
+			}
+			if err := bouncer.Init(); err != nil {
+				return nil, fmt.Errorf("unable to initialize bouncer for %s: %w", endpoint, err)
+			}
+			fetch := lapi.BouncerFetcher(bouncer)
+			set.endpoints = append(set.endpoints, lapi.Endpoint{URL: endpoint, Pull: lapi.ProbePuller(fetch)})
+			set.clients = append(set.clients, bouncer.APIClient)
+			set.fetchers = append(set.fetchers, fetch)
+			continue
+		}
+
+		bouncer := &csbouncer.StreamBouncer{
+			APIKey:             pluginConfig.LAPIKey(),
+			APIUrl:             endpoint,
+			UserAgent:          info.BOUNCER_USER_AGENT,
+			TickerInterval:     pluginConfig.StreamUpdateFrequency,
+			CertPath:           pluginConfig.CertPath,
+			KeyPath:            pluginConfig.KeyPath,
+			CAPath:             pluginConfig.CACertPath,
+			InsecureSkipVerify: &insecureSkipVerify,
+			// LAPI only sends the decisions passing the filters
+			Scopes:                 filter.Scopes,
+			Origins:                filter.Origins,
+			ScenariosContaining:    filter.ScenariosContaining,
+			ScenariosNotContaining: filter.ScenariosNotContaining,
+		}
+		if err := bouncer.Init(); err != nil {
+			return nil, fmt.Errorf("unable to initialize bouncer for %s: %w", endpoint, err)
+		}
+		set.endpoints = append(set.endpoints, lapi.Endpoint{URL: endpoint, Pull: lapi.BouncerPuller(bouncer)})
+		set.clients = append(set.clients, bouncer.APIClient)
+	}
+	return set, nil
+}
+
+// start runs bouncers, which use the LAPI endpoints in order of preference,
+// stopping the bouncers that were running before, if any.
+func (r *bouncerRunner) start(bouncers *bouncers) error {
+	endpoints := bouncers.endpoints
+	urls := make([]string, len(endpoints))
+	metricsProviders := make([]*csbouncer.MetricsProvider, len(endpoints))
+	for i, client := range bouncers.clients {
+		metricsProvider, err := csbouncer.NewMetricsProvider(
+			client,
+			info.BOUNCER_TYPE,
+			r.metricsHandler.MetricsUpdater,
+			r.logger,
+		)
+		if err != nil {
+			return fmt.Errorf("unable to initialize metrics provider: %w", err)
+		}
+		metricsProviders[i] = metricsProvider
+		urls[i] = endpoints[i].URL
+	}
+
+	if r.stop != nil {
+		r.stop()
+		r.done.Wait()
+	}
+	ctx, stop := context.WithCancel(r.ctx)
+	r.stop = stop
+	r.health.Reset(urls)
+
+	// usage metrics go to the LAPI decisions are pulled from
+	metricsEndpoint := -1
+	stopMetrics := func() {}
+	sendMetricsTo := func(endpoint int) {
+		if endpoint == metricsEndpoint {
+			return
+		}
+		stopMetrics()
+		metricsCtx, cancel := context.WithCancel(ctx)
+		metricsEndpoint, stopMetrics = endpoint, cancel
+		r.run(metricsCtx, metricsProviders[endpoint].Run)
+	}
+	sendMetricsTo(0)
+
+	// in live mode, lookups start with the preferred endpoint, and LAPI is
+	// only polled to check that it answers; the decisions of the stream are
+	// dropped so that they are neither listed nor saved
+	live := bouncers.mode == config.ModeLive
+	r.decisionCache.SetFilter(bouncers.filter)
+	if live {
+		r.decisionCache.Replace("", &models.DecisionsStreamResponse{})
+		r.live.Use(bouncers.fetchers[0], bouncers.live)
+	} else {
+		r.live.Use(nil, lapi.LiveOptions{})
+		r.restoreSnapshot()
+		// the snapshot is only written in stream mode, so that it is kept
+		// while live mode leaves the cache empty; stopping the bouncer
+		// saves it one last time
+		r.run(ctx, func(ctx context.Context) error {
+			return r.decisionCache.RunSnapshotter(ctx, r.logger, info.SNAPSHOT_FILE, decisions.DefaultSnapshotInterval)
+		})
+	}
+	liveEndpoint := 0
+
+	// pull decisions ourselves rather than with bouncer.Run, so that the
+	// outcome of every pull is recorded in health, and another endpoint
+	// takes over when one is down
+	r.run(ctx, func(ctx context.Context) error {
+		return lapi.Run(ctx, r.logger, endpoints, bouncers.interval, r.health, func(endpoint int, update *models.DecisionsStreamResponse, startup bool) {
+			switch {
+			case live:
+				if endpoint != liveEndpoint {
+					liveEndpoint = endpoint
+					r.live.Use(bouncers.fetchers[endpoint], bouncers.live)
+				}
+			case startup:
+				// the startup update carries every active decision, it
+				// replaces whatever was restored from the snapshot or
+				// pulled from another LAPI
+				r.decisionCache.Replace(endpoints[endpoint].URL, update)
+			default:
+				r.decisionCache.Apply(update)
+			}
+			r.failurePolicy.RecordSync()
+			sendMetricsTo(endpoint)
+		})
+	})
+	return nil
+}
+
+// restoreSnapshot loads the decisions saved before the last shutdown, or
+// before switching to live mode, into an empty cache, so requests are blocked
+// before the first stream response arrives. The filters set on the cache
+// leave out the decisions they reject.
+func (r *bouncerRunner) restoreSnapshot() {
+	if r.decisionCache.Len() > 0 {
+		return
+	}
+	restored, err := r.decisionCache.LoadSnapshot(info.SNAPSHOT_FILE)
+	if err != nil {
+		r.logger.Warnf("Ignoring decision snapshot: %v", err)
+	} else if restored > 0 {
+		r.logger.Infof("Restored %d decisions from %s", restored, info.SNAPSHOT_FILE)
+	}
+}
+
+// run runs fn in the errgroup. Errors caused by stopping the bouncer are not
+// reported, so that a restart does not shut the plugin down.
+func (r *bouncerRunner) run(ctx context.Context, fn func(ctx context.Context) error) {
+	r.done.Add(1)
+	r.g.Go(func() error {
+		defer r.done.Done()
+		if err := fn(ctx); err != nil && ctx.Err() == nil {
+			return err
+		}
+		return nil
+	})
+}
+
+// newRegistry creates the remediation registry, which decides what to do with
+// requests matching each decision type. The block page, captcha challenger
+// and failure policy are set by the caller.
+func newRegistry(pluginConfig *config.PluginConfig) (*remediation.Registry, error) {
+	registry, err := remediation.NewRegistry(pluginConfig.Remediation.Default, pluginConfig.Remediation.Types)
+	if err != nil {
+		return nil, err
+	}
+	registry.TarpitDelay = pluginConfig.Remediation.TarpitDelay
+	registry.RedirectURL = pluginConfig.Remediation.RedirectURL
+	return registry, nil
+}
+
+// controller owns the running configuration. It applies changes made to
+// config.yaml or through the web UI, and starts blocking once onboarding is
+// complete. The sniff and capture handlers read the configuration and the
+// remediation registry through pluginConfig and registry, so both are swapped
+// as a whole.
+type controller struct {
+	g              *errgroup.Group
+	ctx            context.Context
+	logger         *logrus.Logger
+	decisionCache  *decisions.Cache
+	live           *lapi.Live
+	metricsHandler *metrics.MetricsHandler
+
+	pluginConfig *atomic.Pointer[config.PluginConfig]
+	registry     *atomic.Pointer[remediation.Registry]
+
+	mu sync.Mutex
+	// runner is nil in onboarding mode, until the bouncer starts blocking
+	runner *bouncerRunner
+	// started holds the captcha and failure mode settings in effect, which
+	// only change when the plugin restarts
+	started *config.PluginConfig
+}
+
+// configChange is a validated configuration change, ready to be applied.
+type configChange struct {
+	pluginConfig *config.PluginConfig
+	changes      config.Changes
+	registry     *remediation.Registry
+	// bouncers are set when the bouncer has to be (re)started
+	bouncers *bouncers
+	// failurePolicy is set when onboarding is complete
+	failurePolicy *remediation.FailurePolicy
+}
+
+// startBlocking starts the bouncer. It returns the health of the LAPI
+// connection.
+func (c *controller) startBlocking(pluginConfig *config.PluginConfig, bouncers *bouncers, failurePolicy *remediation.FailurePolicy) (*lapi.Health, error) {
+	health := lapi.NewHealth(pluginConfig.Endpoints)
+	runner := &bouncerRunner{
+		g:              c.g,
+		ctx:            c.ctx,
+		logger:         c.logger,
+		decisionCache:  c.decisionCache,
+		live:           c.live,
+		metricsHandler: c.metricsHandler,
+		failurePolicy:  failurePolicy,
+		health:         health,
+	}
+	if err := runner.start(bouncers); err != nil {
+		return nil, err
+	}
+	c.runner = runner
+	return health, nil
+}
+
+// reload reads config.yaml and applies what changed. An invalid configuration
+// is rejected as a whole, and the running one stays in place.
+func (c *controller) reload() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// an older file pasted over config.yaml is upgraded as well, which
+	// triggers another, empty, reload
+	migration, err := config.MigrateFile(info.CONFIGURATION_FILE)
+	if migration != nil {
+		logMigration(c.logger, migration)
+	}
+	var reloaded *config.PluginConfig
+	if err == nil {
+		reloaded, err = config.ReadConfig(info.CONFIGURATION_FILE)
+	}
+	if err == nil {
+		var change *configChange
+		if change, err = c.prepare(reloaded); err == nil {
+			err = c.commit(change)
+		}
+	}
+	if err != nil {
+		c.logger.Errorf("Rejected changes to %s, keeping the running configuration: %v", info.CONFIGURATION_FILE, err)
+		web.SetConfigErrors(config.AsFieldErrors(err))
+		return
+	}
+	web.SetConfigErrors(nil)
+}
+
+// Source returns where the sniff and capture handlers look decisions up in
+// the running mode.
+func (c *controller) Source() decisions.Source {
+	if c.pluginConfig.Load().Mode == config.ModeLive {
+		return c.live
+	}
+	return c.decisionCache
+}
+
+// Config returns the running configuration.
+func (c *controller) Config() *config.PluginConfig {
+	return c.pluginConfig.Load()
+}
+
+// Update validates a configuration edited in the web UI, writes it to
+// config.yaml and applies it.
+func (c *controller) Update(updated *config.PluginConfig) (config.Changes, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	change, err := c.prepare(updated)
+	if err != nil {
+		return config.Changes{}, err
+	}
+	if err := config.WriteConfig(info.CONFIGURATION_FILE, updated); err != nil {
+		return config.Changes{}, err
+	}
+	if err := c.commit(change); err != nil {
+		return config.Changes{}, err
+	}
+	return change.changes, nil
+}
+
+// prepare validates updated against the running configuration, and builds
+// everything needed to apply it, so that a bad edit is rejected before
+// anything changes. Validation errors wrap config.ErrInvalidConfig. The
+// caller must hold c.mu.
+func (c *controller) prepare(updated *config.PluginConfig) (*configChange, error) {
+	running := c.pluginConfig.Load()
+	change := &configChange{
+		pluginConfig: updated,
+		changes:      config.Diff(running, updated),
+		registry:     c.registry.Load(),
+	}
+
+	var err error
+	if slices.Contains(change.changes.Live, "remediation") {
+		change.registry, err = newRegistry(updated)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unable to initialize remediation: %v", config.ErrInvalidConfig, err)
+		}
+		current := c.registry.Load()
+		change.registry.BlockPage = current.BlockPage
+		change.registry.Challenger = current.Challenger
+		change.registry.Failure = current.Failure
+	}
+
+	// the failure mode only changes on restart, but it is still validated
+	// so that the plugin does not fail to start later on
+	failureConfig := updated.FailureMode
+	failurePolicy, err := remediation.NewFailurePolicy(failureConfig.Mode, failureConfig.Action, failureConfig.Hostnames, failureConfig.StaleAfter)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unable to initialize failure mode: %v", config.ErrInvalidConfig, err)
+	}
+
+	onboarding := c.runner == nil
+	switch {
+	case onboarding && len(updated.MissingRequiredFields()) > 0:
+		// still onboarding, the LAPI settings are not in use yet
+		return change, nil
+	case !onboarding && !change.changes.Bouncer:
+		return change, nil
+	}
+
+	// the bouncer is about to connect with these settings, so a wrong key or
+	// URL is rejected now rather than showing up as failed pulls
+	validation := updated.Validate(c.ctx, true)
+	if err := validation.Err(); err != nil {
+		return nil, err
+	}
+	for _, check := range validation.Connections {
+		if !check.Reachable {
+			c.logger.Warnf("CrowdSec LAPI at %s is unreachable, the bouncer will keep retrying: %s", check.URL, check.Error)
+		}
+	}
+	if onboarding {
+		// onboarding is complete, start blocking with the new settings
+		change.failurePolicy = failurePolicy
+		change.changes.Restart = slices.DeleteFunc(change.changes.Restart, func(setting string) bool { return setting == "failure_mode" })
+	}
+
+	change.bouncers, err = newBouncers(updated)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", config.ErrInvalidConfig, err)
+	}
+	return change, nil
+}
+
+// commit applies a prepared configuration change. The caller must hold c.mu.
+func (c *controller) commit(change *configChange) error {
+	updated := change.pluginConfig
+	changes := change.changes
+
+	registry := change.registry
+	switch {
+	case change.failurePolicy != nil:
+		withFailure := *registry
+		withFailure.Failure = change.failurePolicy
+		registry = &withFailure
+		health, err := c.startBlocking(updated, change.bouncers, change.failurePolicy)
+		if err != nil {
+			return err
+		}
+		web.EnableBlocking(change.failurePolicy, health)
+		started := *c.started
+		started.FailureMode = updated.FailureMode
+		c.started = &started
+		c.logger.Infof("Onboarding complete, the bouncer is connecting to %s", strings.Join(updated.Endpoints, ", "))
+	case change.bouncers != nil:
+		if err := c.runner.start(change.bouncers); err != nil {
+			return err
+		}
+		c.logger.Infof("LAPI settings changed, restarted the bouncer for %s", strings.Join(updated.Endpoints, ", "))
+	}
+
+	c.logger.SetLevel(updated.LogLevel)
+	c.decisionCache.SetTypePriority(registry.Priority)
+	c.live.SetTypePriority(registry.Priority)
+	c.registry.Store(registry)
+	// the running configuration is what config.yaml says, the settings
+	// that need a restart are reported until then
+	c.pluginConfig.Store(updated)
+	web.SetRestartRequired(config.Diff(c.started, updated).Restart)
+
+	if len(changes.Live) > 0 {
+		c.logger.Infof("Applied changes to %s: %s", info.CONFIGURATION_FILE, strings.Join(changes.Live, ", "))
+	}
+	if len(changes.Restart) > 0 {
+		c.logger.Warnf("Changes to %s in %s take effect after restarting the plugin", strings.Join(changes.Restart, ", "), info.CONFIGURATION_FILE)
+	}
+	return nil
+}
@@ -6,13 +6,18 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
+	"sync/atomic"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/dynamiccapture"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/lapi"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/metrics"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/web"
 	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
@@ -22,61 +27,69 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func startBouncer(g *errgroup.Group, ctx context.Context, pluginConfig *config.PluginConfig, logger *logrus.Logger, decisionCache *decisions.Cache, metricsHandler *metrics.MetricsHandler) {
-
-	// Initialize the CrowdSec stream bouncer. It keeps the decision cache local
-	// and only requests deltas from LAPI at the configured interval.
-	bouncer := &csbouncer.StreamBouncer{
-		APIKey:              pluginConfig.APIKey,
-		APIUrl:              pluginConfig.AgentUrl,
-		UserAgent:           info.BOUNCER_USER_AGENT,
-		TickerInterval:      pluginConfig.StreamUpdateFrequency,
-		Scopes:              []string{"ip", "range"},
-		RetryInitialConnect: true,
-	}
-	if err := bouncer.Init(); err != nil {
-		logger.Fatalf("unable to initialize bouncer: %v", err)
+// newChallenger creates the captcha challenger, or returns nil if no captcha
+// provider is configured, in which case captcha decisions are blocked.
+func newChallenger(pluginConfig *config.PluginConfig, port int) (*captcha.Challenger, error) {
+	captchaConfig := pluginConfig.Captcha
+	if !captchaConfig.Enabled() {
+		return nil, nil
 	}
 
-	g.Go(func() error {
-		if err := bouncer.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
-			return err
+	// The fake provider verifies against the plugin's own web server, so
+	// the captcha flow can be tested without a real captcha service.
+	if strings.EqualFold(captchaConfig.Provider, captcha.FakeProviderName) {
+		http.DefaultServeMux.Handle(captcha.FakeVerifyPath, captcha.FakeVerifyHandler())
+		if captchaConfig.VerifyURL == "" {
+			captchaConfig.VerifyURL = fmt.Sprintf("http://127.0.0.1:%d%s", port, captcha.FakeVerifyPath)
 		}
-		return nil
-	})
+	}
 
-	g.Go(func() error {
-		for {
-			select {
-			case <-ctx.Done():
-				return nil
-			case update, ok := <-bouncer.Stream:
-				if !ok {
-					return nil
-				}
-				decisionCache.Apply(update)
-			}
-		}
-	})
+	signer, err := captcha.NewCookieSigner(captchaConfig.CookieSecret, captchaConfig.CookieTTL)
+	if err != nil {
+		return nil, err
+	}
+	return captcha.NewChallenger(captchaConfig.Provider, captchaConfig.SiteKey, captchaConfig.SecretKey, captchaConfig.VerifyURL, signer)
+}
 
-	// initialize and start a metrics provider
-	metricsProvider, err := csbouncer.NewMetricsProvider(
-		bouncer.APIClient,
-		info.BOUNCER_TYPE,
-		metricsHandler.MetricsUpdater,
-		logger,
-	)
+// checkConfig validates the configuration file and prints every problem
+// found in it. It returns the exit code of the -check-config flag.
+func checkConfig() int {
+	pluginConfig, err := config.ReadConfig(info.CONFIGURATION_FILE)
 	if err != nil {
-		logger.Fatalf("unable to initialize metrics provider: %v", err)
-		panic(err)
+		fmt.Fprintf(os.Stderr, "%s is invalid:\n", info.CONFIGURATION_FILE)
+		printConfigErrors(err)
+		return 1
+	}
+	if pluginConfig.ConfigVersion < config.CurrentConfigVersion {
+		fmt.Printf("%s has config_version %d, and will be upgraded to %d when the plugin starts\n", info.CONFIGURATION_FILE, pluginConfig.ConfigVersion, config.CurrentConfigVersion)
 	}
+	if missing := pluginConfig.MissingRequiredFields(); len(missing) > 0 {
+		fmt.Printf("%s is valid, but %s must be set before the bouncer starts blocking\n", info.CONFIGURATION_FILE, strings.Join(missing, ", "))
+		return 0
+	}
+	fmt.Printf("%s is valid\n", info.CONFIGURATION_FILE)
+	return 0
+}
 
-	g.Go(func() error {
-		return metricsProvider.Run(ctx)
-	})
+// logMigration logs that the configuration file was upgraded.
+func logMigration(logger *logrus.Logger, migration *config.Migration) {
+	logger.Infof("Upgraded %s from config_version %d to %d, the original is kept in %s", info.CONFIGURATION_FILE, migration.From, migration.To, migration.Backup)
+}
+
+// printConfigErrors prints the problems found in the configuration file, one
+// per line.
+func printConfigErrors(err error) {
+	for _, problem := range config.AsFieldErrors(err) {
+		fmt.Fprintf(os.Stderr, "  %s\n", problem)
+	}
 }
 
 func main() {
+	// validate the configuration file and exit, without starting the plugin
+	if slices.Contains(os.Args[1:], "-check-config") {
+		os.Exit(checkConfig())
+	}
+
 	// Serve the plugin introspect
 	// This will print the plugin introspect and exit if the -introspect flag is provided
 	pluginIntoSpect := &plugin.IntroSpect{
@@ -102,20 +115,27 @@ func main() {
 		panic(err)
 	}
 
-	// load the configuration
+	// upgrade a configuration file written by an older version, then load it
+	migration, err := config.MigrateFile(info.CONFIGURATION_FILE)
+	if err != nil {
+		panic(err)
+	}
 	pluginConfig := &config.PluginConfig{}
 	if err := pluginConfig.LoadConfig(); err != nil {
-		if errors.Is(err, config.ErrConfigCreated) {
-			fmt.Fprintf(os.Stderr, "%v\n", err)
-			return
-		}
-		fmt.Fprintf(os.Stderr, "Error loading configuration: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error loading configuration:\n")
+		printConfigErrors(err)
 		panic(err)
 	}
 
 	// initialize the logger
 	logger := logrus.StandardLogger()
 	logger.Level = pluginConfig.LogLevel
+	if migration != nil {
+		logMigration(logger, migration)
+	}
+	if pluginConfig.GeoIP.Resolver.Enabled() {
+		logger.Infof("Locating clients with %s", pluginConfig.GeoIP.Resolver)
+	}
 
 	missingFields := pluginConfig.MissingRequiredFields()
 	onboardingMode := len(missingFields) > 0
@@ -126,7 +146,7 @@ func main() {
 	if onboardingMode {
 		configStatus.MissingFields = missingFields
 		configStatus.Message = fmt.Sprintf(
-			"Bouncer onboarding mode: update %s in %s, then restart the plugin.",
+			"Bouncer onboarding mode: set %s in the configuration form, or in %s.",
 			strings.Join(missingFields, ", "),
 			info.CONFIGURATION_FILE,
 		)
@@ -146,9 +166,76 @@ func main() {
 	metrics.Map.MustRegisterAll()
 	prometheus.MustRegister(csbouncer.TotalLAPICalls, csbouncer.TotalLAPIError)
 
+	// initialize the remediation registry, which decides what to do with
+	// requests matching each decision type
+	remediations, err := newRegistry(pluginConfig)
+	if err != nil {
+		logger.Fatalf("unable to initialize remediation: %v", err)
+	}
+	remediations.BlockPage, err = dynamiccapture.LoadBlockPage(info.BLOCK_PAGE_FILE)
+	if err != nil {
+		logger.Fatalf("unable to load block page: %v", err)
+	}
+	remediations.Challenger, err = newChallenger(pluginConfig, runtimeCfg.Port)
+	if err != nil {
+		logger.Fatalf("unable to initialize captcha: %v", err)
+	}
+	if remediations.Challenger == nil {
+		logger.Info("No captcha provider configured, challenge remediations will be blocked")
+	} else if remediations.Challenger.Provider.Name() == captcha.FakeProviderName {
+		logger.Warnf("The fake captcha provider is enabled by %s: anyone can pass its challenges with a public token, never use it in production", captcha.AllowFakeEnv)
+	}
+	decisionCache.SetTypePriority(remediations.Priority)
+	liveSource := lapi.NewLive(logger)
+	liveSource.SetTypePriority(remediations.Priority)
+
+	// expired decisions stop matching on their own, the sweeper frees them
+	g.Go(func() error {
+		return decisionCache.RunExpirySweeper(ctx, decisions.DefaultSweepInterval)
+	})
+	g.Go(func() error {
+		return liveSource.RunExpirySweeper(ctx, decisions.DefaultSweepInterval)
+	})
+
+	// the configuration and registry are swapped when config.yaml changes or
+	// the configuration is saved in the web UI
+	currentConfig := &atomic.Pointer[config.PluginConfig]{}
+	currentConfig.Store(pluginConfig)
+	currentRegistry := &atomic.Pointer[remediation.Registry]{}
+	configController := &controller{
+		g:              g,
+		ctx:            ctx,
+		logger:         logger,
+		decisionCache:  decisionCache,
+		live:           liveSource,
+		metricsHandler: metricsHandler,
+		pluginConfig:   currentConfig,
+		registry:       currentRegistry,
+		started:        pluginConfig,
+	}
+
+	var health *lapi.Health
 	if !onboardingMode {
-		startBouncer(g, ctx, pluginConfig, logger, decisionCache, metricsHandler)
+		// decide what happens to requests while CrowdSec is unreachable
+		failureConfig := pluginConfig.FailureMode
+		remediations.Failure, err = remediation.NewFailurePolicy(failureConfig.Mode, failureConfig.Action, failureConfig.Hostnames, failureConfig.StaleAfter)
+		if err != nil {
+			logger.Fatalf("unable to initialize failure mode: %v", err)
+		}
+
+		bouncers, err := newBouncers(pluginConfig)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		health, err = configController.startBlocking(pluginConfig, bouncers, remediations.Failure)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
 	}
+	currentRegistry.Store(remediations)
+
+	// the sniff handler hands matched decisions over to the capture handler
+	handoff := dynamiccapture.NewHandoff(dynamiccapture.DefaultHandoffCapacity, dynamiccapture.DefaultHandoffTTL)
 
 	/*
 		Dynamic Captures
@@ -159,17 +246,23 @@ func main() {
 		We will also print the request information to the console for debugging purposes.
 	*/
 	pathRouter.RegisterDynamicSniffHandler("/d_sniff", http.DefaultServeMux, func(dsfr *plugin.DynamicSniffForwardRequest) plugin.SniffResult {
-		return dynamiccapture.SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache)
+		return dynamiccapture.SniffHandler(logger, metricsHandler, currentConfig.Load(), dsfr, configController.Source(), currentRegistry.Load(), handoff)
 	})
 	pathRouter.RegisterDynamicCaptureHandle(info.DYNAMIC_CAPTURE_INGRESS, http.DefaultServeMux, func(w http.ResponseWriter, r *http.Request) {
-		dynamiccapture.CaptureHandler(logger, w, r)
+		dynamiccapture.CaptureHandler(logger, currentConfig.Load(), configController.Source(), currentRegistry.Load(), handoff, w, r)
 	})
 
-	web.InitWebServer(logger, g, ctx, runtimeCfg.Port, configStatus)
+	web.InitWebServer(logger, g, ctx, runtimeCfg.Port, configStatus, decisionCache, remediations.Failure, health, configController)
 
 	// Handle signals
 	utils.StartSignalHandler(logger, g, ctx)
 
+	// reload the configuration when it changes, or on SIGHUP
+	utils.StartReloadHandler(logger, g, ctx, configController.reload)
+	g.Go(func() error {
+		return utils.WatchFile(ctx, info.CONFIGURATION_FILE, utils.DefaultWatchInterval, configController.reload)
+	})
+
 	// wait for the goroutines to finish
 	if err := g.Wait(); err != nil && !(errors.Is(err, utils.SignalTermError) || errors.Is(err, utils.SignalIntError)) {
 		fmt.Printf("Process terminated with error of type %T: %v\n", err, err)
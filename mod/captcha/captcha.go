@@ -0,0 +1,223 @@
+// Package captcha implements challenge-based remediation for CrowdSec
+// "captcha" decisions.
+//
+// A Provider knows how to render its widget and how to verify the token that
+// the widget posts back. Turnstile, hCaptcha and reCAPTCHA all share the same
+// siteverify protocol, so they are implemented by a single provider type. A
+// solved challenge is remembered with a signed, expiring cookie so that the
+// sniff handler can skip verified clients.
+package captcha
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider is a captcha service that can render a challenge widget and verify
+// the response token it produces.
+type Provider interface {
+	// Name is the identifier used for this provider in config.yaml.
+	Name() string
+	// ScriptURL is the JavaScript that must be loaded for the widget, if any.
+	ScriptURL() string
+	// Widget returns the HTML placed inside the challenge form.
+	Widget(siteKey string) template.HTML
+	// ResponseField is the form field the widget submits its token in.
+	ResponseField() string
+	// DefaultVerifyURL is the siteverify endpoint used when none is configured.
+	DefaultVerifyURL() string
+}
+
+// siteVerifyProvider implements Provider for services that use the
+// siteverify protocol shared by Turnstile, hCaptcha and reCAPTCHA.
+type siteVerifyProvider struct {
+	name          string
+	scriptURL     string
+	widgetClass   string
+	responseField string
+	verifyURL     string
+}
+
+func (p *siteVerifyProvider) Name() string             { return p.name }
+func (p *siteVerifyProvider) ScriptURL() string        { return p.scriptURL }
+func (p *siteVerifyProvider) ResponseField() string    { return p.responseField }
+func (p *siteVerifyProvider) DefaultVerifyURL() string { return p.verifyURL }
+
+func (p *siteVerifyProvider) Widget(siteKey string) template.HTML {
+	return template.HTML(fmt.Sprintf(
+		`<div class="%s" data-sitekey="%s"></div>`,
+		template.HTMLEscapeString(p.widgetClass),
+		template.HTMLEscapeString(siteKey),
+	))
+}
+
+var (
+	providersMu sync.RWMutex
+	providers   = map[string]Provider{}
+)
+
+// Register makes a provider available under its name. Registering a name
+// twice replaces the earlier provider.
+func Register(provider Provider) {
+	providersMu.Lock()
+	defer providersMu.Unlock()
+	providers[strings.ToLower(provider.Name())] = provider
+}
+
+// LookupProvider returns the registered provider with the given name.
+func LookupProvider(name string) (Provider, bool) {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	provider, ok := providers[strings.ToLower(strings.TrimSpace(name))]
+	return provider, ok
+}
+
+// ProviderNames returns the names of all registered providers, sorted.
+func ProviderNames() []string {
+	providersMu.RLock()
+	defer providersMu.RUnlock()
+	names := make([]string, 0, len(providers))
+	for name := range providers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	Register(&siteVerifyProvider{
+		name:          "turnstile",
+		scriptURL:     "https://challenges.cloudflare.com/turnstile/v0/api.js",
+		widgetClass:   "cf-turnstile",
+		responseField: "cf-turnstile-response",
+		verifyURL:     "https://challenges.cloudflare.com/turnstile/v0/siteverify",
+	})
+	Register(&siteVerifyProvider{
+		name:          "hcaptcha",
+		scriptURL:     "https://js.hcaptcha.com/1/api.js",
+		widgetClass:   "h-captcha",
+		responseField: "h-captcha-response",
+		verifyURL:     "https://api.hcaptcha.com/siteverify",
+	})
+	Register(&siteVerifyProvider{
+		name:          "recaptcha",
+		scriptURL:     "https://www.google.com/recaptcha/api.js",
+		widgetClass:   "g-recaptcha",
+		responseField: "g-recaptcha-response",
+		verifyURL:     "https://www.google.com/recaptcha/api/siteverify",
+	})
+	Register(fakeProvider{})
+}
+
+// siteVerifyResponse is the common subset of the siteverify responses. A
+// rejected token is reported through Success, not as an error.
+type siteVerifyResponse struct {
+	Success    bool     `json:"success"`
+	ErrorCodes []string `json:"error-codes"`
+}
+
+// Challenger ties a provider to its keys and issues verification cookies.
+type Challenger struct {
+	Provider  Provider
+	SiteKey   string
+	SecretKey string
+	VerifyURL string
+
+	signer *CookieSigner
+	client *http.Client
+}
+
+// NewChallenger creates a challenger for the named provider. If verifyURL is
+// empty, the provider's public siteverify endpoint is used.
+func NewChallenger(providerName, siteKey, secretKey, verifyURL string, signer *CookieSigner) (*Challenger, error) {
+	provider, ok := LookupProvider(providerName)
+	if !ok {
+		return nil, fmt.Errorf("unknown captcha provider %q (available: %s)", providerName, strings.Join(ProviderNames(), ", "))
+	}
+	if signer == nil {
+		return nil, fmt.Errorf("captcha challenger requires a cookie signer")
+	}
+	if verifyURL == "" {
+		verifyURL = provider.DefaultVerifyURL()
+	}
+
+	return &Challenger{
+		Provider:  provider,
+		SiteKey:   siteKey,
+		SecretKey: secretKey,
+		VerifyURL: verifyURL,
+		signer:    signer,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Verify checks a widget response token against the provider's siteverify
+// endpoint.
+func (c *Challenger) Verify(ctx context.Context, response, remoteIP string) (bool, error) {
+	if response == "" {
+		return false, nil
+	}
+
+	form := url.Values{}
+	form.Set("secret", c.SecretKey)
+	form.Set("response", response)
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, fmt.Errorf("failed to create verify request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to send verify request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("unexpected status code from %s: %d", c.Provider.Name(), resp.StatusCode)
+	}
+
+	var result siteVerifyResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, fmt.Errorf("failed to decode verify response: %w", err)
+	}
+	return result.Success, nil
+}
+
+// SetCookie marks the client as verified for the signer's TTL. The cookie is
+// marked Secure if the client reached Zoraxy over HTTPS.
+func (c *Challenger) SetCookie(w http.ResponseWriter, ip string, secure bool) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieName,
+		Value:    c.signer.Sign(ip, time.Now()),
+		Path:     "/",
+		MaxAge:   int(c.signer.TTL().Seconds()),
+		Secure:   secure,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// HasValidCookie reports whether the request headers carry an unexpired
+// verification cookie issued to ip.
+func (c *Challenger) HasValidCookie(headers map[string][]string, ip string) bool {
+	r := http.Request{Header: http.Header(headers)}
+	for _, cookie := range r.CookiesNamed(CookieName) {
+		if c.signer.Valid(cookie.Value, ip, time.Now()) {
+			return true
+		}
+	}
+	return false
+}
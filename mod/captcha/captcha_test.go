@@ -0,0 +1,104 @@
+package captcha
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCookieSignerRoundTrip(t *testing.T) {
+	signer, err := NewCookieSigner("secret", time.Minute)
+	if err != nil {
+		t.Fatalf("NewCookieSigner() error = %v", err)
+	}
+	now := time.Now()
+	value := signer.Sign("203.0.113.10", now)
+
+	tests := []struct {
+		name  string
+		value string
+		ip    string
+		at    time.Time
+		want  bool
+	}{
+		{name: "valid", value: value, ip: "203.0.113.10", at: now, want: true},
+		{name: "other IP", value: value, ip: "203.0.113.11", at: now, want: false},
+		{name: "expired", value: value, ip: "203.0.113.10", at: now.Add(2 * time.Minute), want: false},
+		{name: "tampered", value: "x" + value, ip: "203.0.113.10", at: now, want: false},
+		{name: "garbage", value: "not-a-cookie", ip: "203.0.113.10", at: now, want: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := signer.Valid(tc.value, tc.ip, tc.at); got != tc.want {
+				t.Fatalf("Valid() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	otherSigner, _ := NewCookieSigner("other-secret", time.Minute)
+	if otherSigner.Valid(value, "203.0.113.10", now) {
+		t.Fatal("cookie signed with a different secret should be rejected")
+	}
+}
+
+func TestChallengerVerifiesAgainstFakeEndpoint(t *testing.T) {
+	server := httptest.NewServer(FakeVerifyHandler())
+	defer server.Close()
+
+	signer, _ := NewCookieSigner("", time.Minute)
+	challenger, err := NewChallenger(FakeProviderName, "", "", server.URL, signer)
+	if err != nil {
+		t.Fatalf("NewChallenger() error = %v", err)
+	}
+
+	ok, err := challenger.Verify(context.Background(), FakeResponseToken, "203.0.113.10")
+	if err != nil || !ok {
+		t.Fatalf("Verify(valid token) = %v, %v, want true, nil", ok, err)
+	}
+	ok, err = challenger.Verify(context.Background(), "wrong-token", "203.0.113.10")
+	if err != nil || ok {
+		t.Fatalf("Verify(invalid token) = %v, %v, want false, nil", ok, err)
+	}
+}
+
+func TestChallengerCookieRoundTrip(t *testing.T) {
+	signer, _ := NewCookieSigner("secret", time.Minute)
+	challenger, err := NewChallenger("turnstile", "site-key", "secret-key", "", signer)
+	if err != nil {
+		t.Fatalf("NewChallenger() error = %v", err)
+	}
+
+	recorder := httptest.NewRecorder()
+	challenger.SetCookie(recorder, "2001:db8::1", false)
+	headers := map[string][]string{"Cookie": {strings.Split(recorder.Header().Get("Set-Cookie"), ";")[0]}}
+
+	if !challenger.HasValidCookie(headers, "2001:db8::1") {
+		t.Fatal("expected issued cookie to be valid")
+	}
+	if challenger.HasValidCookie(headers, "2001:db8::2") {
+		t.Fatal("expected cookie to be bound to the issuing IP")
+	}
+	if challenger.HasValidCookie(http.Header{}, "2001:db8::1") {
+		t.Fatal("expected missing cookie to be invalid")
+	}
+	if strings.Contains(recorder.Header().Get("Set-Cookie"), "Secure") {
+		t.Fatal("expected cookie issued over HTTP not to be Secure")
+	}
+
+	recorder = httptest.NewRecorder()
+	challenger.SetCookie(recorder, "2001:db8::1", true)
+	if !strings.Contains(recorder.Header().Get("Set-Cookie"), "; Secure") {
+		t.Fatalf("expected cookie issued over HTTPS to be Secure, got %q", recorder.Header().Get("Set-Cookie"))
+	}
+}
+
+func TestNewChallengerRejectsUnknownProvider(t *testing.T) {
+	signer, _ := NewCookieSigner("secret", time.Minute)
+	if _, err := NewChallenger("not-a-provider", "", "", "", signer); err == nil {
+		t.Fatal("expected an error for an unknown provider")
+	}
+}
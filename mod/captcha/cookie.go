@@ -0,0 +1,88 @@
+package captcha
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CookieName is the cookie that marks a client as having solved a challenge.
+const CookieName = "zcb_captcha"
+
+// CookieSigner issues and validates HMAC-signed verification cookies. A
+// cookie is bound to the client IP it was issued to and expires after the
+// signer's TTL.
+type CookieSigner struct {
+	key []byte
+	ttl time.Duration
+}
+
+// NewCookieSigner creates a signer using secret as the HMAC key. If secret is
+// empty a random key is generated, so cookies will not survive a restart.
+func NewCookieSigner(secret string, ttl time.Duration) (*CookieSigner, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("cookie TTL must be positive, got %s", ttl)
+	}
+
+	key := []byte(secret)
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("unable to generate cookie secret: %w", err)
+		}
+	}
+
+	return &CookieSigner{key: key, ttl: ttl}, nil
+}
+
+// TTL returns how long issued cookies remain valid.
+func (s *CookieSigner) TTL() time.Duration {
+	return s.ttl
+}
+
+// Sign returns a cookie value for ip that expires TTL after now.
+func (s *CookieSigner) Sign(ip string, now time.Time) string {
+	payload := strconv.FormatInt(now.Add(s.ttl).Unix(), 10) + "|" + ip
+	encoded := base64.RawURLEncoding.EncodeToString([]byte(payload))
+	return encoded + "." + base64.RawURLEncoding.EncodeToString(s.mac(encoded))
+}
+
+// Valid reports whether value was signed by this signer for ip and has not
+// expired at now.
+func (s *CookieSigner) Valid(value, ip string, now time.Time) bool {
+	encoded, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+
+	gotMAC, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(gotMAC, s.mac(encoded)) {
+		return false
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	rawExpiry, cookieIP, ok := strings.Cut(string(payload), "|")
+	if !ok || cookieIP != ip {
+		return false
+	}
+	expiry, err := strconv.ParseInt(rawExpiry, 10, 64)
+	if err != nil {
+		return false
+	}
+
+	return now.Unix() < expiry
+}
+
+func (s *CookieSigner) mac(encoded string) []byte {
+	h := hmac.New(sha256.New, s.key)
+	h.Write([]byte(encoded))
+	return h.Sum(nil)
+}
@@ -0,0 +1,65 @@
+package captcha
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	// FakeProviderName selects the offline test provider in config.yaml.
+	FakeProviderName = "fake"
+	// AllowFakeEnv must be set to true for the fake provider to be used. Its
+	// response token is public, so anyone can pass its challenges.
+	AllowFakeEnv = "ZCB_ALLOW_FAKE_CAPTCHA"
+	// FakeResponseToken is the only response token the fake endpoint accepts.
+	FakeResponseToken = "XXXX.DUMMY.TOKEN.XXXX"
+	// FakeVerifyPath is where the plugin web server mounts FakeVerifyHandler.
+	FakeVerifyPath = "/api/captcha/fake-siteverify"
+)
+
+// FakeAllowed reports whether AllowFakeEnv allows the fake provider.
+func FakeAllowed() bool {
+	allowed, _ := strconv.ParseBool(os.Getenv(AllowFakeEnv))
+	return allowed
+}
+
+// fakeProvider renders a one-click challenge that always submits
+// FakeResponseToken. Together with FakeVerifyHandler it allows the whole
+// captcha flow to be exercised without reaching a real captcha service.
+type fakeProvider struct{}
+
+func (fakeProvider) Name() string             { return FakeProviderName }
+func (fakeProvider) ScriptURL() string        { return "" }
+func (fakeProvider) ResponseField() string    { return "fake-captcha-response" }
+func (fakeProvider) DefaultVerifyURL() string { return "" }
+
+func (fakeProvider) Widget(siteKey string) template.HTML {
+	return template.HTML(`<input type="hidden" name="fake-captcha-response" value="` + FakeResponseToken + `">` +
+		`<p class="note">Test challenge: no real captcha service is used.</p>`)
+}
+
+// FakeVerifyHandler implements the siteverify protocol, accepting only
+// FakeResponseToken as a valid response.
+func FakeVerifyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+
+		response := siteVerifyResponse{Success: r.PostForm.Get("response") == FakeResponseToken}
+		if !response.Success {
+			response.ErrorCodes = []string{"invalid-input-response"}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+	})
+}
@@ -1,78 +1,727 @@
 package config
 
 import (
+	"cmp"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"maps"
+	"net/netip"
+	"net/url"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/lapi"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
 	"github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
 )
 
 const DefaultStreamUpdateFrequency = "10s"
+const DefaultMode = ModeStream
 const PlaceholderAPIKey = "<CROWDSEC_BOUNCER_API_KEY>"
+const DefaultCaptchaCookieTTL = "30m"
+const DefaultRemediationAction = "block"
+const DefaultTarpitDelay = "10s"
+const DefaultFailureMode = "open"
+const DefaultFailureAction = "block"
+const DefaultFailureStaleAfter = "5m"
+const DefaultLiveCacheTTL = "1m"
+const DefaultLiveNegativeCacheTTL = "10s"
+const DefaultLiveTimeout = "500ms"
 
-var ErrConfigCreated = errors.New("config file created")
+// How decisions are looked up: stream keeps every decision in memory and
+// pulls the changes from LAPI, live asks LAPI about each client IP.
+const (
+	ModeStream = "stream"
+	ModeLive   = "live"
+)
+
+// The range of stream_update_frequency. LAPI is polled at this interval, so
+// a shorter one only adds load, and a longer one leaves new decisions
+// unenforced for too long.
+const MinStreamUpdateFrequency = time.Second
+const MaxStreamUpdateFrequency = time.Hour
+
+// MaxTarpitDelay bounds how long a tarpitted request is held open.
+const MaxTarpitDelay = 5 * time.Minute
+
+// The range of live.timeout. Requests wait this long for LAPI in live mode,
+// so a longer one stalls them for too long.
+const MinLiveTimeout = 10 * time.Millisecond
+const MaxLiveTimeout = 10 * time.Second
+
+// DefaultTrustedProxies are the loopback and private ranges, which covers
+// Zoraxy itself and reverse proxies on the local network.
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7"}
 
 const defaultConfigTemplate = `# Crowdsec Bouncer Configuration
 # api_key: "YOUR_CROWDSEC_BOUNCER_API_KEY"
+# Alternatively, read the API key from a file such as a Docker secret.
+# api_key_file: /run/secrets/crowdsec_bouncer_api_key
+# Or authenticate with a TLS client certificate, as set up in CrowdSec for
+# bouncers using mTLS, instead of an API key.
+# cert_path: /etc/crowdsec/tls/bouncer.pem
+# key_path: /etc/crowdsec/tls/bouncer-key.pem
+# CA certificate that signed LAPI's certificate, added to the system ones.
+# ca_cert_path: /etc/crowdsec/tls/ca.pem
+# Skip the verification of LAPI's certificate. Only for testing.
+# insecure_skip_verify: false
+# Every setting can also be overridden by an environment variable named after
+# it, e.g. ZCB_API_KEY, ZCB_AGENT_URL or ZCB_CAPTCHA_SITE_KEY.
 agent_url: http://127.0.0.1:8080
+# Alternatively, list several LAPIs in order of preference instead of
+# agent_url. Decisions are pulled from the first one that answers, and the
+# next ones take over while it is down.
+# agent_urls:
+#   - http://crowdsec-1:8080
+#   - http://crowdsec-2:8080
+# How decisions are looked up. stream keeps every decision in memory and pulls
+# the changes from LAPI. live asks LAPI about each client IP instead, which
+# keeps memory low with large blocklists, at the cost of one LAPI call per new
+# client.
+mode: stream
 # How frequently to request decision deltas from CrowdSec's stream endpoint.
+# In live mode, how often LAPI is checked.
 stream_update_frequency: 10s
+# Lookups in live mode.
+live:
+  # How long a decision found for an IP is reused, at most until it expires.
+  cache_ttl: 1m
+  # How long the absence of a decision for an IP is reused.
+  negative_cache_ttl: 10s
+  # How long a request waits for LAPI before going on without a decision.
+  timeout: 500ms
+# Which decisions are enforced. Empty lists enforce every decision. LAPI only
+# sends the matching decisions, and the plugin checks them again.
+decision_filters:
+  # Only decisions from these origins, e.g. crowdsec and cscli for the
+  # decisions of your own CrowdSec, or CAPI and lists for blocklists.
+  origins: []
+  # Only decisions whose scenario contains one of these.
+  scenarios_containing: []
+  # No decisions whose scenario contains one of these.
+  scenarios_not_containing: []
+  # Decision scopes pulled in addition to ip and range.
+  scopes: []
+# Local MaxMind databases locating client IPs, e.g. GeoLite2-Country or
+# GeoLite2-City and GeoLite2-ASN kept up to date by geoipupdate. Decisions for
+# the country or AS of a client are enforced when the matching database is
+# set, and both are logged and counted in the metrics. Leave empty to not
+# locate clients.
+geoip:
+  country_database: ""
+  asn_database: ""
 # Log level for the bouncer, options: trace, debug, info, warning, error
 log_level: warning
-# Set to true if zoraxy is proxied behind Cloudflare
+# Set to true if zoraxy is proxied behind Cloudflare. CF-Connecting-IP is only
+# honored from Cloudflare's IP ranges, which are built into the plugin and can
+# be refreshed by saving https://www.cloudflare.com/ips-v4 and
+# https://www.cloudflare.com/ips-v6 to cloudflare_ips_file.
 is_proxied_behind_cloudflare: true
+cloudflare_ips_file: ./cloudflare_ips.txt
+# Peers allowed to set X-Real-IP and X-Forwarded-For. CF-Connecting-IP is only
+# honored from Cloudflare.
+# Forwarding headers from any other peer are ignored.
+trusted_proxies:
+  - 127.0.0.0/8
+  - ::1/128
+  - 10.0.0.0/8
+  - 172.16.0.0/12
+  - 192.168.0.0/16
+  - fc00::/7
+# Headers holding the client IP, checked in order when the peer is a trusted
+# proxy. pick selects the address from a list: rightmost_untrusted (default)
+# skips trusted proxies from the right, leftmost and rightmost take the first
+# or last address. The standard Forwarded header can be listed as well.
+ip_headers:
+  - name: X-Real-IP
+  - name: CF-Connecting-IP
+  - name: X-Forwarded-For
+    pick: rightmost_untrusted
+# Challenge page served for CrowdSec "captcha" decisions.
+# Leave provider empty to block captcha decisions like bans.
+captcha:
+  # Options: turnstile, hcaptcha, recaptcha, fake (testing only, see README)
+  provider: ""
+  site_key: ""
+  secret_key: ""
+  # How long a solved challenge exempts the client from captcha decisions.
+  cookie_ttl: 30m
+# What to do with requests matching each CrowdSec decision type.
+# Actions: block, challenge, tarpit, redirect, log
+remediation:
+  # Action for decision types not listed under types.
+  default: block
+  types:
+    ban: block
+    captcha: challenge
+    throttle: tarpit
+  # How long tarpitted requests are held before being rejected.
+  tarpit_delay: 10s
+  # Where the redirect action sends clients.
+  redirect_url: ""
+# What to do with requests without a decision when CrowdSec has not been
+# reachable for stale_after, or has not been reached since startup.
+failure_mode:
+  # open: let requests through using the last known decisions
+  # closed: remediate every request with the action below
+  # closed_for_hosts: remediate requests for the listed hostnames only
+  mode: open
+  # Options: block, challenge
+  action: block
+  hostnames: []
+  stale_after: 5m
+# Version of this file's layout. The plugin upgrades older files when it reads
+# them, keeping a copy of the original next to it.
+config_version: 4
 `
 
 type PluginConfig struct {
-	APIKey                    string `yaml:"api_key"`
-	AgentUrl                  string `yaml:"agent_url"`
-	StreamUpdateFrequency     string `yaml:"stream_update_frequency"`
-	LogLevelString            string `yaml:"log_level"`
-	IsProxiedBehindCloudflare bool   `yaml:"is_proxied_behind_cloudflare"`
+	APIKey                    string            `yaml:"api_key" json:"api_key"`
+	APIKeyFile                string            `yaml:"api_key_file" json:"api_key_file"`
+	CertPath                  string            `yaml:"cert_path" json:"cert_path"`
+	KeyPath                   string            `yaml:"key_path" json:"key_path"`
+	CACertPath                string            `yaml:"ca_cert_path" json:"ca_cert_path"`
+	InsecureSkipVerify        bool              `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+	AgentUrl                  string            `yaml:"agent_url" json:"agent_url"`
+	AgentURLs                 []string          `yaml:"agent_urls" json:"agent_urls"`
+	Mode                      string            `yaml:"mode" json:"mode"`
+	StreamUpdateFrequency     string            `yaml:"stream_update_frequency" json:"stream_update_frequency"`
+	Live                      LiveConfig        `yaml:"live" json:"live"`
+	DecisionFilters           FiltersConfig     `yaml:"decision_filters" json:"decision_filters"`
+	GeoIP                     GeoIPConfig       `yaml:"geoip" json:"geoip"`
+	LogLevelString            string            `yaml:"log_level" json:"log_level"`
+	IsProxiedBehindCloudflare bool              `yaml:"is_proxied_behind_cloudflare" json:"is_proxied_behind_cloudflare"`
+	CloudflareIPsFile         string            `yaml:"cloudflare_ips_file" json:"cloudflare_ips_file"`
+	TrustedProxies            []string          `yaml:"trusted_proxies" json:"trusted_proxies"`
+	IPHeaders                 []IPHeaderConfig  `yaml:"ip_headers" json:"ip_headers"`
+	Captcha                   CaptchaConfig     `yaml:"captcha" json:"captcha"`
+	Remediation               RemediationConfig `yaml:"remediation" json:"remediation"`
+	FailureMode               FailureModeConfig `yaml:"failure_mode" json:"failure_mode"`
+	ConfigVersion             int               `yaml:"config_version" json:"config_version"`
+
+	LogLevel             logrus.Level       `yaml:"-" json:"-"`
+	StreamUpdateInterval time.Duration      `yaml:"-" json:"-"`
+	RealIP               utils.RealIPConfig `yaml:"-" json:"-"`
+	// Endpoints are the LAPIs decisions are pulled from, in order of
+	// preference: agent_urls, or agent_url.
+	Endpoints []string `yaml:"-" json:"-"`
+	// TLSFingerprint is a digest of the certificate files, so that reloading
+	// renewed certificates reconnects to LAPI.
+	TLSFingerprint string `yaml:"-" json:"-"`
+	// Sources tells where the effective value of each setting, by YAML
+	// path, comes from.
+	Sources map[string]ValueSource `yaml:"-" json:"-"`
+}
+
+// CaptchaConfig configures the challenge served for "captcha" decisions.
+type CaptchaConfig struct {
+	Provider  string `yaml:"provider" json:"provider"`
+	SiteKey   string `yaml:"site_key" json:"site_key"`
+	SecretKey string `yaml:"secret_key" json:"secret_key"`
+	// VerifyURL overrides the provider's siteverify endpoint.
+	VerifyURL string `yaml:"verify_url" json:"verify_url"`
+	// CookieSecret is the HMAC key for verification cookies. If empty, a
+	// random key is generated on startup.
+	CookieSecret    string `yaml:"cookie_secret" json:"cookie_secret"`
+	CookieTTLString string `yaml:"cookie_ttl" json:"cookie_ttl"`
+
+	CookieTTL time.Duration `yaml:"-" json:"-"`
+}
+
+// LiveConfig configures the lookups made in live mode.
+type LiveConfig struct {
+	CacheTTLString         string `yaml:"cache_ttl" json:"cache_ttl"`
+	NegativeCacheTTLString string `yaml:"negative_cache_ttl" json:"negative_cache_ttl"`
+	TimeoutString          string `yaml:"timeout" json:"timeout"`
+
+	CacheTTL         time.Duration `yaml:"-" json:"-"`
+	NegativeCacheTTL time.Duration `yaml:"-" json:"-"`
+	Timeout          time.Duration `yaml:"-" json:"-"`
+}
+
+// FiltersConfig selects the decisions that are enforced.
+type FiltersConfig struct {
+	Origins                []string `yaml:"origins" json:"origins"`
+	ScenariosContaining    []string `yaml:"scenarios_containing" json:"scenarios_containing"`
+	ScenariosNotContaining []string `yaml:"scenarios_not_containing" json:"scenarios_not_containing"`
+	// Scopes are pulled in addition to ip and range.
+	Scopes []string `yaml:"scopes" json:"scopes"`
+}
+
+// BaseScopes are the decision scopes always pulled from LAPI.
+var BaseScopes = []string{"ip", "range"}
+
+// Filter returns the filter selecting the decisions to enforce. Its scopes
+// are BaseScopes, extraScopes and the additional ones.
+func (f *FiltersConfig) Filter(extraScopes ...string) *decisions.Filter {
+	scopes := slices.Clone(BaseScopes)
+	for _, scope := range slices.Concat(extraScopes, f.Scopes) {
+		if !slices.ContainsFunc(scopes, func(s string) bool { return strings.EqualFold(s, scope) }) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return &decisions.Filter{
+		Origins:                f.Origins,
+		ScenariosContaining:    f.ScenariosContaining,
+		ScenariosNotContaining: f.ScenariosNotContaining,
+		Scopes:                 scopes,
+	}
+}
+
+// GeoIPConfig locates client IPs with local MaxMind databases, so that the
+// decisions with the country and AS scopes can be enforced.
+type GeoIPConfig struct {
+	CountryDatabase string `yaml:"country_database" json:"country_database"`
+	ASNDatabase     string `yaml:"asn_database" json:"asn_database"`
+
+	// Resolver holds the databases, read by PostProcess. It resolves nothing
+	// if none is set.
+	Resolver *geoip.Resolver `yaml:"-" json:"-"`
+}
+
+// Scopes returns the decision scopes that can be enforced with the
+// configured databases.
+func (g *GeoIPConfig) Scopes() []string {
+	var scopes []string
+	if g.CountryDatabase != "" {
+		scopes = append(scopes, lapi.ScopeCountry)
+	}
+	if g.ASNDatabase != "" {
+		scopes = append(scopes, lapi.ScopeAS)
+	}
+	return scopes
+}
+
+// RemediationConfig maps decision types to remediation actions.
+type RemediationConfig struct {
+	Default           string            `yaml:"default" json:"default"`
+	Types             map[string]string `yaml:"types" json:"types"`
+	TarpitDelayString string            `yaml:"tarpit_delay" json:"tarpit_delay"`
+	RedirectURL       string            `yaml:"redirect_url" json:"redirect_url"`
+
+	TarpitDelay time.Duration `yaml:"-" json:"-"`
+}
+
+// IPHeaderConfig is a request header that carries the client IP, and which
+// of its addresses to use.
+type IPHeaderConfig struct {
+	Name string `yaml:"name" json:"name"`
+	// Pick is rightmost_untrusted (default), leftmost or rightmost.
+	Pick string `yaml:"pick" json:"pick"`
+}
+
+// FailureModeConfig decides what happens to requests without a decision while
+// the decision stream is stale.
+type FailureModeConfig struct {
+	Mode             string   `yaml:"mode" json:"mode"`
+	Action           string   `yaml:"action" json:"action"`
+	Hostnames        []string `yaml:"hostnames" json:"hostnames"`
+	StaleAfterString string   `yaml:"stale_after" json:"stale_after"`
+
+	StaleAfter time.Duration `yaml:"-" json:"-"`
+}
+
+// Enabled reports whether a captcha provider is configured.
+func (c *CaptchaConfig) Enabled() bool {
+	return strings.TrimSpace(c.Provider) != ""
+}
 
-	LogLevel logrus.Level `yaml:"-"`
+// TLS returns the TLS settings of the connection to LAPI.
+func (p *PluginConfig) TLS() lapi.TLSOptions {
+	return lapi.TLSOptions{
+		CertPath:           p.CertPath,
+		KeyPath:            p.KeyPath,
+		CACertPath:         p.CACertPath,
+		InsecureSkipVerify: p.InsecureSkipVerify,
+	}
+}
+
+// hasAPIKey reports whether an API key other than the placeholder is set.
+func (p *PluginConfig) hasAPIKey() bool {
+	trimmedAPIKey := strings.TrimSpace(p.APIKey)
+	return trimmedAPIKey != "" && trimmedAPIKey != PlaceholderAPIKey
+}
+
+// LAPIKey returns the API key to authenticate to LAPI with, which is empty
+// when a client certificate is used instead.
+func (p *PluginConfig) LAPIKey() string {
+	if p.TLS().HasClientCertificate() {
+		return ""
+	}
+	return p.APIKey
 }
 
+// DecisionFilter returns the filter selecting the decisions to enforce,
+// including the country and AS decisions when the GeoIP databases allow to
+// match them.
+func (p *PluginConfig) DecisionFilter() *decisions.Filter {
+	return p.DecisionFilters.Filter(p.GeoIP.Scopes()...)
+}
+
+// MissingRequiredFields lists the settings needed to connect to LAPI that
+// are not set. A client certificate stands in for the API key.
 func (p *PluginConfig) MissingRequiredFields() []string {
 	missing := make([]string, 0, 2)
 
-	trimmedAPIKey := strings.TrimSpace(p.APIKey)
-	if trimmedAPIKey == "" || trimmedAPIKey == PlaceholderAPIKey {
+	if !p.hasAPIKey() && !p.TLS().HasClientCertificate() {
 		missing = append(missing, "api_key")
 	}
 
-	if strings.TrimSpace(p.AgentUrl) == "" {
+	if strings.TrimSpace(p.AgentUrl) == "" && len(p.AgentURLs) == 0 {
 		missing = append(missing, "agent_url")
 	}
 
 	return missing
 }
 
+// PostProcess applies the overrides and defaults, and parses and checks
+// every setting. All problems found are returned as FieldErrors.
 func (p *PluginConfig) PostProcess() error {
-	// This function can be used to perform any post-processing on the configuration
-	// For now, it populates the LogLevel based on the LogLevelString
+	var problems FieldErrors
+	if err := p.ApplyOverrides(); err != nil {
+		problems = AsFieldErrors(err)
+	}
+	fail := func(field, format string, args ...any) {
+		message := fmt.Sprintf(format, args...)
+		if source := p.Sources[field]; source.Kind == SourceEnv {
+			message = fmt.Sprintf("%s (set by %s)", message, source.Name)
+		}
+		problems = append(problems, FieldError{Field: field, Message: message})
+	}
+	duration := func(field, raw string, minimum, maximum time.Duration) time.Duration {
+		parsed, err := time.ParseDuration(raw)
+		switch {
+		case err != nil:
+			fail(field, "%q is not a duration, e.g. 30s or 5m", raw)
+		case parsed < minimum:
+			fail(field, "must be at least %s, got %s", minimum, raw)
+		case maximum > 0 && parsed > maximum:
+			fail(field, "must be at most %s, got %s", maximum, raw)
+		}
+		return parsed
+	}
+
+	if p.ConfigVersion < 0 || p.ConfigVersion > CurrentConfigVersion {
+		fail("config_version", "version %d is not supported, the latest is %d", p.ConfigVersion, CurrentConfigVersion)
+	}
+
 	// parse the log level string into a logrus Level
 	if p.LogLevelString == "" {
 		p.LogLevelString = "warning"
 	}
-
 	level, err := logrus.ParseLevel(p.LogLevelString)
 	if err != nil {
-		return fmt.Errorf("unable to parse log level: %w", err)
+		fail("log_level", "unknown log level %q", p.LogLevelString)
 	}
 	p.LogLevel = level
 
+	p.Endpoints = nil
+	endpointsField := "agent_url"
+	switch {
+	case len(p.AgentURLs) > 0 && p.AgentUrl != "":
+		fail("agent_urls", "set either agent_url or agent_urls, not both")
+	case len(p.AgentURLs) > 0:
+		endpointsField = "agent_urls"
+		p.Endpoints = p.AgentURLs
+	case p.AgentUrl != "":
+		p.Endpoints = []string{p.AgentUrl}
+	}
+	for i, endpoint := range p.Endpoints {
+		agentURL, err := url.Parse(endpoint)
+		switch {
+		case err != nil:
+			fail(endpointsField, "%v", err)
+		case agentURL.Scheme != "http" && agentURL.Scheme != "https":
+			fail(endpointsField, "must be an http or https URL, got %q", endpoint)
+		case agentURL.Host == "":
+			fail(endpointsField, "must include a host, got %q", endpoint)
+		case slices.Contains(p.Endpoints[:i], endpoint):
+			fail(endpointsField, "%s is listed more than once", endpoint)
+		}
+	}
+
+	p.checkTLS(fail)
+
 	if p.StreamUpdateFrequency == "" {
 		p.StreamUpdateFrequency = DefaultStreamUpdateFrequency
 	}
+	p.StreamUpdateInterval = duration("stream_update_frequency", p.StreamUpdateFrequency, MinStreamUpdateFrequency, MaxStreamUpdateFrequency)
+
+	if p.Mode == "" {
+		p.Mode = DefaultMode
+	}
+	if p.Mode != ModeStream && p.Mode != ModeLive {
+		fail("mode", "must be %s or %s, got %q", ModeStream, ModeLive, p.Mode)
+	}
+	if p.Live.CacheTTLString == "" {
+		p.Live.CacheTTLString = DefaultLiveCacheTTL
+	}
+	p.Live.CacheTTL = duration("live.cache_ttl", p.Live.CacheTTLString, 0, 0)
+	if p.Live.NegativeCacheTTLString == "" {
+		p.Live.NegativeCacheTTLString = DefaultLiveNegativeCacheTTL
+	}
+	p.Live.NegativeCacheTTL = duration("live.negative_cache_ttl", p.Live.NegativeCacheTTLString, 0, 0)
+	if p.Live.TimeoutString == "" {
+		p.Live.TimeoutString = DefaultLiveTimeout
+	}
+	p.Live.Timeout = duration("live.timeout", p.Live.TimeoutString, MinLiveTimeout, MaxLiveTimeout)
+
+	// the lists are joined with commas in the stream query
+	filters := []struct {
+		field  string
+		values *[]string
+	}{
+		{"decision_filters.origins", &p.DecisionFilters.Origins},
+		{"decision_filters.scenarios_containing", &p.DecisionFilters.ScenariosContaining},
+		{"decision_filters.scenarios_not_containing", &p.DecisionFilters.ScenariosNotContaining},
+		{"decision_filters.scopes", &p.DecisionFilters.Scopes},
+	}
+	for _, filter := range filters {
+		if *filter.values == nil {
+			*filter.values = []string{}
+		}
+		for _, value := range *filter.values {
+			if strings.TrimSpace(value) == "" || strings.Contains(value, ",") {
+				fail(filter.field, "entries must be non-empty and without commas, got %q", value)
+			}
+		}
+	}
+
+	// the databases are read now, so that a missing or wrong file is reported
+	// before it is used
+	p.GeoIP.Resolver = nil
+	if p.GeoIP.CountryDatabase != "" || p.GeoIP.ASNDatabase != "" {
+		p.GeoIP.Resolver, err = openGeoIP(p.GeoIP.CountryDatabase, p.GeoIP.ASNDatabase)
+		if err != nil {
+			fail("geoip", "%v", err)
+		}
+	}
+
+	if p.Captcha.Provider != "" {
+		if _, ok := captcha.LookupProvider(p.Captcha.Provider); !ok {
+			fail("captcha.provider", "unknown provider %q (available: %s)", p.Captcha.Provider, strings.Join(captcha.ProviderNames(), ", "))
+		} else if strings.EqualFold(p.Captcha.Provider, captcha.FakeProviderName) && !captcha.FakeAllowed() {
+			fail("captcha.provider", "the fake provider lets anyone pass its challenges and is for testing only; set %s=true to use it", captcha.AllowFakeEnv)
+		}
+	}
+	if p.Captcha.CookieTTLString == "" {
+		p.Captcha.CookieTTLString = DefaultCaptchaCookieTTL
+	}
+	p.Captcha.CookieTTL = duration("captcha.cookie_ttl", p.Captcha.CookieTTLString, time.Second, 0)
+
+	if p.Remediation.Default == "" {
+		p.Remediation.Default = DefaultRemediationAction
+	}
+	if _, err := remediation.ParseAction(p.Remediation.Default); err != nil {
+		fail("remediation.default", "%v", err)
+	}
+	// the default mappings apply unless overridden, so list them to compare
+	// equal to a configuration that spells them out
+	types := maps.Clone(p.Remediation.Types)
+	if types == nil {
+		types = make(map[string]string, len(remediation.DefaultTypes))
+	}
+	for decisionType, action := range remediation.DefaultTypes {
+		if _, ok := types[decisionType]; !ok {
+			types[decisionType] = string(action)
+		}
+	}
+	p.Remediation.Types = types
+	for _, decisionType := range slices.Sorted(maps.Keys(p.Remediation.Types)) {
+		if _, err := remediation.ParseAction(p.Remediation.Types[decisionType]); err != nil {
+			fail("remediation.types", "%s: %v", decisionType, err)
+		}
+	}
+	if p.Remediation.TarpitDelayString == "" {
+		p.Remediation.TarpitDelayString = DefaultTarpitDelay
+	}
+	p.Remediation.TarpitDelay = duration("remediation.tarpit_delay", p.Remediation.TarpitDelayString, 0, MaxTarpitDelay)
+	if p.Remediation.RedirectURL != "" {
+		if _, err := url.Parse(p.Remediation.RedirectURL); err != nil {
+			fail("remediation.redirect_url", "%v", err)
+		}
+	}
+
+	if p.FailureMode.Mode == "" {
+		p.FailureMode.Mode = DefaultFailureMode
+	}
+	if p.FailureMode.Action == "" {
+		p.FailureMode.Action = DefaultFailureAction
+	}
+	if p.FailureMode.Hostnames == nil {
+		p.FailureMode.Hostnames = []string{}
+	}
+	if p.FailureMode.StaleAfterString == "" {
+		p.FailureMode.StaleAfterString = DefaultFailureStaleAfter
+	}
+	p.FailureMode.StaleAfter = duration("failure_mode.stale_after", p.FailureMode.StaleAfterString, time.Second, 0)
+	if p.FailureMode.StaleAfter > 0 && p.FailureMode.StaleAfter <= p.StreamUpdateInterval {
+		fail("failure_mode.stale_after", "must be longer than stream_update_frequency (%s), or decisions are always stale", p.StreamUpdateFrequency)
+	}
+	if _, err := remediation.NewFailurePolicy(p.FailureMode.Mode, p.FailureMode.Action, p.FailureMode.Hostnames, p.FailureMode.StaleAfter); err != nil {
+		fail("failure_mode", "%v", err)
+	}
+
+	// a missing list uses the defaults, an empty list trusts no proxy
+	if p.TrustedProxies == nil {
+		p.TrustedProxies = DefaultTrustedProxies
+	}
+	trustedProxies := make([]netip.Prefix, 0, len(p.TrustedProxies))
+	for _, raw := range p.TrustedProxies {
+		prefix, err := parsePrefixOrAddr(raw)
+		if err != nil {
+			fail("trusted_proxies", "%q is not an IP address or CIDR range", raw)
+			continue
+		}
+		trustedProxies = append(trustedProxies, prefix)
+	}
+
+	// a missing list uses the default order, an empty list uses no header
+	var ipHeaders []utils.IPHeader
+	if p.IPHeaders != nil {
+		ipHeaders = make([]utils.IPHeader, 0, len(p.IPHeaders))
+		for _, header := range p.IPHeaders {
+			name := strings.TrimSpace(header.Name)
+			if name == "" {
+				fail("ip_headers", "entries must have a name")
+				continue
+			}
+			pick, err := utils.ParseIPPick(header.Pick)
+			if err != nil {
+				fail("ip_headers", "%s: %v", name, err)
+				continue
+			}
+			ipHeaders = append(ipHeaders, utils.IPHeader{Name: name, Pick: pick})
+		}
+	}
+
+	// the embedded Cloudflare ranges are used unless the file exists
+	var cloudflareRanges []netip.Prefix
+	if p.IsProxiedBehindCloudflare {
+		if p.CloudflareIPsFile == "" {
+			p.CloudflareIPsFile = info.CLOUDFLARE_IPS_FILE
+		}
+		cloudflareRanges, err = utils.LoadCloudflareRanges(p.CloudflareIPsFile)
+		if err != nil {
+			fail("cloudflare_ips_file", "%v", err)
+		}
+	}
+
+	p.RealIP = utils.RealIPConfig{
+		IsProxiedBehindCloudflare: p.IsProxiedBehindCloudflare,
+		CloudflareRanges:          cloudflareRanges,
+		TrustedProxies:            trustedProxies,
+		Headers:                   ipHeaders,
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
 	return nil
 }
 
+// openedGeoIP is the last Resolver opened by PostProcess, along with the
+// paths, sizes and modification times of its databases. It is reused while
+// they are unchanged, so that reloads and validations do not read the
+// databases into memory again.
+var openedGeoIP struct {
+	sync.Mutex
+	stamp    string
+	resolver *geoip.Resolver
+}
+
+// openGeoIP opens the GeoIP databases at the given paths, or returns the
+// Resolver opened for them earlier if the files have not changed since.
+func openGeoIP(countryPath, asnPath string) (*geoip.Resolver, error) {
+	stamp := fileStamp(countryPath) + "\x00" + fileStamp(asnPath)
+
+	openedGeoIP.Lock()
+	defer openedGeoIP.Unlock()
+	if openedGeoIP.resolver != nil && openedGeoIP.stamp == stamp {
+		return openedGeoIP.resolver, nil
+	}
+	resolver, err := geoip.Open(countryPath, asnPath)
+	if err != nil {
+		return nil, err
+	}
+	openedGeoIP.stamp, openedGeoIP.resolver = stamp, resolver
+	return resolver, nil
+}
+
+// fileStamp identifies the version of the file at path by its size and
+// modification time. A file that cannot be read only has its path, which
+// Open reports the problem with.
+func fileStamp(path string) string {
+	if path == "" {
+		return ""
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return path
+	}
+	return fmt.Sprintf("%s %d %d", path, stat.Size(), stat.ModTime().UnixNano())
+}
+
+// checkTLS loads the certificate files to report problems with them before
+// connecting, and records their digest in TLSFingerprint.
+func (p *PluginConfig) checkTLS(fail func(field, format string, args ...any)) {
+	switch {
+	case p.CertPath != "" && p.KeyPath == "":
+		fail("key_path", "must be set together with cert_path")
+	case p.CertPath == "" && p.KeyPath != "":
+		fail("cert_path", "must be set together with key_path")
+	case p.CertPath != "":
+		if p.hasAPIKey() {
+			fail("api_key", "set either api_key or cert_path and key_path, not both")
+		}
+		if _, err := tls.LoadX509KeyPair(p.CertPath, p.KeyPath); err != nil {
+			fail("cert_path", "unable to load the client certificate: %v", err)
+		}
+	}
+	if p.CACertPath != "" {
+		if _, err := lapi.LoadCAPool(p.CACertPath); err != nil {
+			fail("ca_cert_path", "%v", err)
+		}
+	}
+
+	digest := sha256.New()
+	for _, path := range []string{p.CertPath, p.KeyPath, p.CACertPath} {
+		if path == "" {
+			continue
+		}
+		// unreadable files are reported above
+		content, _ := os.ReadFile(path)
+		digest.Write(content)
+	}
+	p.TLSFingerprint = hex.EncodeToString(digest.Sum(nil))
+}
+
+// parsePrefixOrAddr parses a CIDR range, or a single IP address as a range
+// containing only that address.
+func parsePrefixOrAddr(raw string) (netip.Prefix, error) {
+	raw = strings.TrimSpace(raw)
+	if addr, err := netip.ParseAddr(raw); err == nil {
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(raw)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
+
 func (p *PluginConfig) LoadConfig() error {
 	configFile, err := os.Open(info.CONFIGURATION_FILE)
 	if err != nil {
@@ -80,7 +729,10 @@ func (p *PluginConfig) LoadConfig() error {
 			if writeErr := os.WriteFile(info.CONFIGURATION_FILE, []byte(defaultConfigTemplate), 0o644); writeErr != nil {
 				return fmt.Errorf("unable to create default config file: %w", writeErr)
 			}
-			return fmt.Errorf("%w: %s (please edit api_key and agent_url, then restart)", ErrConfigCreated, info.CONFIGURATION_FILE)
+			// the plugin starts in onboarding mode unless the environment
+			// provides the API key and agent URL, and the web UI fills in
+			// the rest
+			return p.parse([]byte(defaultConfigTemplate))
 		}
 		return fmt.Errorf("unable to open config file: %w", err)
 	}
@@ -91,14 +743,33 @@ func (p *PluginConfig) LoadConfig() error {
 		return fmt.Errorf("unable to read configuration: %w", err)
 	}
 
-	if err := yaml.Unmarshal(content, p); err != nil {
-		return fmt.Errorf("unable to unmarshal config file: %w", err)
+	return p.parse(content)
+}
+
+// parse unmarshals content into p, applies the environment overrides and
+// post-processes it. Problems are returned as FieldErrors, with the line of
+// config.yaml they are on.
+func (p *PluginConfig) parse(content []byte) error {
+	if err := decodeStrict(content, p); err != nil {
+		return err
+	}
+	sources, err := fileSources(content)
+	if err != nil {
+		return FieldErrors{{Message: err.Error()}}
 	}
+	p.Sources = sources
 
-	// parse the log level string into a logrus Level
 	if err := p.PostProcess(); err != nil {
-		return fmt.Errorf("unable to post-process config: %w", err)
+		// point at the lines of config.yaml holding the invalid settings
+		problems := AsFieldErrors(err)
+		lines := keyLines(content)
+		for i := range problems {
+			if !p.Sources[problems[i].Field].Overridden() {
+				problems[i].Line = lines[problems[i].Field]
+			}
+		}
+		slices.SortStableFunc(problems, func(a, b FieldError) int { return cmp.Compare(a.Line, b.Line) })
+		return problems
 	}
-
 	return nil
 }
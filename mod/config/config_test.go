@@ -1,10 +1,30 @@
 package config
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
+	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/sirupsen/logrus"
 )
 
 func TestPostProcessDefaultsStreamUpdateFrequency(t *testing.T) {
@@ -18,6 +38,105 @@ func TestPostProcessDefaultsStreamUpdateFrequency(t *testing.T) {
 	}
 }
 
+func TestPostProcessParsesTrustedProxies(t *testing.T) {
+	pluginConfig := PluginConfig{LogLevelString: "warning"}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if len(pluginConfig.RealIP.TrustedProxies) != len(DefaultTrustedProxies) {
+		t.Fatalf("TrustedProxies = %v, want the defaults", pluginConfig.RealIP.TrustedProxies)
+	}
+
+	pluginConfig = PluginConfig{LogLevelString: "warning", TrustedProxies: []string{"198.51.100.1", "2001:db8::1/64"}}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	want := []netip.Prefix{netip.MustParsePrefix("198.51.100.1/32"), netip.MustParsePrefix("2001:db8::/64")}
+	for i, prefix := range pluginConfig.RealIP.TrustedProxies {
+		if prefix != want[i] {
+			t.Fatalf("TrustedProxies[%d] = %v, want %v", i, prefix, want[i])
+		}
+	}
+
+	pluginConfig = PluginConfig{LogLevelString: "warning", TrustedProxies: []string{}}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if len(pluginConfig.RealIP.TrustedProxies) != 0 {
+		t.Fatalf("expected an empty list to trust no proxy, got %v", pluginConfig.RealIP.TrustedProxies)
+	}
+
+	pluginConfig = PluginConfig{LogLevelString: "warning", TrustedProxies: []string{"not-a-cidr"}}
+	if err := pluginConfig.PostProcess(); err == nil {
+		t.Fatal("expected an error for an invalid trusted_proxies entry")
+	}
+}
+
+func TestPostProcessLoadsCloudflareRanges(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	pluginConfig := PluginConfig{LogLevelString: "warning", IsProxiedBehindCloudflare: true, CloudflareIPsFile: filepath.Join(tmpDir, "missing.txt")}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if len(pluginConfig.RealIP.CloudflareRanges) != len(utils.DefaultCloudflareRanges()) {
+		t.Fatalf("CloudflareRanges = %v, want the embedded ranges", pluginConfig.RealIP.CloudflareRanges)
+	}
+
+	path := filepath.Join(tmpDir, "cloudflare_ips.txt")
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pluginConfig = PluginConfig{LogLevelString: "warning", IsProxiedBehindCloudflare: true, CloudflareIPsFile: path}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if !pluginConfig.RealIP.IsCloudflare(netip.MustParseAddr("198.51.100.7")) || pluginConfig.RealIP.IsCloudflare(netip.MustParseAddr("104.16.0.1")) {
+		t.Fatalf("CloudflareRanges = %v, want the ranges from %s", pluginConfig.RealIP.CloudflareRanges, path)
+	}
+
+	if err := os.WriteFile(path, []byte("not-a-range\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := pluginConfig.PostProcess(); err == nil {
+		t.Fatal("expected an error for an invalid cloudflare_ips_file")
+	}
+}
+
+func TestPostProcessParsesIPHeaders(t *testing.T) {
+	pluginConfig := PluginConfig{LogLevelString: "warning"}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if pluginConfig.RealIP.Headers != nil {
+		t.Fatalf("expected a missing ip_headers list to use the defaults, got %v", pluginConfig.RealIP.Headers)
+	}
+
+	pluginConfig = PluginConfig{LogLevelString: "warning", IPHeaders: []IPHeaderConfig{
+		{Name: "True-Client-IP"},
+		{Name: "X-Forwarded-For", Pick: "leftmost"},
+	}}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	want := []utils.IPHeader{{Name: "True-Client-IP", Pick: utils.PickRightmostUntrusted}, {Name: "X-Forwarded-For", Pick: utils.PickLeftmost}}
+	if len(pluginConfig.RealIP.Headers) != len(want) {
+		t.Fatalf("Headers = %v, want %v", pluginConfig.RealIP.Headers, want)
+	}
+	for i := range want {
+		if pluginConfig.RealIP.Headers[i] != want[i] {
+			t.Fatalf("Headers[%d] = %v, want %v", i, pluginConfig.RealIP.Headers[i], want[i])
+		}
+	}
+
+	for _, headers := range [][]IPHeaderConfig{{{Name: ""}}, {{Name: "X-Forwarded-For", Pick: "middle"}}} {
+		pluginConfig = PluginConfig{LogLevelString: "warning", IPHeaders: headers}
+		if err := pluginConfig.PostProcess(); err == nil {
+			t.Fatalf("expected an error for ip_headers %v", headers)
+		}
+	}
+}
+
 func TestLoadConfigCreatesDefaultOnMissingFile(t *testing.T) {
 	tmpDir := t.TempDir()
 	originalWD, err := os.Getwd()
@@ -32,10 +151,16 @@ func TestLoadConfigCreatesDefaultOnMissingFile(t *testing.T) {
 		t.Fatalf("Chdir(%q) error = %v", tmpDir, err)
 	}
 
+	// the plugin goes on in onboarding mode with the default settings
 	pluginConfig := PluginConfig{}
-	err = pluginConfig.LoadConfig()
-	if !errors.Is(err, ErrConfigCreated) {
-		t.Fatalf("LoadConfig() error = %v, want ErrConfigCreated", err)
+	if err := pluginConfig.LoadConfig(); err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if missing := pluginConfig.MissingRequiredFields(); len(missing) == 0 {
+		t.Fatal("MissingRequiredFields() = [], want the API key missing")
+	}
+	if pluginConfig.Mode != ModeStream || pluginConfig.LogLevelString == "" {
+		t.Fatalf("LoadConfig() = %+v, want the default settings", pluginConfig)
 	}
 
 	content, err := os.ReadFile(filepath.Join(tmpDir, "config.yaml"))
@@ -47,6 +172,35 @@ func TestLoadConfigCreatesDefaultOnMissingFile(t *testing.T) {
 	}
 }
 
+func TestDefaultConfigHonorsCloudflare(t *testing.T) {
+	// cloudflare_ips_file does not exist there, so the embedded ranges are used
+	t.Chdir(t.TempDir())
+	pluginConfig := PluginConfig{}
+	if err := pluginConfig.parse([]byte(defaultConfigTemplate)); err != nil {
+		t.Fatalf("parse() error = %v", err)
+	}
+
+	logger := logrus.New()
+	for remoteAddr, want := range map[string]string{
+		// a Cloudflare edge, which is not a trusted proxy
+		"173.245.48.1:443": "203.0.113.10",
+		// a client sending the header directly
+		"198.51.100.7:443": "198.51.100.7",
+	} {
+		dsfr := &plugin.DynamicSniffForwardRequest{
+			RemoteAddr: remoteAddr,
+			Header:     map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+		}
+		got, err := utils.GetRealIP(logger, dsfr, pluginConfig.RealIP)
+		if err != nil {
+			t.Fatalf("GetRealIP() error = %v", err)
+		}
+		if got.String() != want {
+			t.Errorf("GetRealIP() from %s = %s, want %s", remoteAddr, got, want)
+		}
+	}
+}
+
 func TestMissingRequiredFields(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -69,6 +223,15 @@ func TestMissingRequiredFields(t *testing.T) {
 			},
 			wantFields: []string{"api_key"},
 		},
+		{
+			name: "client certificate instead of api key",
+			cfg: PluginConfig{
+				CertPath: "/etc/crowdsec/tls/bouncer.pem",
+				KeyPath:  "/etc/crowdsec/tls/bouncer-key.pem",
+				AgentUrl: "http://127.0.0.1:8080",
+			},
+			wantFields: []string{},
+		},
 		{
 			name: "all required fields present",
 			cfg: PluginConfig{
@@ -94,3 +257,678 @@ func TestMissingRequiredFields(t *testing.T) {
 		})
 	}
 }
+
+func TestReadConfigRejectsInvalidFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	if _, err := ReadConfig(filepath.Join(tmpDir, "missing.yaml")); err == nil {
+		t.Fatal("expected an error for a missing file")
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "missing.yaml")); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("ReadConfig() must not create the file, Stat() error = %v", err)
+	}
+
+	for name, content := range map[string]string{
+		"bad yaml":      "agent_url: [",
+		"bad log level": "log_level: loud\n",
+		"bad duration":  "remediation:\n  tarpit_delay: soon\n",
+	} {
+		path := filepath.Join(tmpDir, "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ReadConfig(path); err == nil {
+			t.Errorf("ReadConfig(%s) expected an error", name)
+		}
+	}
+
+	path := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(path, []byte(defaultConfigTemplate), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	pluginConfig, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig(default) error = %v", err)
+	}
+	if pluginConfig.AgentUrl != "http://127.0.0.1:8080" || pluginConfig.LogLevel != logrus.WarnLevel {
+		t.Fatalf("ReadConfig(default) = %+v", pluginConfig)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	t.Setenv(captcha.AllowFakeEnv, "true")
+	parse := func(t *testing.T, content string) *PluginConfig {
+		t.Helper()
+		pluginConfig := &PluginConfig{}
+		if err := pluginConfig.parse([]byte(content)); err != nil {
+			t.Fatalf("parse() error = %v", err)
+		}
+		return pluginConfig
+	}
+	base := "api_key: key\nagent_url: http://127.0.0.1:8080\n"
+	countryDatabase := writeGeoIPDatabase(t, t.TempDir(), "GeoLite2-Country")
+
+	tests := []struct {
+		name     string
+		reloaded string
+		want     Changes
+	}{
+		{name: "no change", reloaded: base},
+		{name: "api key", reloaded: "api_key: other\nagent_url: http://127.0.0.1:8080\n", want: Changes{Bouncer: true}},
+		{name: "agent url", reloaded: "api_key: key\nagent_url: http://10.0.0.2:8080\n", want: Changes{Bouncer: true}},
+		{name: "agent urls", reloaded: "api_key: key\nagent_urls:\n  - http://127.0.0.1:8080\n  - http://10.0.0.2:8080\n", want: Changes{Bouncer: true}},
+		{name: "stream frequency", reloaded: base + "stream_update_frequency: 1m\n", want: Changes{Bouncer: true}},
+		{name: "mode", reloaded: base + "mode: live\n", want: Changes{Bouncer: true}},
+		{name: "decision filters", reloaded: base + "decision_filters:\n  origins: [crowdsec]\n", want: Changes{Bouncer: true}},
+		{name: "geoip", reloaded: base + "geoip:\n  country_database: " + countryDatabase + "\n", want: Changes{Bouncer: true, Live: []string{"geoip"}}},
+		{name: "live settings in stream mode", reloaded: base + "live:\n  timeout: 1s\n", want: Changes{}},
+		{name: "log level", reloaded: base + "log_level: debug\n", want: Changes{Live: []string{"log_level"}}},
+		{name: "trusted proxies", reloaded: base + "trusted_proxies: []\n", want: Changes{Live: []string{"client IP"}}},
+		{name: "ip headers", reloaded: base + "ip_headers:\n  - name: X-Real-IP\n", want: Changes{Live: []string{"client IP"}}},
+		{name: "remediation", reloaded: base + "remediation:\n  types:\n    ban: tarpit\n", want: Changes{Live: []string{"remediation"}}},
+		{name: "captcha", reloaded: base + "captcha:\n  provider: fake\n", want: Changes{Restart: []string{"captcha"}}},
+		{name: "failure mode", reloaded: base + "failure_mode:\n  mode: closed\n", want: Changes{Restart: []string{"failure_mode"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes := Diff(parse(t, base), parse(t, tt.reloaded))
+			if changes.Bouncer != tt.want.Bouncer || !slices.Equal(changes.Live, tt.want.Live) || !slices.Equal(changes.Restart, tt.want.Restart) {
+				t.Fatalf("Diff() = %+v, want %+v", changes, tt.want)
+			}
+			if changes.Empty() != tt.want.Empty() {
+				t.Fatalf("Empty() = %v", changes.Empty())
+			}
+		})
+	}
+}
+
+func TestPostProcessAgentURLs(t *testing.T) {
+	pluginConfig := PluginConfig{APIKey: "key", AgentURLs: []string{"http://lapi-1:8080", "http://lapi-2:8080"}}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if !slices.Equal(pluginConfig.Endpoints, pluginConfig.AgentURLs) || len(pluginConfig.MissingRequiredFields()) != 0 {
+		t.Fatalf("Endpoints = %v, missing = %v", pluginConfig.Endpoints, pluginConfig.MissingRequiredFields())
+	}
+
+	for name, invalid := range map[string]PluginConfig{
+		"both":      {AgentUrl: "http://lapi-1:8080", AgentURLs: []string{"http://lapi-2:8080"}},
+		"duplicate": {AgentURLs: []string{"http://lapi-1:8080", "http://lapi-1:8080"}},
+		"not http":  {AgentURLs: []string{"http://lapi-1:8080", "lapi-2:8080"}},
+	} {
+		err := invalid.PostProcess()
+		if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != "agent_urls" {
+			t.Errorf("%s: PostProcess() errors = %v, want one for agent_urls", name, err)
+		}
+	}
+}
+
+// writeGeoIPDatabase writes an empty MaxMind database of databaseType in dir.
+func writeGeoIPDatabase(t *testing.T, dir, databaseType string) string {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: databaseType})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, databaseType+".mmdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := tree.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPostProcessGeoIP(t *testing.T) {
+	dir := t.TempDir()
+	countryPath := writeGeoIPDatabase(t, dir, "GeoLite2-Country")
+	asnPath := writeGeoIPDatabase(t, dir, "GeoLite2-ASN")
+
+	pluginConfig := PluginConfig{GeoIP: GeoIPConfig{CountryDatabase: countryPath, ASNDatabase: asnPath}}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if !pluginConfig.GeoIP.Resolver.Enabled() {
+		t.Fatal("PostProcess() did not read the databases")
+	}
+	if scopes := pluginConfig.DecisionFilter().Scopes; !slices.Equal(scopes, []string{"ip", "range", "country", "as"}) {
+		t.Fatalf("DecisionFilter() scopes = %v, want the country and AS ones added", scopes)
+	}
+
+	// unchanged databases are not read again, updated ones are
+	reloaded := PluginConfig{GeoIP: pluginConfig.GeoIP}
+	if err := reloaded.PostProcess(); err != nil || reloaded.GeoIP.Resolver != pluginConfig.GeoIP.Resolver {
+		t.Fatalf("PostProcess() read unchanged databases again, error = %v", err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(countryPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloaded.PostProcess(); err != nil || reloaded.GeoIP.Resolver == pluginConfig.GeoIP.Resolver {
+		t.Fatalf("PostProcess() did not read an updated database, error = %v", err)
+	}
+
+	for name, geoIP := range map[string]GeoIPConfig{
+		"missing database":  {CountryDatabase: filepath.Join(dir, "missing.mmdb")},
+		"swapped databases": {CountryDatabase: asnPath, ASNDatabase: countryPath},
+	} {
+		invalid := PluginConfig{GeoIP: geoIP}
+		err := invalid.PostProcess()
+		if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != "geoip" {
+			t.Errorf("%s: PostProcess() errors = %v, want one for geoip", name, err)
+		}
+	}
+}
+
+// writeCertificate writes a self-signed certificate and its key to PEM files
+// in dir.
+func writeCertificate(t *testing.T, dir string) (certPath, keyPath string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "bouncer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath, keyPath = filepath.Join(dir, "bouncer.pem"), filepath.Join(dir, "bouncer-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestPostProcessClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certPath, keyPath := writeCertificate(t, dir)
+
+	pluginConfig := PluginConfig{APIKey: PlaceholderAPIKey, AgentUrl: "https://lapi:8080", CertPath: certPath, KeyPath: keyPath, CACertPath: certPath}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if missing := pluginConfig.MissingRequiredFields(); len(missing) != 0 {
+		t.Fatalf("MissingRequiredFields() = %v, want none with a client certificate", missing)
+	}
+	if pluginConfig.LAPIKey() != "" {
+		t.Fatalf("LAPIKey() = %q, want none with a client certificate", pluginConfig.LAPIKey())
+	}
+
+	// renewing the certificate reconnects on reload
+	renewed := pluginConfig
+	writeCertificate(t, dir)
+	if err := renewed.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if !Diff(&pluginConfig, &renewed).Bouncer {
+		t.Fatal("Diff() must restart the bouncer when the certificate changes")
+	}
+
+	missing := filepath.Join(dir, "missing.pem")
+	for name, tt := range map[string]struct {
+		cfg   PluginConfig
+		field string
+	}{
+		"cert without key":  {PluginConfig{CertPath: certPath}, "key_path"},
+		"key without cert":  {PluginConfig{KeyPath: keyPath}, "cert_path"},
+		"with an api key":   {PluginConfig{APIKey: "key", CertPath: certPath, KeyPath: keyPath}, "api_key"},
+		"mismatched pair":   {PluginConfig{CertPath: certPath, KeyPath: certPath}, "cert_path"},
+		"missing CA":        {PluginConfig{CACertPath: missing}, "ca_cert_path"},
+		"CA without a cert": {PluginConfig{CACertPath: keyPath}, "ca_cert_path"},
+	} {
+		err := tt.cfg.PostProcess()
+		if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != tt.field {
+			t.Errorf("%s: PostProcess() errors = %v, want one for %s", name, err, tt.field)
+		}
+	}
+}
+
+func TestPostProcessMode(t *testing.T) {
+	pluginConfig := PluginConfig{APIKey: "key", AgentUrl: "http://lapi:8080", Mode: ModeLive}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	if pluginConfig.Live.CacheTTL != time.Minute || pluginConfig.Live.NegativeCacheTTL != 10*time.Second || pluginConfig.Live.Timeout != 500*time.Millisecond {
+		t.Fatalf("Live = %+v, want the defaults", pluginConfig.Live)
+	}
+
+	for name, tt := range map[string]struct {
+		cfg   PluginConfig
+		field string
+	}{
+		"unknown mode":      {PluginConfig{Mode: "poll"}, "mode"},
+		"negative ttl":      {PluginConfig{Live: LiveConfig{CacheTTLString: "-1s"}}, "live.cache_ttl"},
+		"timeout too short": {PluginConfig{Live: LiveConfig{TimeoutString: "1ms"}}, "live.timeout"},
+		"timeout too long":  {PluginConfig{Live: LiveConfig{TimeoutString: "1m"}}, "live.timeout"},
+	} {
+		err := tt.cfg.PostProcess()
+		if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != tt.field {
+			t.Errorf("%s: PostProcess() errors = %v, want one for %s", name, err, tt.field)
+		}
+	}
+}
+
+func TestPostProcessDecisionFilters(t *testing.T) {
+	pluginConfig := PluginConfig{DecisionFilters: FiltersConfig{Origins: []string{"crowdsec", "cscli"}, Scopes: []string{"Range", "country"}}}
+	if err := pluginConfig.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() error = %v", err)
+	}
+	filter := pluginConfig.DecisionFilters.Filter()
+	if !slices.Equal(filter.Scopes, []string{"ip", "range", "country"}) || !slices.Equal(filter.Origins, []string{"crowdsec", "cscli"}) {
+		t.Fatalf("Filter() = %+v", filter)
+	}
+	if pluginConfig.DecisionFilters.ScenariosContaining == nil {
+		t.Fatal("PostProcess() left an unset filter nil")
+	}
+
+	invalid := PluginConfig{DecisionFilters: FiltersConfig{ScenariosNotContaining: []string{"ssh,http"}}}
+	err := invalid.PostProcess()
+	if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != "decision_filters.scenarios_not_containing" {
+		t.Fatalf("PostProcess() errors = %v, want one for decision_filters.scenarios_not_containing", err)
+	}
+}
+
+func TestFakeCaptchaRequiresOptIn(t *testing.T) {
+	fake := PluginConfig{Captcha: CaptchaConfig{Provider: captcha.FakeProviderName}}
+	err := fake.PostProcess()
+	if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != "captcha.provider" {
+		t.Fatalf("PostProcess() errors = %v, want the fake provider refused", err)
+	}
+
+	t.Setenv(captcha.AllowFakeEnv, "true")
+	if err := fake.PostProcess(); err != nil {
+		t.Fatalf("PostProcess() with %s error = %v", captcha.AllowFakeEnv, err)
+	}
+}
+
+func TestMaskedAndRestoreSecrets(t *testing.T) {
+	running := &PluginConfig{
+		APIKey:  "secret-api-key",
+		Captcha: CaptchaConfig{SecretKey: "captcha-secret", CookieSecret: ""},
+	}
+
+	masked := running.Masked()
+	if masked.APIKey != MaskedSecret || masked.Captcha.SecretKey != MaskedSecret {
+		t.Fatalf("Masked() = %+v, want secrets masked", masked)
+	}
+	if masked.Captcha.CookieSecret != "" {
+		t.Fatalf("Masked() must keep empty secrets empty, got %q", masked.Captcha.CookieSecret)
+	}
+	if running.APIKey != "secret-api-key" {
+		t.Fatalf("Masked() modified the original configuration")
+	}
+	if placeholder := (&PluginConfig{APIKey: PlaceholderAPIKey}).Masked(); placeholder.APIKey != PlaceholderAPIKey {
+		t.Fatalf("Masked() must keep the placeholder API key, got %q", placeholder.APIKey)
+	}
+
+	updated := *masked
+	updated.Captcha.SecretKey = "new-captcha-secret"
+	if err := updated.RestoreSecrets(running); err != nil {
+		t.Fatalf("RestoreSecrets() error = %v", err)
+	}
+	if updated.APIKey != "secret-api-key" {
+		t.Fatalf("RestoreSecrets() APIKey = %q, want the running key", updated.APIKey)
+	}
+	if updated.Captcha.SecretKey != "new-captcha-secret" {
+		t.Fatalf("RestoreSecrets() replaced a changed secret with %q", updated.Captcha.SecretKey)
+	}
+
+	// masked secrets are not sent to another server
+	moved := *masked
+	moved.AgentUrl = "http://attacker.example:8080"
+	moved.Captcha.VerifyURL = "http://attacker.example/siteverify"
+	err := moved.RestoreSecrets(running)
+	if got := AsFieldErrors(err); len(got) != 2 || got[0].Field != "api_key" || got[1].Field != "captcha.secret_key" {
+		t.Fatalf("RestoreSecrets() with other servers: errors = %v, want api_key and captcha.secret_key", err)
+	}
+	if moved.APIKey != MaskedSecret || moved.Captcha.SecretKey != MaskedSecret {
+		t.Fatalf("RestoreSecrets() restored secrets for other servers: %+v", moved)
+	}
+	insecure := *masked
+	insecure.InsecureSkipVerify = true
+	if err := insecure.RestoreSecrets(running); err == nil || insecure.APIKey != MaskedSecret {
+		t.Fatalf("RestoreSecrets() restored the API key with other TLS settings")
+	}
+}
+
+func TestWriteConfigRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(defaultConfigTemplate), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	pluginConfig, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluginConfig.APIKey = "written-api-key"
+	pluginConfig.TrustedProxies = []string{"10.0.0.0/8"}
+	pluginConfig.IPHeaders = nil
+
+	if err := WriteConfig(path, pluginConfig); err != nil {
+		t.Fatalf("WriteConfig() error = %v", err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o600 {
+		t.Fatalf("WriteConfig() changed the permissions to %v", info.Mode().Perm())
+	}
+
+	written, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig(written) error = %v", err)
+	}
+	if written.APIKey != "written-api-key" || !slices.Equal(written.TrustedProxies, []string{"10.0.0.0/8"}) {
+		t.Fatalf("ReadConfig(written) = %+v", written)
+	}
+	// a missing ip_headers list is written as the defaults, not as no header
+	if len(written.RealIP.Headers) != len(utils.DefaultIPHeaders) {
+		t.Fatalf("ReadConfig(written) headers = %v, want the defaults", written.RealIP.Headers)
+	}
+	if changes := Diff(pluginConfig, written); changes.Bouncer || len(changes.Restart) > 0 {
+		t.Fatalf("Diff(written) = %+v, want no bouncer or restart changes", changes)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	lapiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "valid" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("null"))
+	}))
+	defer lapiServer.Close()
+
+	tests := []struct {
+		name    string
+		config  PluginConfig
+		wantErr bool
+		// reachable is whether each endpoint was reached, or nil if the
+		// connections were not checked
+		reachable []bool
+	}{
+		{"valid", PluginConfig{APIKey: "valid", AgentUrl: lapiServer.URL}, false, []bool{true}},
+		{"missing key", PluginConfig{AgentUrl: lapiServer.URL}, true, nil},
+		{"rejected key", PluginConfig{APIKey: "wrong", AgentUrl: lapiServer.URL}, true, []bool{true}},
+		// LAPI may only be down for a moment
+		{"unreachable", PluginConfig{APIKey: "valid", AgentUrl: "http://127.0.0.1:1"}, false, []bool{false}},
+		{"one of several unreachable", PluginConfig{APIKey: "valid", AgentURLs: []string{"http://127.0.0.1:1", lapiServer.URL}}, false, []bool{false, true}},
+		{"rejected by one of several", PluginConfig{APIKey: "wrong", AgentURLs: []string{"http://127.0.0.1:1", lapiServer.URL}}, true, []bool{false, true}},
+	}
+	for _, tt := range tests {
+		tt.config.LogLevelString = "warning"
+		if err := tt.config.PostProcess(); err != nil {
+			t.Fatalf("%s: PostProcess() error = %v", tt.name, err)
+		}
+		validation := tt.config.Validate(context.Background(), true)
+		if err := validation.Err(); (err != nil) != tt.wantErr || (err != nil && !errors.Is(err, ErrInvalidConfig)) {
+			t.Errorf("%s: Validate().Err() = %v, want error %v", tt.name, err, tt.wantErr)
+		}
+		reachable := make([]bool, 0, len(validation.Connections))
+		for _, check := range validation.Connections {
+			reachable = append(reachable, check.Reachable)
+		}
+		if !slices.Equal(reachable, tt.reachable) {
+			t.Errorf("%s: Validate().Connections = %+v, want reachable %v", tt.name, validation.Connections, tt.reachable)
+		}
+	}
+
+	if validation := (&PluginConfig{APIKey: "valid", AgentUrl: lapiServer.URL, StreamUpdateFrequency: "5s"}).Validate(context.Background(), false); validation.Connections != nil {
+		t.Fatalf("Validate(checkConnection=false) checked the connection: %+v", validation.Connections)
+	}
+}
+
+func TestEnvOverrides(t *testing.T) {
+	tmpDir := t.TempDir()
+	keyFile := filepath.Join(tmpDir, "api_key")
+	if err := os.WriteFile(keyFile, []byte("key-from-secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmpDir, "config.yaml")
+	if err := os.WriteFile(path, []byte("api_key: key-from-file\nagent_url: http://127.0.0.1:8080\nlog_level: info\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("ZCB_AGENT_URL", "http://crowdsec:8080")
+	t.Setenv("ZCB_API_KEY_FILE", keyFile)
+	t.Setenv("ZCB_TRUSTED_PROXIES", "10.0.0.0/8, 192.168.1.1")
+	t.Setenv("ZCB_IP_HEADERS", "X-Real-IP,X-Forwarded-For:leftmost")
+	t.Setenv("ZCB_REMEDIATION_TYPES", "ban=tarpit,custom=log")
+	t.Setenv("ZCB_FAILURE_MODE_STALE_AFTER", "1m")
+
+	pluginConfig, err := ReadConfig(path)
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	if pluginConfig.AgentUrl != "http://crowdsec:8080" || pluginConfig.APIKey != "key-from-secret" {
+		t.Fatalf("ReadConfig() agent_url = %q, api_key = %q", pluginConfig.AgentUrl, pluginConfig.APIKey)
+	}
+	if !slices.Equal(pluginConfig.TrustedProxies, []string{"10.0.0.0/8", "192.168.1.1"}) {
+		t.Fatalf("ReadConfig() trusted_proxies = %v", pluginConfig.TrustedProxies)
+	}
+	wantHeaders := []utils.IPHeader{{Name: "X-Real-IP", Pick: utils.PickRightmostUntrusted}, {Name: "X-Forwarded-For", Pick: utils.PickLeftmost}}
+	if !slices.Equal(pluginConfig.RealIP.Headers, wantHeaders) {
+		t.Fatalf("ReadConfig() headers = %v, want %v", pluginConfig.RealIP.Headers, wantHeaders)
+	}
+	if pluginConfig.Remediation.Types["custom"] != "log" || pluginConfig.FailureMode.StaleAfter != time.Minute {
+		t.Fatalf("ReadConfig() remediation = %+v, failure_mode = %+v", pluginConfig.Remediation, pluginConfig.FailureMode)
+	}
+
+	for path, want := range map[string]ValueSource{
+		"api_key":                  {Kind: SourceSecretFile, Name: keyFile},
+		"api_key_file":             {Kind: SourceEnv, Name: "ZCB_API_KEY_FILE"},
+		"agent_url":                {Kind: SourceEnv, Name: "ZCB_AGENT_URL"},
+		"failure_mode.stale_after": {Kind: SourceEnv, Name: "ZCB_FAILURE_MODE_STALE_AFTER"},
+		"log_level":                {Kind: SourceConfigFile},
+		"captcha.provider":         {Kind: SourceDefault},
+	} {
+		if got := pluginConfig.Sources[path]; got != want {
+			t.Errorf("Sources[%s] = %+v, want %+v", path, got, want)
+		}
+	}
+
+	// overridden settings keep their value from config.yaml when it is saved
+	pluginConfig.LogLevelString = "debug"
+	if err := WriteConfig(path, pluginConfig); err != nil {
+		t.Fatalf("WriteConfig() error = %v", err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leaked := range []string{"key-from-secret", "crowdsec:8080", keyFile} {
+		if strings.Contains(string(content), leaked) {
+			t.Errorf("WriteConfig() wrote the overridden value %q", leaked)
+		}
+	}
+	if !strings.Contains(string(content), "key-from-file") || !strings.Contains(string(content), "log_level: debug") {
+		t.Errorf("WriteConfig() = %s", content)
+	}
+
+	t.Setenv("ZCB_IS_PROXIED_BEHIND_CLOUDFLARE", "maybe")
+	if _, err := ReadConfig(path); err == nil {
+		t.Fatal("expected an error for an invalid boolean override")
+	}
+}
+
+func TestAPIKeyFileErrors(t *testing.T) {
+	tmpDir := t.TempDir()
+	empty := filepath.Join(tmpDir, "empty")
+	if err := os.WriteFile(empty, []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, keyFile := range []string{empty, filepath.Join(tmpDir, "missing")} {
+		pluginConfig := PluginConfig{LogLevelString: "warning", APIKeyFile: keyFile}
+		if err := pluginConfig.PostProcess(); err == nil {
+			t.Errorf("PostProcess(api_key_file %s) expected an error", keyFile)
+		}
+	}
+}
+
+func TestPostProcessReportsEveryProblem(t *testing.T) {
+	pluginConfig := PluginConfig{
+		AgentUrl:              "crowdsec:8080",
+		StreamUpdateFrequency: "often",
+		LogLevelString:        "loud",
+		TrustedProxies:        []string{"10.0.0.0/8", "not-an-ip"},
+		Remediation:           RemediationConfig{Types: map[string]string{"ban": "explode"}, TarpitDelayString: "1h"},
+		FailureMode:           FailureModeConfig{StaleAfterString: "5s"},
+	}
+	t.Setenv("ZCB_IS_PROXIED_BEHIND_CLOUDFLARE", "maybe")
+
+	err := pluginConfig.PostProcess()
+	if !errors.Is(err, ErrInvalidConfig) {
+		t.Fatalf("PostProcess() error = %v, want ErrInvalidConfig", err)
+	}
+	var fields []string
+	for _, problem := range AsFieldErrors(err) {
+		fields = append(fields, problem.Field)
+	}
+	want := []string{"is_proxied_behind_cloudflare", "log_level", "agent_url", "stream_update_frequency", "remediation.types", "remediation.tarpit_delay", "trusted_proxies"}
+	if !slices.Equal(fields, want) {
+		t.Fatalf("PostProcess() problems = %v (%v), want %v", fields, err, want)
+	}
+
+	// stale_after is checked against the stream update frequency
+	pluginConfig = PluginConfig{StreamUpdateFrequency: "1m", FailureMode: FailureModeConfig{StaleAfterString: "30s"}}
+	t.Setenv("ZCB_IS_PROXIED_BEHIND_CLOUDFLARE", "false")
+	if problems := AsFieldErrors(pluginConfig.PostProcess()); len(problems) != 1 || problems[0].Field != "failure_mode.stale_after" {
+		t.Fatalf("PostProcess() problems = %v, want failure_mode.stale_after", problems)
+	}
+}
+
+func TestReadConfigReportsLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "agent_url: http://127.0.0.1:8080\nstream_update_frequncy: 5s\ncaptcha:\n  provider: nope\n  cookie_tll: 1m\nremediation:\n  tarpit_delay: soon\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// unknown keys are reported before the values are checked
+	_, err := ReadConfig(path)
+	want := FieldErrors{
+		{Field: "stream_update_frequncy", Line: 2, Message: "unknown setting"},
+		{Field: "captcha.cookie_tll", Line: 5, Message: "unknown setting"},
+	}
+	if got := AsFieldErrors(err); !slices.Equal(got, want) {
+		t.Fatalf("ReadConfig() errors = %v, want %v", got, want)
+	}
+
+	content = strings.NewReplacer("stream_update_frequncy", "stream_update_frequency", "cookie_tll", "cookie_ttl").Replace(content)
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ReadConfig(path)
+	got := AsFieldErrors(err)
+	if len(got) != 2 || got[0].Field != "captcha.provider" || got[0].Line != 4 || got[1].Field != "remediation.tarpit_delay" || got[1].Line != 7 {
+		t.Fatalf("ReadConfig() errors = %v", got)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Setenv(captcha.AllowFakeEnv, "true")
+	// the configuration shape before config_version was added
+	original := "# my bouncer\napi_key: secret # from cscli\nagent_url: http://127.0.0.1:8080\nlog_level: info\ncaptcha:\n  provider: fake\n"
+
+	migrated, err := Migrate([]byte(original))
+	if err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	if !strings.HasPrefix(string(migrated), original) {
+		t.Fatalf("Migrate() did not keep the original content and comments:\n%s", migrated)
+	}
+	for _, added := range []string{"\ntrusted_proxies:\n", "\nip_headers:\n", "\nremediation:\n", "\nfailure_mode:\n", "\nmode: stream\n", "\nlive:\n", "\ndecision_filters:\n", "\ngeoip:\n", "\nconfig_version: 4\n"} {
+		if !strings.Contains(string(migrated), added) {
+			t.Errorf("Migrate() did not add %q", strings.TrimSpace(added))
+		}
+	}
+	if strings.Count(string(migrated), "\ncaptcha:\n") != 1 {
+		t.Errorf("Migrate() added captcha, which is already set")
+	}
+	if again, err := Migrate(migrated); err != nil || string(again) != string(migrated) {
+		t.Fatalf("Migrate() changed a current configuration: %v", err)
+	}
+
+	// the added settings are the defaults, so nothing changes
+	before, after := &PluginConfig{}, &PluginConfig{}
+	if err := before.parse([]byte(original)); err != nil {
+		t.Fatal(err)
+	}
+	if err := after.parse(migrated); err != nil {
+		t.Fatalf("the migrated configuration does not parse: %v", err)
+	}
+	if changes := Diff(before, after); !changes.Empty() {
+		t.Fatalf("Diff() = %+v, want no change", changes)
+	}
+	if after.ConfigVersion != CurrentConfigVersion {
+		t.Fatalf("ConfigVersion = %d, want %d", after.ConfigVersion, CurrentConfigVersion)
+	}
+
+	if _, err := Migrate([]byte("config_version: 99\n")); err == nil {
+		t.Fatal("expected an error for a newer config_version")
+	}
+}
+
+func TestMigrateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	original := "api_key: secret\nagent_url: http://127.0.0.1:8080\n"
+	if err := os.WriteFile(path, []byte(original), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	migration, err := MigrateFile(path)
+	if err != nil || migration == nil {
+		t.Fatalf("MigrateFile() = %v, %v", migration, err)
+	}
+	if migration.From != 0 || migration.To != CurrentConfigVersion || migration.Backup != path+".v0.bak" {
+		t.Fatalf("MigrateFile() = %+v", migration)
+	}
+	backup, err := os.ReadFile(migration.Backup)
+	if err != nil || string(backup) != original {
+		t.Fatalf("backup = %q, %v, want the original file", backup, err)
+	}
+	for _, file := range []string{path, migration.Backup} {
+		if info, err := os.Stat(file); err != nil || info.Mode().Perm() != 0o600 {
+			t.Fatalf("%s permissions = %v, %v, want 0600", file, info.Mode().Perm(), err)
+		}
+	}
+	pluginConfig, err := ReadConfig(path)
+	if err != nil || pluginConfig.ConfigVersion != CurrentConfigVersion || pluginConfig.APIKey != "secret" {
+		t.Fatalf("ReadConfig() = %+v, %v", pluginConfig, err)
+	}
+
+	// a current file is left alone
+	if migration, err := MigrateFile(path); migration != nil || err != nil {
+		t.Fatalf("MigrateFile() = %+v, %v, want nothing to do", migration, err)
+	}
+	// a newer file is reported when it is read
+	if err := os.WriteFile(path, []byte(original+"config_version: 99\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if migration, err := MigrateFile(path); migration != nil || err != nil {
+		t.Fatalf("MigrateFile() = %+v, %v, want nothing to do", migration, err)
+	}
+	_, err = ReadConfig(path)
+	if got := AsFieldErrors(err); len(got) != 1 || got[0].Field != "config_version" || got[0].Line != 3 {
+		t.Fatalf("ReadConfig() errors = %v", got)
+	}
+}
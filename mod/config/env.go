@@ -0,0 +1,197 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// EnvPrefix starts the environment variables that override settings. The
+// rest of the name is the setting's YAML path in upper case, with sections
+// joined by underscores, e.g. ZCB_AGENT_URL or ZCB_CAPTCHA_SITE_KEY.
+const EnvPrefix = "ZCB_"
+
+// Where the effective value of a setting comes from.
+const (
+	SourceDefault    = "default"
+	SourceConfigFile = "config_file"
+	SourceEnv        = "env"
+	SourceSecretFile = "secret_file"
+)
+
+// ValueSource tells where the effective value of a setting comes from.
+type ValueSource struct {
+	Kind string `json:"kind"`
+	// Name is the environment variable or secret file the value was read
+	// from.
+	Name string `json:"name,omitempty"`
+}
+
+// Overridden reports whether the value comes from outside config.yaml, in
+// which case editing config.yaml does not change it.
+func (s ValueSource) Overridden() bool {
+	return s.Kind == SourceEnv || s.Kind == SourceSecretFile
+}
+
+// setting is a single configuration value, addressed by its YAML path.
+type setting struct {
+	path  string
+	value reflect.Value
+}
+
+// settings lists the settings of p in declaration order. Sections are
+// flattened, while lists and maps are single settings. config_version
+// describes the file rather than the plugin, so it is not a setting.
+func (p *PluginConfig) settings() []setting {
+	var settings []setting
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		for i := range v.NumField() {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("yaml"), ",")
+			if name == "" || name == "-" || name == "config_version" {
+				continue
+			}
+			field := v.Field(i)
+			if field.Kind() == reflect.Struct {
+				walk(prefix+name+".", field)
+				continue
+			}
+			settings = append(settings, setting{path: prefix + name, value: field})
+		}
+	}
+	walk("", reflect.ValueOf(p).Elem())
+	return settings
+}
+
+// EnvName returns the environment variable that overrides the setting at
+// path.
+func EnvName(path string) string {
+	return EnvPrefix + strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// ApplyOverrides applies the environment variable overrides to p, then
+// reads the API key from api_key_file if one is set. Settings that are not
+// overridden keep the source recorded when p was read, or config.yaml. It is
+// called by PostProcess.
+func (p *PluginConfig) ApplyOverrides() error {
+	if p.Sources == nil {
+		p.Sources = make(map[string]ValueSource)
+	}
+	var problems FieldErrors
+	for _, s := range p.settings() {
+		name := EnvName(s.path)
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			if _, known := p.Sources[s.path]; !known {
+				p.Sources[s.path] = ValueSource{Kind: SourceConfigFile}
+			}
+			continue
+		}
+		if err := setFromEnv(s.value, raw); err != nil {
+			problems = append(problems, FieldError{Field: s.path, Message: fmt.Sprintf("unable to parse %s: %v", name, err)})
+			continue
+		}
+		p.Sources[s.path] = ValueSource{Kind: SourceEnv, Name: name}
+	}
+
+	if p.APIKeyFile != "" {
+		content, err := os.ReadFile(p.APIKeyFile)
+		if err != nil {
+			problems = append(problems, FieldError{Field: "api_key_file", Message: fmt.Sprintf("unable to read the API key: %v", err)})
+		} else if p.APIKey = strings.TrimSpace(string(content)); p.APIKey == "" {
+			problems = append(problems, FieldError{Field: "api_key_file", Message: fmt.Sprintf("%s is empty", p.APIKeyFile)})
+		}
+		p.Sources["api_key"] = ValueSource{Kind: SourceSecretFile, Name: p.APIKeyFile}
+	}
+
+	if len(problems) > 0 {
+		return problems
+	}
+	return nil
+}
+
+// setFromEnv parses raw into value. Lists are comma separated, maps are
+// comma separated key=value pairs, and ip_headers entries are name:pick.
+func setFromEnv(value reflect.Value, raw string) error {
+	switch value.Interface().(type) {
+	case string:
+		value.SetString(raw)
+	case bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return err
+		}
+		value.SetBool(parsed)
+	case []string:
+		value.Set(reflect.ValueOf(splitList(raw)))
+	case map[string]string:
+		parsed := make(map[string]string)
+		for _, pair := range splitList(raw) {
+			key, val, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("expected key=value, got %q", pair)
+			}
+			parsed[strings.TrimSpace(key)] = strings.TrimSpace(val)
+		}
+		value.Set(reflect.ValueOf(parsed))
+	case []IPHeaderConfig:
+		headers := []IPHeaderConfig{}
+		for _, entry := range splitList(raw) {
+			name, pick, _ := strings.Cut(entry, ":")
+			headers = append(headers, IPHeaderConfig{Name: strings.TrimSpace(name), Pick: strings.TrimSpace(pick)})
+		}
+		value.Set(reflect.ValueOf(headers))
+	default:
+		return fmt.Errorf("unsupported setting type %s", value.Type())
+	}
+	return nil
+}
+
+// splitList splits a comma separated list. An empty string is an empty list.
+func splitList(raw string) []string {
+	items := []string{}
+	for item := range strings.SplitSeq(raw, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// fileSources records which settings are set in the YAML content, and which
+// are left to their defaults.
+func fileSources(content []byte) (map[string]ValueSource, error) {
+	var tree map[string]any
+	if err := yaml.Unmarshal(content, &tree); err != nil {
+		return nil, err
+	}
+
+	sources := make(map[string]ValueSource)
+	for _, s := range (&PluginConfig{}).settings() {
+		sources[s.path] = ValueSource{Kind: SourceDefault}
+		if hasPath(tree, strings.Split(s.path, ".")) {
+			sources[s.path] = ValueSource{Kind: SourceConfigFile}
+		}
+	}
+	return sources, nil
+}
+
+func hasPath(tree map[string]any, path []string) bool {
+	value, ok := tree[path[0]]
+	if !ok || len(path) == 1 {
+		return ok
+	}
+	section, ok := value.(map[any]any)
+	if !ok {
+		return false
+	}
+	converted := make(map[string]any, len(section))
+	for key, value := range section {
+		converted[fmt.Sprint(key)] = value
+	}
+	return hasPath(converted, path[1:])
+}
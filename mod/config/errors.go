@@ -0,0 +1,140 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FieldError is a problem with one setting.
+type FieldError struct {
+	// Field is the YAML path of the setting, e.g. captcha.cookie_ttl. It is
+	// empty for problems with the file as a whole.
+	Field string `json:"field,omitempty"`
+	// Line is the line of config.yaml the setting is on, if known.
+	Line    int    `json:"line,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e FieldError) Error() string {
+	var b strings.Builder
+	if e.Line > 0 {
+		fmt.Fprintf(&b, "line %d: ", e.Line)
+	}
+	if e.Field != "" {
+		b.WriteString(e.Field + ": ")
+	}
+	b.WriteString(e.Message)
+	return b.String()
+}
+
+// FieldErrors are all the problems found in a configuration. It wraps
+// ErrInvalidConfig.
+type FieldErrors []FieldError
+
+func (e FieldErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, fieldError := range e {
+		messages[i] = fieldError.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+func (e FieldErrors) Is(target error) bool {
+	return target == ErrInvalidConfig
+}
+
+// AsFieldErrors returns the problems reported by err, which are a single
+// problem without a field unless err wraps FieldErrors.
+func AsFieldErrors(err error) FieldErrors {
+	var fieldErrors FieldErrors
+	if errors.As(err, &fieldErrors) {
+		return fieldErrors
+	}
+	return FieldErrors{{Message: err.Error()}}
+}
+
+// yamlErrorPattern matches the errors reported by yaml.UnmarshalStrict.
+var yamlErrorPattern = regexp.MustCompile(`^line (\d+): (?:field (\S+) (not found|already set) in type (\S+)|(.*))$`)
+
+// decodeStrict unmarshals content into p, reporting unknown and duplicated
+// keys as well as values of the wrong type.
+func decodeStrict(content []byte, p *PluginConfig) error {
+	err := yaml.UnmarshalStrict(content, p)
+	var typeError *yaml.TypeError
+	if !errors.As(err, &typeError) {
+		if err != nil {
+			return FieldErrors{{Message: err.Error()}}
+		}
+		return nil
+	}
+
+	// sections by the name of the type they are decoded into
+	sections := map[string]string{reflect.TypeOf(*p).String(): ""}
+	sectionType := reflect.TypeOf(*p)
+	for i := range sectionType.NumField() {
+		field := sectionType.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			sections[field.Type.String()] = name + "."
+		}
+	}
+
+	fieldErrors := make(FieldErrors, 0, len(typeError.Errors))
+	for _, message := range typeError.Errors {
+		match := yamlErrorPattern.FindStringSubmatch(message)
+		if match == nil {
+			fieldErrors = append(fieldErrors, FieldError{Message: message})
+			continue
+		}
+		line, _ := strconv.Atoi(match[1])
+		switch {
+		case match[3] == "not found":
+			fieldErrors = append(fieldErrors, FieldError{Field: sections[match[4]] + match[2], Line: line, Message: "unknown setting"})
+		case match[3] == "already set":
+			fieldErrors = append(fieldErrors, FieldError{Field: sections[match[4]] + match[2], Line: line, Message: "set more than once"})
+		default:
+			fieldErrors = append(fieldErrors, FieldError{Line: line, Message: match[5]})
+		}
+	}
+	return fieldErrors
+}
+
+// keyLines finds the line of each key in YAML content, by its path. It only
+// follows nested mappings, which is all config.yaml uses besides lists of
+// values.
+func keyLines(content []byte) map[string]int {
+	type key struct {
+		indent int
+		name   string
+	}
+	lines := make(map[string]int)
+	var stack []key
+	for i, line := range strings.Split(string(content), "\n") {
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || strings.HasPrefix(trimmed, "-") {
+			continue
+		}
+		name, _, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		for len(stack) > 0 && stack[len(stack)-1].indent >= indent {
+			stack = stack[:len(stack)-1]
+		}
+		stack = append(stack, key{indent: indent, name: strings.Trim(strings.TrimSpace(name), `"'`)})
+
+		path := make([]string, len(stack))
+		for j, k := range stack {
+			path[j] = k.name
+		}
+		lines[strings.Join(path, ".")] = i + 1
+	}
+	return lines
+}
@@ -0,0 +1,199 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// CurrentConfigVersion is the config_version of the configuration files
+// written by this version of the plugin. Files without config_version are
+// version 0.
+const CurrentConfigVersion = 4
+
+// A migration upgrades the content of a configuration file by one version.
+// Migrations edit the text rather than re-encoding it, so that comments are
+// kept.
+type migration func(content []byte) ([]byte, error)
+
+// migrations[v] upgrades a file from version v to v+1.
+var migrations = []migration{
+	addSections("trusted_proxies", "ip_headers", "captcha", "remediation", "failure_mode"),
+	addSections("mode", "live"),
+	addSections("decision_filters"),
+	addSections("geoip"),
+}
+
+// Migration describes a configuration file upgraded by MigrateFile.
+type Migration struct {
+	From, To int
+	// Backup is the copy of the file before it was upgraded.
+	Backup string
+}
+
+// ConfigVersion returns the config_version of the YAML content.
+func ConfigVersion(content []byte) (int, error) {
+	var versioned struct {
+		ConfigVersion int `yaml:"config_version"`
+	}
+	if err := yaml.Unmarshal(content, &versioned); err != nil {
+		return 0, err
+	}
+	return versioned.ConfigVersion, nil
+}
+
+// Migrate upgrades content to CurrentConfigVersion. Content that is already
+// current is returned unchanged.
+func Migrate(content []byte) ([]byte, error) {
+	version, err := ConfigVersion(content)
+	if err != nil {
+		return nil, err
+	}
+	if version < 0 || version > CurrentConfigVersion {
+		return nil, fmt.Errorf("config_version %d is not supported, the latest is %d", version, CurrentConfigVersion)
+	}
+	for ; version < CurrentConfigVersion; version++ {
+		if content, err = migrations[version](content); err != nil {
+			return nil, fmt.Errorf("unable to upgrade config_version %d: %w", version, err)
+		}
+		content = setConfigVersion(content, version+1)
+	}
+	return content, nil
+}
+
+// MigrateFile upgrades the configuration file at path to
+// CurrentConfigVersion in place, after copying it next to itself. It returns
+// nil if the file is current, or cannot be upgraded because it does not parse
+// or has an unsupported version, in which case reading it reports the
+// problems.
+func MigrateFile(path string) (*Migration, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read configuration: %w", err)
+	}
+	version, err := ConfigVersion(content)
+	if err != nil || version < 0 || version >= CurrentConfigVersion {
+		return nil, nil
+	}
+	migrated, err := Migrate(content)
+	if err != nil {
+		return nil, err
+	}
+
+	backup, err := writeBackup(path, version, content)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, migrated); err != nil {
+		return nil, err
+	}
+	return &Migration{From: version, To: CurrentConfigVersion, Backup: backup}, nil
+}
+
+// writeBackup copies content to path.v<version>.bak, numbering the copy if
+// an earlier one exists. The copy keeps the permissions of the file, which
+// holds the API key.
+func writeBackup(path string, version int, content []byte) (string, error) {
+	mode := os.FileMode(0o600)
+	if existing, err := os.Stat(path); err == nil {
+		mode = existing.Mode().Perm()
+	}
+	for i := 0; ; i++ {
+		backup := fmt.Sprintf("%s.v%d.bak", path, version)
+		if i > 0 {
+			backup = fmt.Sprintf("%s.v%d.%d.bak", path, version, i)
+		}
+		file, err := os.OpenFile(backup, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if errors.Is(err, os.ErrExist) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("unable to back up configuration: %w", err)
+		}
+		if _, err := file.Write(content); err != nil {
+			file.Close()
+			return "", fmt.Errorf("unable to back up configuration: %w", err)
+		}
+		if err := file.Close(); err != nil {
+			return "", fmt.Errorf("unable to back up configuration: %w", err)
+		}
+		return backup, nil
+	}
+}
+
+// configVersionLine matches a top-level config_version setting.
+var configVersionLine = regexp.MustCompile(`(?m)^config_version:.*$`)
+
+// setConfigVersion sets config_version in content, adding it with its
+// comment from the default configuration if it is not there.
+func setConfigVersion(content []byte, version int) []byte {
+	text := string(content)
+	if !configVersionLine.MatchString(text) {
+		if text != "" && !strings.HasSuffix(text, "\n") {
+			text += "\n"
+		}
+		text += templateBlocks()["config_version"]
+	}
+	return []byte(configVersionLine.ReplaceAllString(text, "config_version: "+strconv.Itoa(version)))
+}
+
+// addSections returns a migration that appends the given top-level settings,
+// with their comments, from the default configuration to files that do not
+// set them. Each must default to the same value when missing, so adding it
+// only makes the default visible.
+func addSections(keys ...string) migration {
+	return func(content []byte) ([]byte, error) {
+		var tree map[string]any
+		if err := yaml.Unmarshal(content, &tree); err != nil {
+			return nil, err
+		}
+		blocks := templateBlocks()
+		text := string(content)
+		for _, key := range keys {
+			if _, ok := tree[key]; ok {
+				continue
+			}
+			if text != "" && !strings.HasSuffix(text, "\n") {
+				text += "\n"
+			}
+			text += blocks[key]
+		}
+		return []byte(text), nil
+	}
+}
+
+// templateBlocks splits the default configuration into the text of each
+// top-level setting, including the comment lines right above it.
+func templateBlocks() map[string]string {
+	blocks := make(map[string]string)
+	var key string
+	var block, comments []string
+	flush := func() {
+		if key != "" {
+			blocks[key] = strings.Join(block, "\n") + "\n"
+		}
+		key, block = "", nil
+	}
+	for line := range strings.SplitSeq(strings.TrimSuffix(defaultConfigTemplate, "\n"), "\n") {
+		switch {
+		case strings.HasPrefix(line, "#"):
+			flush()
+			comments = append(comments, line)
+		case strings.HasPrefix(line, " ") || strings.HasPrefix(line, "-"):
+			block = append(block, line)
+		default:
+			flush()
+			key, _, _ = strings.Cut(line, ":")
+			block = append(comments, line)
+			comments = nil
+		}
+	}
+	flush()
+	return blocks
+}
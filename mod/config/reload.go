@@ -0,0 +1,107 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
+)
+
+// ErrInvalidConfig is returned when a configuration change is rejected
+// because it does not validate.
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// Changes describes how a reloaded configuration differs from the running
+// one.
+type Changes struct {
+	// Bouncer is true when the LAPI connection settings changed, which
+	// requires restarting the stream bouncer.
+	Bouncer bool
+	// Live lists the changed settings that are applied while running.
+	Live []string
+	// Restart lists the changed settings that only take effect once the
+	// plugin is restarted.
+	Restart []string
+}
+
+// Empty reports whether nothing changed.
+func (c Changes) Empty() bool {
+	return !c.Bouncer && len(c.Live) == 0 && len(c.Restart) == 0
+}
+
+// ReadConfig reads and post-processes the configuration file at path. Unlike
+// LoadConfig, it never creates the file, so it can be used to reload a
+// running configuration.
+func ReadConfig(path string) (*PluginConfig, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read configuration: %w", err)
+	}
+
+	p := &PluginConfig{}
+	if err := p.parse(content); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Diff compares the running configuration with a reloaded one.
+//
+// The log level, client IP settings, remediation actions and GeoIP databases
+// are applied live. The API key, TLS settings and certificates, LAPI URLs,
+// stream update frequency, mode, live mode settings and decision filters,
+// including the scopes the GeoIP databases add, restart the bouncer. The
+// captcha and failure mode settings take effect on the next restart of the
+// plugin.
+func Diff(running, reloaded *PluginConfig) Changes {
+	var changes Changes
+
+	changes.Bouncer = running.APIKey != reloaded.APIKey ||
+		running.TLS() != reloaded.TLS() ||
+		running.TLSFingerprint != reloaded.TLSFingerprint ||
+		!slices.Equal(running.Endpoints, reloaded.Endpoints) ||
+		running.StreamUpdateInterval != reloaded.StreamUpdateInterval ||
+		running.Mode != reloaded.Mode ||
+		(reloaded.Mode == ModeLive && running.Live != reloaded.Live) ||
+		!reflect.DeepEqual(running.DecisionFilter(), reloaded.DecisionFilter())
+
+	if running.LogLevel != reloaded.LogLevel {
+		changes.Live = append(changes.Live, "log_level")
+	}
+	// compare the parsed settings, which include the Cloudflare ranges file
+	if !reflect.DeepEqual(effectiveRealIP(running), effectiveRealIP(reloaded)) {
+		changes.Live = append(changes.Live, "client IP")
+	}
+	if !reflect.DeepEqual(running.Remediation, reloaded.Remediation) {
+		changes.Live = append(changes.Live, "remediation")
+	}
+	// the description of the databases includes their build date, so
+	// updated databases are a change
+	if running.GeoIP.CountryDatabase != reloaded.GeoIP.CountryDatabase ||
+		running.GeoIP.ASNDatabase != reloaded.GeoIP.ASNDatabase ||
+		running.GeoIP.Resolver.String() != reloaded.GeoIP.Resolver.String() {
+		changes.Live = append(changes.Live, "geoip")
+	}
+
+	if !reflect.DeepEqual(running.Captcha, reloaded.Captcha) {
+		changes.Restart = append(changes.Restart, "captcha")
+	}
+	if !reflect.DeepEqual(running.FailureMode, reloaded.FailureMode) {
+		changes.Restart = append(changes.Restart, "failure_mode")
+	}
+
+	return changes
+}
+
+// effectiveRealIP returns the client IP settings of p with the default
+// headers spelled out, so that listing them is not a change.
+func effectiveRealIP(p *PluginConfig) utils.RealIPConfig {
+	realIP := p.RealIP
+	if realIP.Headers == nil {
+		realIP.Headers = utils.DefaultIPHeaders
+	}
+	return realIP
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/lapi"
+)
+
+// Validation is the outcome of validating a configuration.
+type Validation struct {
+	// MissingFields are the required settings that are not set.
+	MissingFields []string `json:"missingFields,omitempty"`
+	// Errors describe the settings that are set but invalid.
+	Errors FieldErrors `json:"errors,omitempty"`
+	// Connections are the outcomes of calling each LAPI endpoint with the
+	// configured credentials, in order. They are empty when the connections
+	// were not checked, or when the settings they need are missing.
+	Connections []lapi.ConnectionCheck `json:"connections,omitempty"`
+}
+
+// Err returns the problems found as FieldErrors, or nil if there are none.
+// An unreachable LAPI is not an error, as it may only be down for a moment,
+// but any LAPI refusing the credentials is.
+func (v Validation) Err() error {
+	var problems FieldErrors
+	for _, field := range v.MissingFields {
+		problems = append(problems, FieldError{Field: field, Message: "required"})
+	}
+	problems = append(problems, v.Errors...)
+	for _, check := range v.Connections {
+		if check.Reachable && !check.Authenticated {
+			problems = append(problems, FieldError{Field: "api_key", Message: fmt.Sprintf("%s: %s", check.URL, check.Error)})
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return problems
+}
+
+// Validate checks that p, which must be post-processed, has the settings
+// needed to connect to LAPI. If checkConnection is set and they are there,
+// it also makes one authenticated call to each LAPI endpoint at once, over
+// the configured TLS settings, giving up after lapi.DefaultCheckTimeout.
+func (p *PluginConfig) Validate(ctx context.Context, checkConnection bool) Validation {
+	validation := Validation{MissingFields: p.MissingRequiredFields()}
+
+	if checkConnection && len(validation.MissingFields) == 0 {
+		client, err := p.TLS().HTTPClient()
+		if err != nil {
+			// the certificate files are reported by PostProcess
+			return validation
+		}
+		ctx, cancel := context.WithTimeout(ctx, lapi.DefaultCheckTimeout)
+		defer cancel()
+		validation.Connections = make([]lapi.ConnectionCheck, len(p.Endpoints))
+		var wg sync.WaitGroup
+		for i, endpoint := range p.Endpoints {
+			wg.Go(func() {
+				validation.Connections[i] = lapi.CheckConnection(ctx, client, endpoint, p.LAPIKey())
+			})
+		}
+		wg.Wait()
+	}
+	return validation
+}
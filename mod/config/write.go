@@ -0,0 +1,142 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
+	"gopkg.in/yaml.v2"
+)
+
+// MaskedSecret replaces secrets in configurations shown in the web UI. A
+// secret sent back unchanged keeps its current value.
+const MaskedSecret = "********"
+
+// Masked returns a copy of p with its secrets replaced by MaskedSecret. Empty
+// secrets stay empty, so the web UI can tell that they are not set.
+func (p *PluginConfig) Masked() *PluginConfig {
+	masked := *p
+	mask := func(secret *string) {
+		if *secret != "" && *secret != PlaceholderAPIKey {
+			*secret = MaskedSecret
+		}
+	}
+	mask(&masked.APIKey)
+	mask(&masked.Captcha.SecretKey)
+	mask(&masked.Captcha.CookieSecret)
+	return &masked
+}
+
+// RestoreSecrets replaces the secrets of p that are still MaskedSecret with
+// the values from running. A secret is only restored for the server it is
+// sent to in running: the API key when the LAPI URLs and TLS settings are
+// unchanged, and the captcha secret key when the provider and verify URL
+// are. Otherwise the secret has to be entered again, and the error lists
+// the secrets concerned, so that a masked secret cannot be sent to another
+// server.
+func (p *PluginConfig) RestoreSecrets(running *PluginConfig) error {
+	var fieldErrors FieldErrors
+	restore := func(field string, secret *string, value string, sameServer bool) {
+		if *secret != MaskedSecret {
+			return
+		}
+		if !sameServer {
+			fieldErrors = append(fieldErrors, FieldError{Field: field, Message: "enter the secret again to use it with another server"})
+			return
+		}
+		*secret = value
+	}
+	sameLAPI := p.AgentUrl == running.AgentUrl &&
+		slices.Equal(p.AgentURLs, running.AgentURLs) &&
+		p.TLS() == running.TLS()
+	sameCaptcha := p.Captcha.Provider == running.Captcha.Provider &&
+		p.Captcha.VerifyURL == running.Captcha.VerifyURL
+	restore("api_key", &p.APIKey, running.APIKey, sameLAPI)
+	restore("captcha.secret_key", &p.Captcha.SecretKey, running.Captcha.SecretKey, sameCaptcha)
+	restore("captcha.cookie_secret", &p.Captcha.CookieSecret, running.Captcha.CookieSecret, true)
+	if len(fieldErrors) > 0 {
+		return fieldErrors
+	}
+	return nil
+}
+
+// WriteConfig writes p to path as YAML. The file is replaced atomically, so
+// the config watcher never reads a partial file. Comments in the existing
+// file are not kept. Settings overridden by the environment or read from
+// api_key_file keep the value they have in the existing file, so that
+// secrets are not written out.
+func WriteConfig(path string, p *PluginConfig) error {
+	written := *p
+	written.ConfigVersion = CurrentConfigVersion
+	if err := keepOverridden(path, &written); err != nil {
+		return err
+	}
+	// a nil list would be written as [], which means no header at all
+	if written.IPHeaders == nil {
+		for _, header := range utils.DefaultIPHeaders {
+			written.IPHeaders = append(written.IPHeaders, IPHeaderConfig{Name: header.Name, Pick: string(header.Pick)})
+		}
+	}
+
+	content, err := yaml.Marshal(&written)
+	if err != nil {
+		return fmt.Errorf("unable to encode configuration: %w", err)
+	}
+	return writeFileAtomic(path, append([]byte("# Crowdsec Bouncer Configuration\n"), content...))
+}
+
+// writeFileAtomic replaces the file at path with content, keeping its
+// permissions.
+func writeFileAtomic(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("unable to write configuration: %w", err)
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return fmt.Errorf("unable to write configuration: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("unable to write configuration: %w", err)
+	}
+	// keep the permissions of the existing file, which holds the API key
+	mode := os.FileMode(0o644)
+	if existing, err := os.Stat(path); err == nil {
+		mode = existing.Mode().Perm()
+	}
+	if err := os.Chmod(tmpPath, mode); err != nil {
+		return fmt.Errorf("unable to write configuration: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return fmt.Errorf("unable to write configuration: %w", err)
+	}
+	return nil
+}
+
+// keepOverridden replaces the overridden settings of written with their
+// values in the file at path, or their zero values if the file does not
+// exist.
+func keepOverridden(path string, written *PluginConfig) error {
+	existing := &PluginConfig{}
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("unable to read configuration: %w", err)
+	}
+	if err := yaml.Unmarshal(content, existing); err != nil {
+		return fmt.Errorf("unable to unmarshal config file: %w", err)
+	}
+
+	existingSettings := existing.settings()
+	for i, s := range written.settings() {
+		if written.Sources[s.path].Overridden() {
+			s.value.Set(existingSettings[i].value)
+		}
+	}
+	return nil
+}
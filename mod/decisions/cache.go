@@ -4,26 +4,117 @@ package decisions
 
 import (
 	"net/netip"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 )
 
+// Decision types the bouncer knows how to remediate.
+const (
+	TypeBan     = "ban"
+	TypeCaptcha = "captcha"
+)
+
+// DefaultTypePriority ranks bans above captchas and every other type below
+// both. It is used until a priority function is set with SetTypePriority.
+func DefaultTypePriority(decisionType string) int {
+	switch strings.ToLower(decisionType) {
+	case TypeBan:
+		return 2
+	case TypeCaptcha:
+		return 1
+	default:
+		return 0
+	}
+}
+
+// Source looks up the decision that should be remediated for a client at ip
+// and location, if any. location is resolved from the GeoIP databases, and
+// is empty when there are none. The Cache is the source in stream mode.
+type Source interface {
+	Lookup(ip netip.Addr, location geoip.Location) *models.Decision
+}
+
 // Cache applies decision stream updates and offers lock-safe IP lookups.
 // CrowdSec sends deleted decisions as well as new decisions, so the cache can
 // retain its last known-good state while a later stream update temporarily
 // fails.
+//
+// Decisions of every type are kept; which one wins when several match an IP
+// is decided by the type priority function. Decision values are parsed once,
+// when they are applied, into an index that serves the lookups. Decisions
+// with the country and AS scopes match the clients located there.
+//
+// Decisions rejected by the filter set with SetFilter are not kept.
+//
+// Each decision's expiry is computed when it is applied, so a decision stops
+// matching once it expires even if LAPI is unreachable and never sends the
+// matching deletion.
+//
+// The cache also records which LAPI endpoint each decision came from. IDs are
+// only unique within one LAPI, so the stream of another endpoint starts with
+// Replace.
 type Cache struct {
 	mu        sync.RWMutex
 	decisions map[int64]*models.Decision
+	// endpoints maps decision IDs to the LAPI they came from, and endpoint
+	// is the LAPI updates are currently applied from
+	endpoints map[int64]string
+	endpoint  string
+	index     *index
+	priority  func(decisionType string) int
+	// filter selects the decisions kept, nil keeps all of them
+	filter *Filter
+	now    func() time.Time
+	// generation is incremented on every change, so the snapshotter can
+	// tell whether the cache changed since the last snapshot.
+	generation      uint64
+	savedGeneration uint64
 }
 
 func NewCache() *Cache {
-	return &Cache{decisions: make(map[int64]*models.Decision)}
+	return &Cache{
+		decisions: make(map[int64]*models.Decision),
+		endpoints: make(map[int64]string),
+		index:     newIndex(),
+		priority:  DefaultTypePriority,
+		now:       time.Now,
+	}
 }
 
-// Apply updates the cache with one response from /v1/decisions/stream.
+// SetTypePriority replaces the function used to rank decision types when
+// several decisions match the same IP. Higher values win.
+func (c *Cache) SetTypePriority(priority func(decisionType string) int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.priority = priority
+}
+
+// SetFilter replaces the filter selecting which decisions are kept, and drops
+// the cached decisions it rejects.
+func (c *Cache) SetFilter(filter *Filter) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.filter = filter
+	removed := false
+	for id, decision := range c.decisions {
+		if !filter.Match(decision) {
+			c.remove(id)
+			removed = true
+		}
+	}
+	if removed {
+		c.generation++
+	}
+}
+
+// Apply updates the cache with one response from /v1/decisions/stream of the
+// endpoint passed to the last Replace.
 func (c *Cache) Apply(update *models.DecisionsStreamResponse) {
 	if update == nil {
 		return
@@ -31,75 +122,221 @@ func (c *Cache) Apply(update *models.DecisionsStreamResponse) {
 
 	c.mu.Lock()
 	defer c.mu.Unlock()
+	c.apply(update)
+}
+
+// Replace discards every cached decision and applies update, which came from
+// the LAPI at endpoint. It is used for the stream's startup response, which
+// carries the complete set of active decisions, so that decisions restored
+// from a snapshot that were deleted while the plugin was down, or pulled
+// from another LAPI, do not linger.
+func (c *Cache) Replace(endpoint string, update *models.DecisionsStreamResponse) {
+	if update == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.decisions = make(map[int64]*models.Decision)
+	c.endpoints = make(map[int64]string)
+	c.endpoint = endpoint
+	c.index = newIndex()
+	c.apply(update)
+}
+
+// apply applies update to the cache. The caller must hold the write lock.
+func (c *Cache) apply(update *models.DecisionsStreamResponse) {
+	c.generation++
 
+	now := c.now()
 	for _, decision := range update.Deleted {
 		if decision != nil {
-			delete(c.decisions, decision.ID)
+			c.remove(decision.ID)
 		}
 	}
 
 	for _, decision := range update.New {
-		if decision == nil || decision.Type == nil || !strings.EqualFold(*decision.Type, "ban") {
+		if decision == nil || decision.Type == nil {
+			continue
+		}
+		// a decision may be sent again, e.g. after it was extended
+		c.remove(decision.ID)
+		if !c.filter.Match(decision) {
+			continue
+		}
+
+		expires, ok := computeExpiry(decision, now)
+		if ok {
+			if !now.Before(expires) {
+				continue
+			}
+			decision.Until = expires.UTC().Format(time.RFC3339Nano)
+		}
+		if c.index.add(decision, expires) {
+			c.decisions[decision.ID] = decision
+			if c.endpoint != "" {
+				c.endpoints[decision.ID] = c.endpoint
+			}
+		}
+	}
+}
+
+// Active returns the cached decisions that have not expired.
+func (c *Cache) Active() []*models.Decision {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	now := c.now()
+	active := make([]*models.Decision, 0, len(c.decisions))
+	for _, decision := range c.decisions {
+		if until, ok := ExpiresAt(decision); ok && !now.Before(until) {
 			continue
 		}
-		c.decisions[decision.ID] = decision
+		active = append(active, decision)
 	}
+	return active
+}
+
+// Len returns the number of cached decisions, including expired decisions
+// that have not been swept yet.
+func (c *Cache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.decisions)
+}
+
+// remove drops the cached decision with the given ID. The caller must hold
+// the write lock.
+func (c *Cache) remove(id int64) {
+	if cached, ok := c.decisions[id]; ok {
+		c.index.remove(cached)
+		delete(c.decisions, id)
+		delete(c.endpoints, id)
+	}
+}
+
+// Endpoint returns the LAPI endpoint the cached decision with the given ID
+// came from, or "" if it is not known, e.g. for decisions restored from an
+// older snapshot.
+func (c *Cache) Endpoint(id int64) string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.endpoints[id]
 }
 
 // GetBan returns the most specific matching IP or CIDR ban decision, if any.
-func (c *Cache) GetBan(rawIP string) *models.Decision {
-	ip, err := netip.ParseAddr(rawIP)
-	if err != nil {
+func (c *Cache) GetBan(ip netip.Addr) *models.Decision {
+	return c.lookup(ip, geoip.Location{}, func(decision *models.Decision) bool {
+		return IsType(decision, TypeBan)
+	})
+}
+
+// GetDecision returns the IP or CIDR decision that should be remediated for
+// ip, if any. The highest priority decision type wins, then the most
+// specific match.
+func (c *Cache) GetDecision(ip netip.Addr) *models.Decision {
+	return c.lookup(ip, geoip.Location{}, nil)
+}
+
+// Lookup returns the decision that should be remediated for a client at ip
+// and location, if any, ranked like GetDecision. Country and AS decisions
+// rank below IP and CIDR ones of the same type.
+func (c *Cache) Lookup(ip netip.Addr, location geoip.Location) *models.Decision {
+	return c.lookup(ip, location, nil)
+}
+
+// IsType reports whether decision has the given type, ignoring case.
+func IsType(decision *models.Decision, decisionType string) bool {
+	return decision != nil && decision.Type != nil && strings.EqualFold(*decision.Type, decisionType)
+}
+
+// lookup returns the best decision matching ip and location. ip is
+// normalized the same way as decision values, so IPv4-mapped IPv6 addresses
+// match IPv4 decisions.
+func (c *Cache) lookup(ip netip.Addr, location geoip.Location, filter func(*models.Decision) bool) *models.Decision {
+	if !ip.IsValid() {
 		return nil
 	}
+	ip = utils.NormalizeIP(ip)
 
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	var best *models.Decision
-	bestSpecificity := -1
-	for _, decision := range c.decisions {
-		specificity, matches := decisionMatchSpecificity(decision, ip)
-		if !matches {
-			continue
+	now := c.now()
+	ranking := ranking{priority: c.priority}
+	c.index.each(ip, location, func(entry indexEntry) {
+		if !entry.expires.IsZero() && !now.Before(entry.expires) {
+			return
 		}
-		if best == nil || specificity > bestSpecificity || (specificity == bestSpecificity && decision.ID > best.ID) {
-			best = decision
-			bestSpecificity = specificity
+		if filter != nil && !filter(entry.decision) {
+			return
 		}
-	}
+		ranking.consider(entry.decision, entry.specificity)
+	})
 
-	return best
+	return ranking.best
 }
 
-func decisionMatchSpecificity(decision *models.Decision, ip netip.Addr) (int, bool) {
-	if decision == nil || decision.Scope == nil || decision.Value == nil {
-		return 0, false
+// ranking keeps the best of the decisions matching an IP: the highest
+// priority decision type wins, then the most specific match, then the
+// latest decision.
+type ranking struct {
+	priority        func(decisionType string) int
+	best            *models.Decision
+	bestPriority    int
+	bestSpecificity int
+}
+
+func (r *ranking) consider(decision *models.Decision, specificity int) {
+	priority := r.priority(*decision.Type)
+	if r.best == nil || priority > r.bestPriority ||
+		(priority == r.bestPriority && (specificity > r.bestSpecificity || (specificity == r.bestSpecificity && decision.ID > r.best.ID))) {
+		r.best = decision
+		r.bestPriority = priority
+		r.bestSpecificity = specificity
 	}
+}
 
-	switch strings.ToLower(*decision.Scope) {
-	case "ip":
-		decisionIP, err := netip.ParseAddr(*decision.Value)
-		if err == nil {
-			return decisionIP.BitLen() + 1, decisionIP == ip
+// Best returns the decision of candidates that should be remediated for a
+// client at ip and location, ranked like the lookups of a Cache. Candidates
+// that do not match the client, or have expired at now, are ignored. It is
+// used for the decisions LAPI returns for one client in live mode.
+func Best(ip netip.Addr, location geoip.Location, candidates []*models.Decision, priority func(decisionType string) int, now time.Time) *models.Decision {
+	if !ip.IsValid() {
+		return nil
+	}
+	ip = utils.NormalizeIP(ip)
+	keys := locationKeys(location)
+
+	ranking := ranking{priority: priority}
+	for _, decision := range candidates {
+		if decision == nil || decision.Type == nil {
+			continue
 		}
-		// CAPI decisions may be represented as an IP scope with a /32 or
-		// /128 suffix, so accept a valid prefix here as well.
-		prefix, err := netip.ParsePrefix(*decision.Value)
-		if err != nil || !prefix.Contains(ip) {
-			return 0, false
+		specificity, ok := matchSpecificity(decision, ip, keys)
+		if !ok {
+			continue
 		}
-		if prefix.Bits() == ip.BitLen() {
-			return prefix.Bits() + 1, true
+		if expires, ok := computeExpiry(decision, now); ok && !now.Before(expires) {
+			continue
 		}
-		return prefix.Bits(), true
-	case "range":
-		prefix, err := netip.ParsePrefix(*decision.Value)
-		if err != nil || !prefix.Contains(ip) {
+		ranking.consider(decision, specificity)
+	}
+	return ranking.best
+}
+
+// matchSpecificity reports whether decision matches a client at ip, whose
+// location has the given keys, and how specifically, as the index would.
+func matchSpecificity(decision *models.Decision, ip netip.Addr, keys []string) (int, bool) {
+	if prefix, exact, ok := indexKey(decision); ok {
+		if !prefix.Contains(ip) {
 			return 0, false
 		}
+		if exact {
+			return prefix.Bits() + 1, true
+		}
 		return prefix.Bits(), true
-	default:
-		return 0, false
 	}
+	key, specificity, ok := geoKey(decision)
+	return specificity, ok && slices.Contains(keys, key)
 }
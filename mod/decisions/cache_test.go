@@ -1,8 +1,16 @@
 package decisions
 
 import (
+	"fmt"
+	"math/rand/v2"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 )
 
@@ -19,18 +27,18 @@ func TestCacheAppliesNewAndDeletedDecisions(t *testing.T) {
 	rangeDecision := decision(2, "range", "2001:db8::/32", "ban")
 
 	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{ipDecision, maskedIPDecision, rangeDecision}})
-	if got := cache.GetBan("203.0.113.10"); got != ipDecision {
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != ipDecision {
 		t.Fatalf("expected IP decision, got %#v", got)
 	}
-	if got := cache.GetBan("2001:db8::42"); got != rangeDecision {
+	if got := cache.GetBan(netip.MustParseAddr("2001:db8::42")); got != rangeDecision {
 		t.Fatalf("expected range decision, got %#v", got)
 	}
-	if got := cache.GetBan("198.51.100.4"); got != maskedIPDecision {
+	if got := cache.GetBan(netip.MustParseAddr("198.51.100.4")); got != maskedIPDecision {
 		t.Fatalf("expected masked IP decision, got %#v", got)
 	}
 
 	cache.Apply(&models.DecisionsStreamResponse{Deleted: []*models.Decision{ipDecision}})
-	if got := cache.GetBan("203.0.113.10"); got != nil {
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != nil {
 		t.Fatalf("expected deleted decision to be absent, got %#v", got)
 	}
 }
@@ -42,7 +50,7 @@ func TestCacheIgnoresNonBanAndInvalidDecisions(t *testing.T) {
 		decision(2, "ip", "not-an-ip", "ban"),
 	}})
 
-	if got := cache.GetBan("203.0.113.10"); got != nil {
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != nil {
 		t.Fatalf("expected no matching ban, got %#v", got)
 	}
 }
@@ -55,12 +63,519 @@ func TestCachePrefersExactIPThenMostSpecificRange(t *testing.T) {
 	equallySpecificNewerRange := decision(4, "range", "203.0.113.0/25", "ban")
 
 	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{wideRange, narrowRange, exactIP, equallySpecificNewerRange}})
-	if got := cache.GetBan("203.0.113.10"); got != exactIP {
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != exactIP {
 		t.Fatalf("expected exact IP decision, got %#v", got)
 	}
 
 	cache.Apply(&models.DecisionsStreamResponse{Deleted: []*models.Decision{exactIP}})
-	if got := cache.GetBan("203.0.113.10"); got != equallySpecificNewerRange {
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != equallySpecificNewerRange {
 		t.Fatalf("expected deterministic most-specific range decision, got %#v", got)
 	}
 }
+
+func TestCacheKeepsCaptchaDecisionsAndPrefersBans(t *testing.T) {
+	cache := NewCache()
+	captchaIP := decision(1, "ip", "203.0.113.10", "captcha")
+	banRange := decision(2, "range", "203.0.113.0/24", "ban")
+
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{captchaIP}})
+	if got := cache.GetDecision(netip.MustParseAddr("203.0.113.10")); got != captchaIP {
+		t.Fatalf("expected captcha decision, got %#v", got)
+	}
+
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{banRange}})
+	if got := cache.GetDecision(netip.MustParseAddr("203.0.113.10")); got != banRange {
+		t.Fatalf("expected ban to take precedence over a more specific captcha, got %#v", got)
+	}
+	if got := cache.GetDecision(netip.MustParseAddr("203.0.113.11")); got != banRange {
+		t.Fatalf("expected range ban decision, got %#v", got)
+	}
+}
+
+func TestCacheKeepsCustomTypesAndUsesTypePriority(t *testing.T) {
+	cache := NewCache()
+	throttle := decision(1, "ip", "203.0.113.10", "throttle")
+	captcha := decision(2, "ip", "203.0.113.10", "captcha")
+
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{throttle, captcha}})
+	if got := cache.GetDecision(netip.MustParseAddr("203.0.113.10")); got != captcha {
+		t.Fatalf("expected captcha to outrank an unknown type by default, got %#v", got)
+	}
+
+	cache.SetTypePriority(func(decisionType string) int {
+		if decisionType == "throttle" {
+			return 10
+		}
+		return DefaultTypePriority(decisionType)
+	})
+	if got := cache.GetDecision(netip.MustParseAddr("203.0.113.10")); got != throttle {
+		t.Fatalf("expected custom priority to prefer throttle, got %#v", got)
+	}
+}
+
+func TestCacheMatchesCountryAndASDecisions(t *testing.T) {
+	cache := NewCache()
+	countryBan := decision(1, "Country", "fr", "ban")
+	asCaptcha := decision(2, "AS", "AS64496", "captcha")
+	asBan := decision(3, "AS", "64497", "ban")
+	rangeCaptcha := decision(4, "range", "192.0.2.0/24", "captcha")
+	invalid := decision(5, "AS", "not-a-number", "ban")
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{countryBan, asCaptcha, asBan, rangeCaptcha, invalid}})
+	if cache.Len() != 4 {
+		t.Fatalf("Len() = %d, want the invalid AS decision ignored", cache.Len())
+	}
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	tests := []struct {
+		name     string
+		location geoip.Location
+		want     *models.Decision
+	}{
+		{"unknown location", geoip.Location{}, rangeCaptcha},
+		{"AS ranks below range", geoip.Location{ASN: 64496}, rangeCaptcha},
+		{"bans rank above captchas", geoip.Location{Country: "FR", ASN: 64496}, countryBan},
+		{"AS ranks above country", geoip.Location{Country: "FR", ASN: 64497}, asBan},
+	}
+	now := time.Now()
+	candidates := []*models.Decision{countryBan, asCaptcha, asBan, rangeCaptcha}
+	for _, tt := range tests {
+		if got := cache.Lookup(ip, tt.location); got != tt.want {
+			t.Errorf("%s: Lookup() = %#v, want %#v", tt.name, got, tt.want)
+		}
+		if got := Best(ip, tt.location, candidates, DefaultTypePriority, now); got != tt.want {
+			t.Errorf("%s: Best() = %#v, want %#v", tt.name, got, tt.want)
+		}
+	}
+	if got := cache.GetDecision(ip); got != rangeCaptcha {
+		t.Fatalf("GetDecision() = %#v, want country and AS decisions left out", got)
+	}
+
+	cache.Apply(&models.DecisionsStreamResponse{Deleted: []*models.Decision{countryBan, asBan}})
+	if got := cache.Lookup(netip.MustParseAddr("198.51.100.1"), geoip.Location{Country: "FR", ASN: 64497}); got != nil {
+		t.Fatalf("Lookup() = %#v after the deletion, want none", got)
+	}
+	if len(cache.index.geo) != 1 {
+		t.Fatalf("index holds %d country and AS keys, want only the remaining one", len(cache.index.geo))
+	}
+}
+
+func TestCacheReplacesResentDecision(t *testing.T) {
+	cache := NewCache()
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "range", "203.0.113.0/24", "ban")}})
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "ip", "198.51.100.7", "ban")}})
+
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != nil {
+		t.Fatalf("expected the old value of a resent decision to be unindexed, got %#v", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("198.51.100.7")); got == nil || got.ID != 1 {
+		t.Fatalf("expected the new value of a resent decision, got %#v", got)
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("Len() = %d, want 1", cache.Len())
+	}
+}
+
+func TestPrefixTriePrunesEmptyBranches(t *testing.T) {
+	cache := NewCache()
+	rangeDecision := decision(1, "range", "2001:db8::/48", "ban")
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{rangeDecision}})
+	cache.Apply(&models.DecisionsStreamResponse{Deleted: []*models.Decision{rangeDecision}})
+
+	if root := cache.index.v6.root; root.children[0] != nil || root.children[1] != nil || len(root.entries) != 0 {
+		t.Fatal("expected the trie to be empty after deleting its only decision")
+	}
+}
+
+// linearLookup is the reference implementation the index replaced: it
+// re-parses every decision on every lookup.
+func TestCacheNormalizesAddresses(t *testing.T) {
+	cache := NewCache()
+	mappedIP := decision(1, "ip", "::ffff:203.0.113.10", "ban")
+	mappedRange := decision(2, "range", "::ffff:198.51.100.0/120", "ban")
+	zonedIP := decision(3, "ip", "fe80::1%eth0", "ban")
+	plainIP := decision(4, "ip", "192.0.2.1", "ban")
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{mappedIP, mappedRange, zonedIP, plainIP}})
+
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != mappedIP {
+		t.Fatalf("GetBan(IPv4) = %#v, want the IPv4-mapped decision", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("198.51.100.7")); got != mappedRange {
+		t.Fatalf("GetBan(IPv4 in range) = %#v, want the IPv4-mapped range", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("fe80::1")); got != zonedIP {
+		t.Fatalf("GetBan(fe80::1) = %#v, want the zoned decision", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("::ffff:192.0.2.1")); got != plainIP {
+		t.Fatalf("GetBan(IPv4-mapped) = %#v, want the IPv4 decision", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("fe80::1%eth1")); got != zonedIP {
+		t.Fatalf("GetBan(zoned) = %#v, want the decision without zone", got)
+	}
+
+	for decision, want := range map[*models.Decision]string{mappedIP: "203.0.113.10", mappedRange: "198.51.100.0/24", zonedIP: "fe80::1", plainIP: "192.0.2.1"} {
+		if *decision.Value != want {
+			t.Errorf("decision %d value = %q, want %q", decision.ID, *decision.Value, want)
+		}
+	}
+
+	cache.Apply(&models.DecisionsStreamResponse{Deleted: []*models.Decision{{ID: 1}, {ID: 2}}})
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != nil {
+		t.Fatalf("GetBan() = %#v after deletion, want nil", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("198.51.100.7")); got != nil {
+		t.Fatalf("GetBan() = %#v after deletion, want nil", got)
+	}
+}
+
+func TestCacheExpiresDecisionsLocally(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	cache := NewCache()
+	cache.now = func() time.Time { return now }
+
+	short := decision(1, "ip", "203.0.113.10", "ban")
+	short.Duration = str("1m")
+	long := decision(2, "range", "203.0.113.0/24", "ban")
+	long.Duration = str("1h")
+	until := decision(3, "ip", "198.51.100.4", "ban")
+	until.Until = now.Add(2 * time.Minute).Format(time.RFC3339)
+	permanent := decision(4, "ip", "192.0.2.1", "ban")
+	alreadyExpired := decision(5, "ip", "192.0.2.2", "ban")
+	alreadyExpired.Duration = str("-5s")
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{short, long, until, permanent, alreadyExpired}})
+
+	if got, ok := ExpiresAt(short); !ok || !got.Equal(now.Add(time.Minute)) {
+		t.Fatalf("ExpiresAt(short) = %v, %v, want %v", got, ok, now.Add(time.Minute))
+	}
+	if got := cache.GetBan(netip.MustParseAddr("192.0.2.2")); got != nil {
+		t.Fatalf("expected an already expired decision to be dropped, got %#v", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != short {
+		t.Fatalf("expected IP decision before expiry, got %#v", got)
+	}
+
+	now = now.Add(90 * time.Second)
+	if got := cache.GetBan(netip.MustParseAddr("203.0.113.10")); got != long {
+		t.Fatalf("expected expired IP decision to fall back to the range, got %#v", got)
+	}
+	if got := cache.GetBan(netip.MustParseAddr("198.51.100.4")); got != until {
+		t.Fatalf("expected decision with Until to still match, got %#v", got)
+	}
+	if remaining, ok := Remaining(until, now); !ok || remaining != 30*time.Second {
+		t.Fatalf("Remaining(until) = %v, %v, want 30s", remaining, ok)
+	}
+	if got := len(cache.Active()); got != 3 {
+		t.Fatalf("len(Active()) = %d, want 3", got)
+	}
+
+	now = now.Add(24 * time.Hour)
+	if removed := cache.Sweep(now); removed != 3 {
+		t.Fatalf("Sweep() removed %d decisions, want 3", removed)
+	}
+	if cache.Len() != 1 || cache.GetBan(netip.MustParseAddr("192.0.2.1")) != permanent {
+		t.Fatalf("expected only the decision without expiry to remain, have %d", cache.Len())
+	}
+	if _, ok := Remaining(permanent, now); ok {
+		t.Fatal("expected no remaining time for a decision without expiry")
+	}
+}
+
+func TestCacheSnapshotRoundTrip(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	path := filepath.Join(t.TempDir(), "decisions.snapshot.json")
+
+	cache := NewCache()
+	cache.now = func() time.Time { return now }
+	short := decision(1, "ip", "203.0.113.10", "ban")
+	short.Duration = str("1m")
+	long := decision(2, "range", "198.51.100.0/24", "captcha")
+	long.Duration = str("4h")
+	permanent := decision(3, "ip", "192.0.2.1", "ban")
+	cache.Replace("http://lapi-1:8080", &models.DecisionsStreamResponse{New: []*models.Decision{short, long}})
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{permanent}})
+	if err := cache.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+
+	// restart after the short decision expired
+	restored := NewCache()
+	restored.now = func() time.Time { return now.Add(time.Hour) }
+	count, err := restored.LoadSnapshot(path)
+	if err != nil {
+		t.Fatalf("LoadSnapshot() error = %v", err)
+	}
+	if count != 2 {
+		t.Fatalf("LoadSnapshot() restored %d decisions, want 2", count)
+	}
+	if got := restored.GetBan(netip.MustParseAddr("203.0.113.10")); got != nil {
+		t.Fatalf("expected decision that expired while down to be dropped, got %#v", got)
+	}
+	if got := restored.GetDecision(netip.MustParseAddr("198.51.100.7")); got == nil || got.ID != 2 {
+		t.Fatalf("expected range decision to be restored, got %#v", got)
+	}
+	if remaining, ok := Remaining(restored.GetDecision(netip.MustParseAddr("198.51.100.7")), now.Add(time.Hour)); !ok || remaining != 3*time.Hour {
+		t.Fatalf("Remaining() = %v, %v, want 3h", remaining, ok)
+	}
+	if got := restored.GetBan(netip.MustParseAddr("192.0.2.1")); got == nil || got.ID != 3 {
+		t.Fatalf("expected decision without expiry to be restored, got %#v", got)
+	}
+	// deltas are recorded as coming from the endpoint of the startup response
+	if got := restored.Endpoint(3); got != "http://lapi-1:8080" {
+		t.Fatalf("Endpoint(3) = %q, want the endpoint saved in the snapshot", got)
+	}
+
+	// the startup response from LAPI replaces the restored decisions
+	restored.Replace("http://lapi-2:8080", &models.DecisionsStreamResponse{New: []*models.Decision{decision(4, "ip", "192.0.2.9", "ban")}})
+	if restored.Len() != 1 || restored.GetBan(netip.MustParseAddr("192.0.2.1")) != nil || restored.GetBan(netip.MustParseAddr("192.0.2.9")) == nil {
+		t.Fatalf("expected Replace to drop restored decisions, have %d", restored.Len())
+	}
+	if restored.Endpoint(2) != "" || restored.Endpoint(4) != "http://lapi-2:8080" {
+		t.Fatalf("Endpoint() after Replace = %q, %q", restored.Endpoint(2), restored.Endpoint(4))
+	}
+}
+
+func TestCacheLoadSnapshotRejectsInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+
+	count, err := NewCache().LoadSnapshot(filepath.Join(dir, "missing.json"))
+	if err != nil || count != 0 {
+		t.Fatalf("LoadSnapshot(missing) = %d, %v, want 0, nil", count, err)
+	}
+
+	for name, content := range map[string]string{
+		"corrupt":     `{"version": 1, "decisions": [`,
+		"unversioned": `{"decisions": []}`,
+		"future":      `{"version": 99, "decisions": []}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name+".json")
+			if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			cache := NewCache()
+			if _, err := cache.LoadSnapshot(path); err == nil {
+				t.Fatal("expected an error")
+			}
+			if cache.Len() != 0 {
+				t.Fatalf("expected an empty cache, have %d decisions", cache.Len())
+			}
+		})
+	}
+}
+
+func TestCacheSaveSnapshotReplacesFileAtomically(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "decisions.snapshot.json")
+	if err := os.WriteFile(path, []byte("old"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache()
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "ip", "203.0.113.10", "ban")}})
+	if err := cache.SaveSnapshot(path); err != nil {
+		t.Fatalf("SaveSnapshot() error = %v", err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected no temporary files to be left behind, found %d entries", len(entries))
+	}
+	if count, err := NewCache().LoadSnapshot(path); err != nil || count != 1 {
+		t.Fatalf("LoadSnapshot() = %d, %v, want 1, nil", count, err)
+	}
+}
+
+func linearLookup(decisions []*models.Decision, rawIP string) *models.Decision {
+	ip, err := netip.ParseAddr(rawIP)
+	if err != nil {
+		return nil
+	}
+
+	var best *models.Decision
+	bestPriority, bestSpecificity := -1, -1
+	for _, decision := range decisions {
+		specificity, matches := -1, false
+		switch strings.ToLower(*decision.Scope) {
+		case "ip":
+			if decisionIP, err := netip.ParseAddr(*decision.Value); err == nil {
+				specificity, matches = decisionIP.BitLen()+1, decisionIP == ip
+				break
+			}
+			if prefix, err := netip.ParsePrefix(*decision.Value); err == nil && prefix.Contains(ip) {
+				specificity, matches = prefix.Bits(), true
+				if prefix.Bits() == ip.BitLen() {
+					specificity++
+				}
+			}
+		case "range":
+			if prefix, err := netip.ParsePrefix(*decision.Value); err == nil && prefix.Contains(ip) {
+				specificity, matches = prefix.Bits(), true
+			}
+		}
+		if !matches {
+			continue
+		}
+		priority := DefaultTypePriority(*decision.Type)
+		if best == nil || priority > bestPriority ||
+			(priority == bestPriority && (specificity > bestSpecificity || (specificity == bestSpecificity && decision.ID > best.ID))) {
+			best, bestPriority, bestSpecificity = decision, priority, specificity
+		}
+	}
+	return best
+}
+
+// randomDecisions generates n IPv4 decisions: mostly single IPs, with some
+// ranges and captchas, all within 10.0.0.0/8 so lookups have matches.
+func randomDecisions(rng *rand.Rand, n int) []*models.Decision {
+	decisions := make([]*models.Decision, 0, n)
+	for i := 0; i < n; i++ {
+		ip := fmt.Sprintf("10.%d.%d.%d", rng.IntN(256), rng.IntN(256), rng.IntN(256))
+		decisionType := "ban"
+		if rng.IntN(10) == 0 {
+			decisionType = "captcha"
+		}
+		switch rng.IntN(20) {
+		case 0:
+			decisions = append(decisions, decision(int64(i), "range", fmt.Sprintf("%s/%d", ip, 16+rng.IntN(17)), decisionType))
+		case 1:
+			decisions = append(decisions, decision(int64(i), "ip", ip+"/32", decisionType))
+		default:
+			decisions = append(decisions, decision(int64(i), "ip", ip, decisionType))
+		}
+	}
+	return decisions
+}
+
+func TestCacheMatchesLinearLookup(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	decisions := randomDecisions(rng, 5000)
+	decisions = append(decisions, decision(9000, "range", "2001:db8::/32", "ban"), decision(9001, "ip", "2001:db8::1", "captcha"))
+
+	cache := NewCache()
+	cache.Apply(&models.DecisionsStreamResponse{New: decisions})
+
+	ips := []string{"2001:db8::1", "2001:db8::2", "2001:db9::1", "11.0.0.1"}
+	for _, d := range decisions[:200] {
+		ips = append(ips, strings.Split(*d.Value, "/")[0])
+	}
+	for i := 0; i < 1000; i++ {
+		ips = append(ips, fmt.Sprintf("10.%d.%d.%d", rng.IntN(256), rng.IntN(256), rng.IntN(256)))
+	}
+
+	for _, ip := range ips {
+		if got, want := cache.GetDecision(netip.MustParseAddr(ip)), linearLookup(decisions, ip); got != want {
+			t.Fatalf("GetDecision(%s) = %#v, want %#v", ip, got, want)
+		}
+	}
+}
+
+func TestBestMatchesCache(t *testing.T) {
+	rng := rand.New(rand.NewPCG(3, 4))
+	decisions := randomDecisions(rng, 500)
+	cache := NewCache()
+	cache.Apply(&models.DecisionsStreamResponse{New: decisions})
+
+	now := time.Now()
+	for _, d := range decisions[:200] {
+		ip := netip.MustParseAddr(strings.Split(*d.Value, "/")[0])
+		if got, want := Best(ip, geoip.Location{}, decisions, DefaultTypePriority, now), cache.GetDecision(ip); got != want {
+			t.Fatalf("Best(%s) = %#v, want %#v", ip, got, want)
+		}
+	}
+
+	ip := netip.MustParseAddr("192.0.2.1")
+	expired := decision(1, "ip", "192.0.2.1", "ban")
+	expired.Duration = str("-1s")
+	other := decision(2, "ip", "192.0.2.2", "ban")
+	if got := Best(ip, geoip.Location{}, []*models.Decision{expired, other}, DefaultTypePriority, now); got != nil {
+		t.Fatalf("Best() = %#v, want expired and other decisions ignored", got)
+	}
+}
+
+func benchmarkLookups(b *testing.B, n int, lookup func(decisions []*models.Decision, cache *Cache, ip string) *models.Decision) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	decisions := randomDecisions(rng, n)
+	cache := NewCache()
+	cache.Apply(&models.DecisionsStreamResponse{New: decisions})
+
+	ips := make([]string, 1024)
+	for i := range ips {
+		ips[i] = fmt.Sprintf("10.%d.%d.%d", rng.IntN(256), rng.IntN(256), rng.IntN(256))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		lookup(decisions, cache, ips[i%len(ips)])
+	}
+}
+
+// Benchmark the indexed lookup against the linear scan it replaced, with a
+// CAPI-sized decision list.
+func BenchmarkCacheGetDecision100k(b *testing.B) {
+	benchmarkLookups(b, 100_000, func(_ []*models.Decision, cache *Cache, ip string) *models.Decision {
+		return cache.GetDecision(netip.MustParseAddr(ip))
+	})
+}
+
+func BenchmarkLinearLookup100k(b *testing.B) {
+	benchmarkLookups(b, 100_000, func(decisions []*models.Decision, _ *Cache, ip string) *models.Decision {
+		return linearLookup(decisions, ip)
+	})
+}
+
+func TestFilterMatch(t *testing.T) {
+	local := decision(1, "Ip", "192.0.2.1", "ban")
+	local.Origin, local.Scenario = str("crowdsec"), str("crowdsecurity/ssh-bf")
+	community := decision(2, "Range", "198.51.100.0/24", "ban")
+	community.Origin, community.Scenario = str("CAPI"), str("crowdsecurity/http-probing")
+	country := decision(3, "Country", "FR", "ban")
+	country.Origin, country.Scenario = str("cscli"), str("manual 'ban' from 'admin'")
+
+	tests := []struct {
+		name   string
+		filter *Filter
+		want   []bool
+	}{
+		{"no filter", nil, []bool{true, true, true}},
+		{"empty filter", &Filter{}, []bool{true, true, true}},
+		{"origins", &Filter{Origins: []string{"crowdsec", "capi"}}, []bool{true, true, false}},
+		{"scopes", &Filter{Scopes: []string{"ip", "range"}}, []bool{true, true, false}},
+		{"scenarios containing", &Filter{ScenariosContaining: []string{"SSH", "manual"}}, []bool{true, false, true}},
+		{"scenarios not containing", &Filter{ScenariosNotContaining: []string{"http-"}}, []bool{true, false, true}},
+	}
+	for _, tt := range tests {
+		for i, d := range []*models.Decision{local, community, country} {
+			if got := tt.filter.Match(d); got != tt.want[i] {
+				t.Errorf("%s: Match(%s) = %v, want %v", tt.name, *d.Value, got, tt.want[i])
+			}
+		}
+	}
+}
+
+func TestCacheAppliesFilter(t *testing.T) {
+	cache := NewCache()
+	local := decision(1, "ip", "192.0.2.1", "ban")
+	local.Origin = str("crowdsec")
+	community := decision(2, "ip", "192.0.2.2", "ban")
+	community.Origin = str("CAPI")
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{local, community}})
+
+	// decisions already cached are dropped when the filter rejects them
+	cache.SetFilter(&Filter{Origins: []string{"crowdsec", "cscli"}})
+	if cache.Len() != 1 || cache.GetDecision(netip.MustParseAddr("192.0.2.2")) != nil {
+		t.Fatalf("SetFilter() kept %d decisions, want only the local one", cache.Len())
+	}
+
+	// and new ones are not added
+	resent := decision(3, "ip", "192.0.2.3", "ban")
+	resent.Origin = str("lists")
+	cache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{resent}})
+	if cache.GetDecision(netip.MustParseAddr("192.0.2.3")) != nil {
+		t.Fatal("Apply() added a decision the filter rejects")
+	}
+	if cache.GetDecision(netip.MustParseAddr("192.0.2.1")) != local {
+		t.Fatal("Apply() dropped a decision the filter accepts")
+	}
+}
@@ -0,0 +1,91 @@
+package decisions
+
+import (
+	"context"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// DefaultSweepInterval is how often expired decisions are removed from the
+// cache.
+const DefaultSweepInterval = time.Minute
+
+// computeExpiry returns when decision stops being active. LAPI reports the
+// remaining Duration at the time of the pull, so it is anchored to now. An
+// explicit Until takes precedence. Decisions with neither never expire
+// locally and are only removed when LAPI deletes them.
+func computeExpiry(decision *models.Decision, now time.Time) (time.Time, bool) {
+	if until, ok := ExpiresAt(decision); ok {
+		return until, true
+	}
+	if decision.Duration == nil {
+		return time.Time{}, false
+	}
+	duration, err := time.ParseDuration(*decision.Duration)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return now.Add(duration), true
+}
+
+// ExpiresAt returns the absolute expiry of a cached decision. The cache
+// records it in the decision's Until field when the decision is applied.
+func ExpiresAt(decision *models.Decision) (time.Time, bool) {
+	if decision == nil || decision.Until == "" {
+		return time.Time{}, false
+	}
+	until, err := time.Parse(time.RFC3339Nano, decision.Until)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return until, true
+}
+
+// Remaining returns how long decision stays active, if it expires. Decisions
+// that were not applied to a cache are treated as if they were pulled at now.
+func Remaining(decision *models.Decision, now time.Time) (time.Duration, bool) {
+	if decision == nil {
+		return 0, false
+	}
+	until, ok := computeExpiry(decision, now)
+	if !ok {
+		return 0, false
+	}
+	return max(until.Sub(now), 0), true
+}
+
+// Sweep removes every decision that has expired at now and returns how many
+// were removed.
+func (c *Cache) Sweep(now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	removed := 0
+	for id, decision := range c.decisions {
+		if until, ok := ExpiresAt(decision); ok && !now.Before(until) {
+			c.remove(id)
+			removed++
+		}
+	}
+	if removed > 0 {
+		c.generation++
+	}
+	return removed
+}
+
+// RunExpirySweeper sweeps expired decisions every interval until ctx is done.
+// Lookups already ignore expired decisions; sweeping frees their memory.
+func (c *Cache) RunExpirySweeper(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			c.Sweep(now)
+		}
+	}
+}
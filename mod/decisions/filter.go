@@ -0,0 +1,54 @@
+package decisions
+
+import (
+	"slices"
+	"strings"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// Filter selects the decisions that are enforced. The same filters are
+// passed to LAPI with the stream query, and applied again locally to what
+// LAPI cannot filter: live lookups, decisions restored from a snapshot, and
+// LAPIs that ignore a filter. Matching follows LAPI: origins and scopes are
+// compared ignoring case, and scenarios by substring ignoring case. Empty
+// lists do not filter.
+type Filter struct {
+	Origins                []string
+	ScenariosContaining    []string
+	ScenariosNotContaining []string
+	Scopes                 []string
+}
+
+// Match reports whether decision passes the filter.
+func (f *Filter) Match(decision *models.Decision) bool {
+	if f == nil || decision == nil {
+		return true
+	}
+	if len(f.Origins) > 0 && !containsFold(f.Origins, value(decision.Origin)) {
+		return false
+	}
+	if len(f.Scopes) > 0 && !containsFold(f.Scopes, value(decision.Scope)) {
+		return false
+	}
+	scenario := strings.ToLower(value(decision.Scenario))
+	if len(f.ScenariosContaining) > 0 && !slices.ContainsFunc(f.ScenariosContaining, func(part string) bool {
+		return strings.Contains(scenario, strings.ToLower(part))
+	}) {
+		return false
+	}
+	return !slices.ContainsFunc(f.ScenariosNotContaining, func(part string) bool {
+		return strings.Contains(scenario, strings.ToLower(part))
+	})
+}
+
+func containsFold(values []string, s string) bool {
+	return slices.ContainsFunc(values, func(v string) bool { return strings.EqualFold(v, s) })
+}
+
+func value(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
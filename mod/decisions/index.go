@@ -0,0 +1,284 @@
+package decisions
+
+import (
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// indexEntry is a decision together with how specifically it matches and
+// when it expires (zero if never). Exact IP decisions rank above any range
+// of the same length, so a /32 IP decision beats a /32 range, and country
+// and AS decisions rank below any range.
+type indexEntry struct {
+	decision    *models.Decision
+	specificity int
+	expires     time.Time
+}
+
+// index answers IP lookups without scanning every decision. Exact IP
+// decisions live in a hash map and ranges in one binary prefix trie per
+// address family, so a lookup costs at most one map access plus a walk of
+// prefix-length trie nodes, regardless of how many decisions are cached.
+// Country and AS decisions live in another map, keyed by geoKey.
+type index struct {
+	exact map[netip.Addr][]indexEntry
+	v4    prefixTrie
+	v6    prefixTrie
+	geo   map[string][]indexEntry
+}
+
+func newIndex() *index {
+	return &index{exact: make(map[netip.Addr][]indexEntry), geo: make(map[string][]indexEntry)}
+}
+
+// Specificities of country and AS decisions, below any IP or range decision.
+// An AS is usually smaller than a country.
+const (
+	asSpecificity      = -1
+	countrySpecificity = -2
+)
+
+// geoKey returns the key of a country or AS decision in the index, e.g.
+// "country:FR" or "as:64496", and how specifically it matches. AS values
+// are accepted with or without an AS prefix.
+func geoKey(decision *models.Decision) (key string, specificity int, ok bool) {
+	if decision == nil || decision.Scope == nil || decision.Value == nil {
+		return "", 0, false
+	}
+
+	value := strings.ToUpper(strings.TrimSpace(*decision.Value))
+	switch strings.ToLower(*decision.Scope) {
+	case "country":
+		if value == "" {
+			return "", 0, false
+		}
+		return "country:" + value, countrySpecificity, true
+	case "as":
+		number, err := strconv.ParseUint(strings.TrimPrefix(value, "AS"), 10, 32)
+		if err != nil {
+			return "", 0, false
+		}
+		return "as:" + strconv.FormatUint(number, 10), asSpecificity, true
+	default:
+		return "", 0, false
+	}
+}
+
+// locationKeys returns the keys of the country and AS decisions matching a
+// client at location.
+func locationKeys(location geoip.Location) []string {
+	var keys []string
+	if location.Country != "" {
+		keys = append(keys, "country:"+strings.ToUpper(location.Country))
+	}
+	if location.ASN != 0 {
+		keys = append(keys, "as:"+location.ASNString())
+	}
+	return keys
+}
+
+// indexKey parses a decision's scope and value into the prefix it covers,
+// normalized like the client IPs it is matched against. exact is true when
+// the decision targets a single IP.
+func indexKey(decision *models.Decision) (prefix netip.Prefix, exact bool, ok bool) {
+	if decision == nil || decision.Scope == nil || decision.Value == nil {
+		return netip.Prefix{}, false, false
+	}
+
+	switch strings.ToLower(*decision.Scope) {
+	case "ip":
+		if ip, err := netip.ParseAddr(*decision.Value); err == nil {
+			ip = utils.NormalizeIP(ip)
+			return netip.PrefixFrom(ip, ip.BitLen()), true, true
+		}
+		// CAPI decisions may be represented as an IP scope with a /32 or
+		// /128 suffix, so accept a valid prefix here as well.
+		prefix, err := netip.ParsePrefix(*decision.Value)
+		if err != nil {
+			return netip.Prefix{}, false, false
+		}
+		prefix = utils.NormalizePrefix(prefix)
+		return prefix, prefix.IsSingleIP(), true
+	case "range":
+		prefix, err := netip.ParsePrefix(*decision.Value)
+		if err != nil {
+			return netip.Prefix{}, false, false
+		}
+		return utils.NormalizePrefix(prefix), false, true
+	default:
+		return netip.Prefix{}, false, false
+	}
+}
+
+// add indexes decision, reporting false if it cannot be matched against
+// clients. The value of IP and range decisions is rewritten in its normalized
+// form, so it reads the same as the client IPs it matches.
+func (ix *index) add(decision *models.Decision, expires time.Time) bool {
+	prefix, exact, ok := indexKey(decision)
+	if !ok {
+		key, specificity, ok := geoKey(decision)
+		if ok {
+			ix.geo[key] = append(ix.geo[key], indexEntry{decision: decision, specificity: specificity, expires: expires})
+		}
+		return ok
+	}
+	normalizeValue(decision, prefix, exact)
+
+	if exact {
+		ip := prefix.Addr()
+		ix.exact[ip] = append(ix.exact[ip], indexEntry{decision: decision, specificity: prefix.Bits() + 1, expires: expires})
+		return true
+	}
+
+	ix.trie(prefix.Addr()).insert(prefix, indexEntry{decision: decision, specificity: prefix.Bits(), expires: expires})
+	return true
+}
+
+// normalizeValue rewrites the value of decision, which covers prefix, if its
+// normalized form differs, e.g. for IPv4-mapped IPv6 addresses or addresses
+// with a zone.
+func normalizeValue(decision *models.Decision, prefix netip.Prefix, exact bool) {
+	value := prefix.String()
+	if exact && !strings.Contains(*decision.Value, "/") {
+		value = prefix.Addr().String()
+	}
+	if value != *decision.Value {
+		decision.Value = &value
+	}
+}
+
+// remove drops decision from the index.
+func (ix *index) remove(decision *models.Decision) {
+	prefix, exact, ok := indexKey(decision)
+	if !ok {
+		if key, _, ok := geoKey(decision); ok {
+			if entries := removeEntry(ix.geo[key], decision.ID); len(entries) == 0 {
+				delete(ix.geo, key)
+			} else {
+				ix.geo[key] = entries
+			}
+		}
+		return
+	}
+
+	if exact {
+		ip := prefix.Addr()
+		entries := removeEntry(ix.exact[ip], decision.ID)
+		if len(entries) == 0 {
+			delete(ix.exact, ip)
+		} else {
+			ix.exact[ip] = entries
+		}
+		return
+	}
+
+	ix.trie(prefix.Addr()).remove(prefix, decision.ID)
+}
+
+// each calls fn for every indexed decision matching a client at ip and
+// location.
+func (ix *index) each(ip netip.Addr, location geoip.Location, fn func(indexEntry)) {
+	for _, entry := range ix.exact[ip] {
+		fn(entry)
+	}
+	ix.trie(ip).walk(ip, fn)
+	for _, key := range locationKeys(location) {
+		for _, entry := range ix.geo[key] {
+			fn(entry)
+		}
+	}
+}
+
+func (ix *index) trie(addr netip.Addr) *prefixTrie {
+	if addr.Is4() {
+		return &ix.v4
+	}
+	return &ix.v6
+}
+
+func removeEntry(entries []indexEntry, id int64) []indexEntry {
+	for i, entry := range entries {
+		if entry.decision.ID == id {
+			return append(entries[:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
+
+// prefixTrie is a binary trie keyed by address bits. Each node at depth n
+// holds the decisions for the /n prefix leading to it.
+type prefixTrie struct {
+	root trieNode
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	entries  []indexEntry
+}
+
+func (t *prefixTrie) insert(prefix netip.Prefix, entry indexEntry) {
+	node := &t.root
+	addr := prefix.Addr()
+	for depth := 0; depth < prefix.Bits(); depth++ {
+		bit := addrBit(addr, depth)
+		if node.children[bit] == nil {
+			node.children[bit] = &trieNode{}
+		}
+		node = node.children[bit]
+	}
+	node.entries = append(node.entries, entry)
+}
+
+func (t *prefixTrie) remove(prefix netip.Prefix, id int64) {
+	addr := prefix.Addr()
+	path := make([]*trieNode, 0, prefix.Bits()+1)
+	node := &t.root
+	path = append(path, node)
+	for depth := 0; depth < prefix.Bits(); depth++ {
+		node = node.children[addrBit(addr, depth)]
+		if node == nil {
+			return
+		}
+		path = append(path, node)
+	}
+	node.entries = removeEntry(node.entries, id)
+
+	// prune the branches that no longer lead to any decision
+	for depth := len(path) - 1; depth > 0; depth-- {
+		node := path[depth]
+		if len(node.entries) > 0 || node.children[0] != nil || node.children[1] != nil {
+			return
+		}
+		path[depth-1].children[addrBit(addr, depth-1)] = nil
+	}
+}
+
+// walk calls fn for the decisions of every prefix containing ip.
+func (t *prefixTrie) walk(ip netip.Addr, fn func(indexEntry)) {
+	node := &t.root
+	for depth := 0; node != nil; depth++ {
+		for _, entry := range node.entries {
+			fn(entry)
+		}
+		if depth == ip.BitLen() {
+			return
+		}
+		node = node.children[addrBit(ip, depth)]
+	}
+}
+
+// addrBit returns bit n of addr, counting from the most significant bit.
+func addrBit(addr netip.Addr, n int) int {
+	if addr.Is4() {
+		b := addr.As4()
+		return int(b[n/8]>>(7-n%8)) & 1
+	}
+	b := addr.As16()
+	return int(b[n/8]>>(7-n%8)) & 1
+}
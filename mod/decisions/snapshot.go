@@ -0,0 +1,156 @@
+package decisions
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// SnapshotVersion is the version of the snapshot file format. Snapshots
+	// with any other version are ignored.
+	SnapshotVersion = 1
+	// DefaultSnapshotInterval is how often a changed cache is written to disk.
+	DefaultSnapshotInterval = time.Minute
+)
+
+// snapshot is the on-disk representation of the cache. Every decision carries
+// its absolute expiry in Until, so the snapshot stays valid across restarts.
+type snapshot struct {
+	Version   int                `json:"version"`
+	SavedAt   time.Time          `json:"saved_at"`
+	Decisions []*models.Decision `json:"decisions"`
+	// Endpoints maps decision IDs to the LAPI they came from.
+	Endpoints map[int64]string `json:"endpoints,omitempty"`
+}
+
+// SaveSnapshot writes the active decisions to path. The file is replaced
+// atomically, so a crash while saving never leaves a partial snapshot behind.
+func (c *Cache) SaveSnapshot(path string) error {
+	c.mu.RLock()
+	generation := c.generation
+	c.mu.RUnlock()
+
+	active := c.Active()
+	c.mu.RLock()
+	endpoints := make(map[int64]string, len(c.endpoints))
+	for _, decision := range active {
+		if endpoint, ok := c.endpoints[decision.ID]; ok {
+			endpoints[decision.ID] = endpoint
+		}
+	}
+	c.mu.RUnlock()
+
+	data, err := json.Marshal(snapshot{
+		Version:   SnapshotVersion,
+		SavedAt:   c.now().UTC(),
+		Decisions: active,
+		Endpoints: endpoints,
+	})
+	if err != nil {
+		return fmt.Errorf("unable to encode decision snapshot: %w", err)
+	}
+
+	if err := writeFileAtomic(path, data); err != nil {
+		return fmt.Errorf("unable to write decision snapshot: %w", err)
+	}
+
+	c.mu.Lock()
+	c.savedGeneration = generation
+	c.mu.Unlock()
+	return nil
+}
+
+// LoadSnapshot restores the decisions saved in path and returns how many were
+// restored. Decisions that expired while the plugin was down are dropped. A
+// missing file is not an error.
+func (c *Cache) LoadSnapshot(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("unable to read decision snapshot: %w", err)
+	}
+
+	var saved snapshot
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return 0, fmt.Errorf("unable to decode decision snapshot: %w", err)
+	}
+	if saved.Version != SnapshotVersion {
+		return 0, fmt.Errorf("unsupported decision snapshot version %d (expected %d)", saved.Version, SnapshotVersion)
+	}
+
+	c.Apply(&models.DecisionsStreamResponse{New: saved.Decisions})
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, endpoint := range saved.Endpoints {
+		if _, ok := c.decisions[id]; ok {
+			c.endpoints[id] = endpoint
+		}
+	}
+	c.savedGeneration = c.generation
+	return len(c.decisions), nil
+}
+
+// RunSnapshotter saves the cache to path every interval if it changed, and
+// once more when ctx is done. Failures are logged and retried at the next
+// interval.
+func (c *Cache) RunSnapshotter(ctx context.Context, logger *logrus.Logger, path string, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	save := func() {
+		c.mu.RLock()
+		changed := c.generation != c.savedGeneration
+		c.mu.RUnlock()
+		if !changed {
+			return
+		}
+		if err := c.SaveSnapshot(path); err != nil {
+			logger.Warnf("%v", err)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			save()
+			return nil
+		case <-ticker.C:
+			save()
+		}
+	}
+}
+
+// writeFileAtomic writes data to a temporary file in the same directory as
+// path, then renames it over path.
+func writeFileAtomic(path string, data []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := file.Name()
+	defer os.Remove(tmpPath)
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
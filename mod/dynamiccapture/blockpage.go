@@ -0,0 +1,148 @@
+package dynamiccapture
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+var defaultBlockTemplate = template.Must(template.ParseFS(content, "www/ban.html"))
+
+// BlockPage is the data available to the block page template, and the body
+// of the JSON error returned to clients that prefer JSON.
+type BlockPage struct {
+	Status      int    `json:"status"`
+	Error       string `json:"error"`
+	ClientIP    string `json:"ip,omitempty"`
+	DecisionID  int64  `json:"decisionId,omitempty"`
+	Scenario    string `json:"scenario,omitempty"`
+	Origin      string `json:"origin,omitempty"`
+	Expiry      string `json:"expiry,omitempty"`
+	ReferenceID string `json:"referenceId"`
+}
+
+// LoadBlockPage parses the block page template at path. If the file does not
+// exist, the embedded default page is returned.
+func LoadBlockPage(path string) (*template.Template, error) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return defaultBlockTemplate, nil
+		}
+		return nil, fmt.Errorf("unable to read block page template: %w", err)
+	}
+
+	tmpl, err := template.New(path).Parse(string(source))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse block page template: %w", err)
+	}
+	return tmpl, nil
+}
+
+// newBlockPage collects the template data for a blocked request.
+func newBlockPage(ip string, decision *models.Decision) BlockPage {
+	page := BlockPage{
+		Status:      http.StatusForbidden,
+		Error:       http.StatusText(http.StatusForbidden),
+		ClientIP:    ip,
+		ReferenceID: newReferenceID(),
+	}
+	if decision == nil {
+		return page
+	}
+
+	page.DecisionID = decision.ID
+	if decision.Scenario != nil {
+		page.Scenario = *decision.Scenario
+	}
+	if decision.Origin != nil {
+		page.Origin = *decision.Origin
+	}
+	if until, ok := decisions.ExpiresAt(decision); ok {
+		page.Expiry = until.UTC().Format(time.RFC3339)
+	} else if decision.Duration != nil {
+		page.Expiry = "in " + *decision.Duration
+	}
+	return page
+}
+
+// newReferenceID returns a short random ID that is shown to the client and
+// logged, so that a support request can be matched to the block.
+func newReferenceID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unavailable"
+	}
+	return hex.EncodeToString(buf)
+}
+
+// writeBlockPage renders page as JSON or HTML depending on the request's
+// Accept header. If the template fails, a plain text body is sent instead.
+func writeBlockPage(logger *logrus.Logger, tmpl *template.Template, page BlockPage, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if prefersJSON(r.Header.Get("Accept")) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(page.Status)
+		json.NewEncoder(w).Encode(page)
+		return
+	}
+
+	if tmpl == nil {
+		tmpl = defaultBlockTemplate
+	}
+	var body bytes.Buffer
+	if err := tmpl.Execute(&body, page); err != nil {
+		logger.Errorf("Unable to render block page: %v", err)
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(page.Status)
+		w.Write([]byte(page.Error))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(page.Status)
+	w.Write(body.Bytes())
+}
+
+// prefersJSON reports whether the Accept header explicitly asks for
+// application/json and ranks it above text/html.
+func prefersJSON(accept string) bool {
+	jsonQuality, htmlQuality := -1.0, -1.0
+	for _, mediaRange := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(q, 64); err == nil {
+				quality = parsed
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			jsonQuality = max(jsonQuality, quality)
+		case "text/html":
+			htmlQuality = max(htmlQuality, quality)
+		}
+	}
+
+	return jsonQuality > 0 && jsonQuality > htmlQuality
+}
@@ -0,0 +1,110 @@
+package dynamiccapture
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestBlockPageContentNegotiation(t *testing.T) {
+	logger, _, pluginConfig, decisionCache := testSetup(t)
+	ban := decision(42, "203.0.113.10", "ban")
+	ban.Scenario = str("crowdsecurity/http-probing")
+	ban.Duration = str("3h59m")
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{ban}})
+	registry := testRegistry(t, nil, nil)
+
+	t.Run("HTML", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = "203.0.113.10:5000"
+		request.Header.Set("Accept", "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8")
+		recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+
+		if got := recorder.Header().Get("Content-Type"); got != "text/html; charset=utf-8" {
+			t.Fatalf("Content-Type = %q, want text/html", got)
+		}
+		until, _ := decisions.ExpiresAt(ban)
+		if body := recorder.Body.String(); !strings.Contains(body, "203.0.113.10") || !strings.Contains(body, until.UTC().Format(time.RFC3339)) {
+			t.Fatalf("expected IP and expiry in block page, got %s", body)
+		}
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.RemoteAddr = "203.0.113.10:5000"
+		request.Header.Set("Accept", "application/json")
+		recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+
+		if got := recorder.Header().Get("Content-Type"); got != "application/json" {
+			t.Fatalf("Content-Type = %q, want application/json", got)
+		}
+		var page BlockPage
+		if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+			t.Fatalf("unable to decode JSON body: %v", err)
+		}
+		if page.Status != http.StatusForbidden || page.DecisionID != 42 || page.Scenario != "crowdsecurity/http-probing" || page.ReferenceID == "" {
+			t.Fatalf("unexpected JSON block page: %+v", page)
+		}
+	})
+}
+
+func TestLoadBlockPage(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	tmpl, err := LoadBlockPage(filepath.Join(tmpDir, "missing.html"))
+	if err != nil || tmpl != defaultBlockTemplate {
+		t.Fatalf("LoadBlockPage(missing) = %v, %v, want embedded default", tmpl, err)
+	}
+
+	customPath := filepath.Join(tmpDir, "ban.html")
+	if err := os.WriteFile(customPath, []byte(`blocked {{.ClientIP}} via {{.Origin}} ({{.ReferenceID}})`), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	tmpl, err = LoadBlockPage(customPath)
+	if err != nil {
+		t.Fatalf("LoadBlockPage(custom) error = %v", err)
+	}
+	var body strings.Builder
+	if err := tmpl.Execute(&body, BlockPage{ClientIP: "198.51.100.1", Origin: "cscli", ReferenceID: "abc"}); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if body.String() != "blocked 198.51.100.1 via cscli (abc)" {
+		t.Fatalf("custom template rendered %q", body.String())
+	}
+
+	if err := os.WriteFile(customPath, []byte(`{{.Broken`), 0o644); err != nil {
+		t.Fatalf("WriteFile() error = %v", err)
+	}
+	if _, err := LoadBlockPage(customPath); err == nil {
+		t.Fatal("expected an error for an invalid template")
+	}
+}
+
+func TestPrefersJSON(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "application/json", want: true},
+		{accept: "application/json, text/plain, */*", want: true},
+		{accept: "text/html,application/xhtml+xml,*/*;q=0.8", want: false},
+		{accept: "text/html;q=0.5, application/json", want: true},
+		{accept: "text/html, application/json;q=0.9", want: false},
+		{accept: "application/json;q=0", want: false},
+	}
+
+	for _, tc := range tests {
+		if got := prefersJSON(tc.accept); got != tc.want {
+			t.Errorf("prefersJSON(%q) = %v, want %v", tc.accept, got, tc.want)
+		}
+	}
+}
@@ -1,25 +1,179 @@
 package dynamiccapture
 
 import (
+	"embed"
+	"html/template"
+	"math"
 	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
+	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/sirupsen/logrus"
 )
 
+//go:embed www/*
+var content embed.FS
+
+var challengeTemplate = template.Must(template.ParseFS(content, "www/challenge.html"))
+
+// maxChallengeFormSize bounds how much of a captured request body is read
+// when looking for a captcha response.
+const maxChallengeFormSize = 64 << 10
+
+type challengePage struct {
+	ScriptURL string
+	Widget    template.HTML
+	Failed    bool
+}
+
 // The Capture handler is what handles the requests that were accepted by the Sniff handler
 // It is called for each request that was accepted by the Sniff handler.
 //
-// If the request was accepted, that means that there is a decision for the request IP,
-//
-// TODO: implement a way to present a captcha if the decision is to present a captcha
-func CaptureHandler(logger *logrus.Logger, w http.ResponseWriter, r *http.Request) {
+// If the request was accepted, that means that there is a decision for the request IP.
+// The remediation registry decides whether the request is blocked, challenged,
+// tarpitted or redirected. The decision itself is normally handed over by the
+// sniff handler through handoff, unless it was recorded for another client IP.
+func CaptureHandler(logger *logrus.Logger, config *config.PluginConfig, decisionSource decisions.Source, registry *remediation.Registry, handoff *Handoff, w http.ResponseWriter, r *http.Request) {
 	// This is the dynamic capture handler where it actually captures and handle the request
 
 	// it would be really funny if we could return a 5 petabyte zip bomb or something,
 	// but let's not...
 
+	var match Match
+	forwardRequest := plugin.EncodeForwardRequestPayload(r)
+	clientIP, err := utils.GetRealIP(logger, &forwardRequest, config.RealIP)
+	if err != nil {
+		logger.Warnf("GetRealIP Got an error: %v for captured request: %s", err, r.RequestURI)
+	} else if handedOff, ok := handoff.Take(r.Header.Get(RequestIDHeader)); !ok {
+		// The sniff stage did not record this request, e.g. because the entry
+		// expired, so look the decision up again.
+		logger.Debugf("No handoff found for captured request: %s, looking up the decision again", r.RequestURI)
+		match = lookupMatch(config, decisionSource, registry, clientIP, r)
+	} else if handedOff.IP != clientIP.String() {
+		// The request ID is a header like any other, so a client could send
+		// the ID of someone else's request. Only trust the entry when it was
+		// recorded for the same client.
+		logger.Warnf("Handoff for captured request: %s was recorded for IP %s, not %s, looking up the decision again", r.RequestURI, handedOff.IP, clientIP)
+		match = lookupMatch(config, decisionSource, registry, clientIP, r)
+	} else {
+		match = handedOff
+	}
+	ip, decision := match.IP, match.Decision
+
+	scenario := "unknown"
+	if decision != nil && decision.Scenario != nil {
+		scenario = *decision.Scenario
+	}
+
+	action := registry.ActionFor(decision)
+	if retryAfter, ok := retryAfterSeconds(decision); ok && (action == remediation.ActionBlock || action == remediation.ActionTarpit) {
+		w.Header().Set("Retry-After", retryAfter)
+	}
+
+	switch action {
+	case remediation.ActionChallenge:
+		serveChallenge(logger, registry.Challenger, ip, utils.IsHTTPS(r, config.RealIP), w, r)
+	case remediation.ActionTarpit:
+		serveTarpit(logger, registry.TarpitDelay, w, r)
+	case remediation.ActionRedirect:
+		http.Redirect(w, r, registry.RedirectURL, http.StatusFound)
+		logger.Infof("Request redirected: %s (%s, scenario %s)", r.RequestURI, describeClient(ip, match.Location), scenario)
+	default:
+		page := newBlockPage(ip, decision)
+		writeBlockPage(logger, registry.BlockPage, page, w, r)
+		logger.Infof("Request blocked: %s (%s, scenario %s, reference %s)", r.RequestURI, describeClient(ip, match.Location), scenario, page.ReferenceID)
+	}
+}
+
+// lookupMatch finds the decision for a captured request from ip without
+// help from the sniff stage.
+func lookupMatch(config *config.PluginConfig, decisionSource decisions.Source, registry *remediation.Registry, ip netip.Addr, r *http.Request) Match {
+	location := config.GeoIP.Resolver.Lookup(ip)
+	decision := decisionSource.Lookup(ip, location)
+	if decision == nil && registry.Failure.Engaged(r.Host) {
+		decision = registry.Failure.Decision(ip.String())
+	}
+	return Match{IP: ip.String(), Location: location, Decision: decision}
+}
+
+// describeClient returns the client IP for logs, followed by its location
+// when it is known, e.g. "IP 192.0.2.1, country FR, AS 64496 (Example Org)".
+func describeClient(ip string, location geoip.Location) string {
+	if where := location.String(); where != "" {
+		return "IP " + ip + ", " + where
+	}
+	return "IP " + ip
+}
+
+// retryAfterSeconds returns the time left until the decision expires,
+// rounded up to whole seconds, for use as a Retry-After header.
+func retryAfterSeconds(decision *models.Decision) (string, bool) {
+	remaining, ok := decisions.Remaining(decision, time.Now())
+	if !ok || remaining <= 0 {
+		return "", false
+	}
+	return strconv.FormatInt(int64(math.Ceil(remaining.Seconds())), 10), true
+}
+
+// serveChallenge verifies a submitted captcha response, or renders the
+// challenge page if there is none or it was rejected. secure marks the
+// verification cookie Secure.
+func serveChallenge(logger *logrus.Logger, challenger *captcha.Challenger, ip string, secure bool, w http.ResponseWriter, r *http.Request) {
+	failed := false
+	if r.Method == http.MethodPost {
+		r.Body = http.MaxBytesReader(w, r.Body, maxChallengeFormSize)
+		if response := r.PostFormValue(challenger.Provider.ResponseField()); response != "" {
+			ok, err := challenger.Verify(r.Context(), response, ip)
+			if err != nil {
+				logger.Warnf("Captcha verification failed for IP %s: %v", ip, err)
+			}
+			if ok {
+				logger.Infof("Captcha solved by IP %s", ip)
+				challenger.SetCookie(w, ip, secure)
+				http.Redirect(w, r, r.RequestURI, http.StatusSeeOther)
+				return
+			}
+			failed = true
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
 	w.WriteHeader(http.StatusForbidden)
+	err := challengeTemplate.Execute(w, challengePage{
+		ScriptURL: challenger.Provider.ScriptURL(),
+		Widget:    challenger.Provider.Widget(challenger.SiteKey),
+		Failed:    failed,
+	})
+	if err != nil {
+		logger.Errorf("Unable to render captcha challenge: %v", err)
+	}
+	logger.Infof("Captcha challenge served: %s", r.RequestURI)
+}
+
+// serveTarpit holds the request for delay, then rejects it as rate limited.
+func serveTarpit(logger *logrus.Logger, delay time.Duration, w http.ResponseWriter, r *http.Request) {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		logger.Debugf("Client gave up on tarpitted request: %s", r.RequestURI)
+		return
+	}
+
 	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("Forbidden"))
-	logger.Infof("Request blocked: %s", r.RequestURI)
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte("Too Many Requests"))
+	logger.Infof("Request tarpitted: %s", r.RequestURI)
 }
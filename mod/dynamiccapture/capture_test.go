@@ -0,0 +1,319 @@
+package dynamiccapture
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/metrics"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
+	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+	"github.com/sirupsen/logrus"
+)
+
+func str(value string) *string { return &value }
+
+func decision(id int64, value, decisionType string) *models.Decision {
+	return &models.Decision{ID: id, Scope: str("ip"), Value: str(value), Type: str(decisionType), Origin: str("cscli")}
+}
+
+func testSetup(t *testing.T) (*logrus.Logger, *metrics.MetricsHandler, *config.PluginConfig, *decisions.Cache) {
+	t.Helper()
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+	return logger, metrics.NewMetricsHandler(logger), &config.PluginConfig{}, decisions.NewCache()
+}
+
+func testRegistry(t *testing.T, challenger *captcha.Challenger, types map[string]string) *remediation.Registry {
+	t.Helper()
+	registry, err := remediation.NewRegistry("block", types)
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	registry.Challenger = challenger
+	return registry
+}
+
+func testHandoff() *Handoff {
+	return NewHandoff(DefaultHandoffCapacity, DefaultHandoffTTL)
+}
+
+func capture(logger *logrus.Logger, pluginConfig *config.PluginConfig, decisionCache *decisions.Cache, registry *remediation.Registry, request *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	CaptureHandler(logger, pluginConfig, decisionCache, registry, testHandoff(), recorder, request)
+	return recorder
+}
+
+func TestCaptchaFlowOffline(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "203.0.113.10", "captcha")}})
+
+	verifyServer := httptest.NewServer(captcha.FakeVerifyHandler())
+	defer verifyServer.Close()
+	signer, _ := captcha.NewCookieSigner("secret", time.Minute)
+	challenger, err := captcha.NewChallenger(captcha.FakeProviderName, "", "", verifyServer.URL, signer)
+	if err != nil {
+		t.Fatalf("NewChallenger() error = %v", err)
+	}
+	registry := testRegistry(t, challenger, nil)
+
+	sniff := func(cookie string) plugin.SniffResult {
+		dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: "203.0.113.10:5000", Header: map[string][]string{}}
+		if cookie != "" {
+			dsfr.Header["Cookie"] = []string{cookie}
+		}
+		return SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, testHandoff())
+	}
+
+	// 1. Unverified clients are captured.
+	if got := sniff(""); got != plugin.SniffResultAccept {
+		t.Fatalf("SniffHandler() = %v, want accept", got)
+	}
+
+	// 2. The capture handler serves the challenge page.
+	request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	request.RemoteAddr = "203.0.113.10:5000"
+	recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), captcha.FakeResponseToken) {
+		t.Fatalf("expected challenge page, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	// 3. Submitting the solved challenge sets a cookie and redirects back.
+	form := url.Values{challenger.Provider.ResponseField(): {captcha.FakeResponseToken}}
+	request = httptest.NewRequest(http.MethodPost, "/protected", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = "203.0.113.10:5000"
+	recorder = capture(logger, pluginConfig, decisionCache, registry, request)
+	if recorder.Code != http.StatusSeeOther {
+		t.Fatalf("expected redirect after solving the challenge, got %d", recorder.Code)
+	}
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != captcha.CookieName {
+		t.Fatalf("expected verification cookie, got %v", cookies)
+	}
+
+	// 4. Verified clients are skipped by the sniff handler.
+	if got := sniff(cookies[0].Name + "=" + cookies[0].Value); got != plugin.SniffResultSkip {
+		t.Fatalf("SniffHandler() with cookie = %v, want skip", got)
+	}
+}
+
+func TestCaptchaFlowRejectsInvalidResponse(t *testing.T) {
+	logger, _, pluginConfig, decisionCache := testSetup(t)
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "203.0.113.10", "captcha")}})
+
+	verifyServer := httptest.NewServer(captcha.FakeVerifyHandler())
+	defer verifyServer.Close()
+	signer, _ := captcha.NewCookieSigner("secret", time.Minute)
+	challenger, _ := captcha.NewChallenger(captcha.FakeProviderName, "", "", verifyServer.URL, signer)
+
+	form := url.Values{challenger.Provider.ResponseField(): {"forged"}}
+	request := httptest.NewRequest(http.MethodPost, "/protected", strings.NewReader(form.Encode()))
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.RemoteAddr = "203.0.113.10:5000"
+	recorder := capture(logger, pluginConfig, decisionCache, testRegistry(t, challenger, nil), request)
+
+	if recorder.Code != http.StatusForbidden || len(recorder.Result().Cookies()) != 0 {
+		t.Fatalf("expected challenge to be served again without a cookie, got %d", recorder.Code)
+	}
+}
+
+func TestCaptchaDecisionBlockedWithoutProvider(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "203.0.113.10", "captcha")}})
+
+	registry := testRegistry(t, nil, nil)
+	dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: "203.0.113.10:5000", Header: map[string][]string{}}
+	if got := SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, testHandoff()); got != plugin.SniffResultAccept {
+		t.Fatalf("SniffHandler() = %v, want accept", got)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	request.RemoteAddr = "203.0.113.10:5000"
+	recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), "Access denied") {
+		t.Fatalf("expected block page, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestRemediationActions(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{
+		decision(1, "203.0.113.1", "ban"),
+		decision(2, "203.0.113.2", "throttle"),
+		decision(3, "203.0.113.3", "moved"),
+		decision(4, "203.0.113.4", "watch"),
+		decision(5, "203.0.113.5", "custom"),
+	}})
+	registry := testRegistry(t, nil, map[string]string{"moved": "redirect", "watch": "log"})
+	registry.TarpitDelay = time.Millisecond
+	registry.RedirectURL = "https://example.com/blocked"
+
+	tests := []struct {
+		name       string
+		ip         string
+		wantSniff  plugin.SniffResult
+		wantStatus int
+	}{
+		{name: "ban blocks", ip: "203.0.113.1", wantSniff: plugin.SniffResultAccept, wantStatus: http.StatusForbidden},
+		{name: "throttle tarpits", ip: "203.0.113.2", wantSniff: plugin.SniffResultAccept, wantStatus: http.StatusTooManyRequests},
+		{name: "custom redirect", ip: "203.0.113.3", wantSniff: plugin.SniffResultAccept, wantStatus: http.StatusFound},
+		{name: "log only is skipped", ip: "203.0.113.4", wantSniff: plugin.SniffResultSkip},
+		{name: "unknown type uses default", ip: "203.0.113.5", wantSniff: plugin.SniffResultAccept, wantStatus: http.StatusForbidden},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: tc.ip, Header: map[string][]string{}}
+			if got := SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, testHandoff()); got != tc.wantSniff {
+				t.Fatalf("SniffHandler() = %v, want %v", got, tc.wantSniff)
+			}
+			if tc.wantSniff == plugin.SniffResultSkip {
+				return
+			}
+
+			request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+			request.RemoteAddr = tc.ip + ":5000"
+			recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+			if recorder.Code != tc.wantStatus {
+				t.Fatalf("CaptureHandler() status = %d, want %d", recorder.Code, tc.wantStatus)
+			}
+		})
+	}
+}
+
+func TestFailureModeClosedBlocksRequestsWithoutDecision(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	registry := testRegistry(t, nil, nil)
+	failure, err := remediation.NewFailurePolicy("closed_for_hosts", "block", []string{"admin.example.com"}, time.Nanosecond)
+	if err != nil {
+		t.Fatalf("NewFailurePolicy() error = %v", err)
+	}
+	registry.Failure = failure
+	time.Sleep(time.Millisecond)
+
+	sniff := func(hostname string) plugin.SniffResult {
+		dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: "203.0.113.10:5000", Hostname: hostname, Header: map[string][]string{}}
+		return SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, testHandoff())
+	}
+	if got := sniff("www.example.com"); got != plugin.SniffResultSkip {
+		t.Fatalf("SniffHandler(unlisted host) = %v, want skip", got)
+	}
+	if got := sniff("admin.example.com"); got != plugin.SniffResultAccept {
+		t.Fatalf("SniffHandler(listed host) = %v, want accept", got)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "http://admin.example.com/", nil)
+	request.RemoteAddr = "203.0.113.10:5000"
+	request.Header.Set("Accept", "application/json")
+	recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), remediation.FailureOrigin) {
+		t.Fatalf("expected failure mode block page, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestDualStackClientMatchesIPv4Decision(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{decision(1, "203.0.113.10", "ban")}})
+	registry := testRegistry(t, nil, nil)
+
+	dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: "[::ffff:203.0.113.10]:5000", Header: map[string][]string{}}
+	if got := SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, testHandoff()); got != plugin.SniffResultAccept {
+		t.Fatalf("SniffHandler() = %v, want accept", got)
+	}
+
+	request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	request.RemoteAddr = "[::ffff:203.0.113.10]:5000"
+	request.Header.Set("Accept", "application/json")
+	recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), `"ip":"203.0.113.10"`) {
+		t.Fatalf("expected block page for the IPv4 address, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+func TestCountryDecisionBlocksLocatedClient(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	countryBan := &models.Decision{ID: 1, Scope: str("Country"), Value: str("FR"), Type: str("ban"), Origin: str("cscli"), Scenario: str("manual")}
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{countryBan}})
+	registry := testRegistry(t, nil, nil)
+
+	// a country database placing 192.0.2.0/24 in France
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: "GeoLite2-Country", IncludeReservedNetworks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, network, _ := net.ParseCIDR("192.0.2.0/24")
+	if err := tree.Insert(network, mmdbtype.Map{"country": mmdbtype.Map{"iso_code": mmdbtype.String("FR")}}); err != nil {
+		t.Fatal(err)
+	}
+	var database bytes.Buffer
+	if _, err := tree.WriteTo(&database); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "country.mmdb")
+	if err := os.WriteFile(path, database.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if pluginConfig.GeoIP.Resolver, err = geoip.Open(path, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	for ip, want := range map[string]plugin.SniffResult{"192.0.2.1": plugin.SniffResultAccept, "198.51.100.1": plugin.SniffResultSkip} {
+		dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: ip + ":5000", Header: map[string][]string{}}
+		if got := SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, testHandoff()); got != want {
+			t.Fatalf("SniffHandler(%s) = %v, want %v", ip, got, want)
+		}
+	}
+
+	// the block log says where the client is
+	var logs bytes.Buffer
+	logger.SetOutput(&logs)
+	logger.SetLevel(logrus.InfoLevel)
+	request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	request.RemoteAddr = "192.0.2.1:5000"
+	recorder := capture(logger, pluginConfig, decisionCache, registry, request)
+	if recorder.Code != http.StatusForbidden {
+		t.Fatalf("expected block page, got %d", recorder.Code)
+	}
+	if !strings.Contains(logs.String(), "IP 192.0.2.1, country FR, scenario manual") {
+		t.Fatalf("block log = %q, want the country of the client", logs.String())
+	}
+}
+
+func TestCaptureIgnoresHandoffForAnotherClient(t *testing.T) {
+	logger, _, pluginConfig, decisionCache := testSetup(t)
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{
+		decision(1, "203.0.113.1", "throttle"),
+		decision(2, "203.0.113.2", "ban"),
+	}})
+	registry := testRegistry(t, nil, nil)
+	registry.TarpitDelay = time.Millisecond
+	handoff := testHandoff()
+	handoff.Put("request-1", Match{IP: "203.0.113.1", Decision: decision(1, "203.0.113.1", "throttle")})
+
+	// A different client replays the request ID recorded for 203.0.113.1.
+	request := httptest.NewRequest(http.MethodGet, "/protected", nil)
+	request.RemoteAddr = "203.0.113.2:5000"
+	request.Header.Set(RequestIDHeader, "request-1")
+	request.Header.Set("Accept", "application/json")
+	recorder := httptest.NewRecorder()
+	CaptureHandler(logger, pluginConfig, decisionCache, registry, handoff, recorder, request)
+	if recorder.Code != http.StatusForbidden || !strings.Contains(recorder.Body.String(), `"ip":"203.0.113.2"`) {
+		t.Fatalf("expected the replaying client's own decision, got %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+}
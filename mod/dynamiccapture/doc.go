@@ -8,7 +8,13 @@ It directly interacts with the CrowdSec bouncer to check if the request IP is ba
   - If skipped, zoraxy will forward the request to the next handler in the chain, which could be the origin server or another plugin.
 
 The capture handler is where zoraxy directs the requests that were accepted by the sniff handler.
-It is responsible for handling the request, which in this case means blocking the request or eventually maybe presenting a captcha.
+It is responsible for handling the request, which in this case means blocking the request or presenting a captcha challenge.
+
+The two stages are linked by the request UUID Zoraxy sends in the X-Zoraxy-RequestID header.
+The sniff handler records the decision it matched in a Handoff store under that UUID, and the capture handler claims it,
+so both stages act on the same decision without a second cache lookup.
+As clients can send that header too, the capture handler only uses a recorded decision if it was matched for the same client IP,
+and otherwise looks the decision up again.
 
 For more information, refer to the [zoraxy documentation on plugin architecture](https://zoraxy.aroz.org/plugins/html/2.%20Architecture/1.%20Plugin%20Architecture.html).
 */
@@ -0,0 +1,129 @@
+package dynamiccapture
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// RequestIDHeader carries the UUID Zoraxy assigns to a request. It is sent
+// with both the sniff and the capture request, so it links the two stages.
+const RequestIDHeader = "X-Zoraxy-RequestID"
+
+const (
+	// DefaultHandoffCapacity bounds how many captured requests are remembered.
+	DefaultHandoffCapacity = 10000
+	// DefaultHandoffTTL is how long the capture stage has to claim a request.
+	DefaultHandoffTTL = 30 * time.Second
+)
+
+// Match is what the sniff stage found for a request.
+type Match struct {
+	IP       string
+	Location geoip.Location
+	Decision *models.Decision
+}
+
+type handoffEntry struct {
+	requestID string
+	match     Match
+	expires   time.Time
+}
+
+// Handoff passes the decision matched by the sniff handler to the capture
+// handler, keyed by the Zoraxy request ID. Entries are removed when claimed,
+// expire after a TTL, and the oldest entries are evicted once the store is
+// full, so requests that never reach the capture stage cannot grow it
+// without bound.
+type Handoff struct {
+	mu       sync.Mutex
+	capacity int
+	ttl      time.Duration
+	order    *list.List
+	entries  map[string]*list.Element
+	now      func() time.Time
+}
+
+func NewHandoff(capacity int, ttl time.Duration) *Handoff {
+	return &Handoff{
+		capacity: capacity,
+		ttl:      ttl,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		now:      time.Now,
+	}
+}
+
+// Put remembers match for requestID. Empty request IDs are ignored.
+func (h *Handoff) Put(requestID string, match Match) {
+	if requestID == "" || h.capacity <= 0 {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	h.evictExpired(now)
+
+	if element, ok := h.entries[requestID]; ok {
+		h.order.Remove(element)
+		delete(h.entries, requestID)
+	}
+	for h.order.Len() >= h.capacity {
+		h.remove(h.order.Front())
+	}
+
+	h.entries[requestID] = h.order.PushBack(&handoffEntry{
+		requestID: requestID,
+		match:     match,
+		expires:   now.Add(h.ttl),
+	})
+}
+
+// Take returns and forgets the match recorded for requestID.
+func (h *Handoff) Take(requestID string) (Match, bool) {
+	if requestID == "" {
+		return Match{}, false
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	element, ok := h.entries[requestID]
+	if !ok {
+		return Match{}, false
+	}
+	entry := h.remove(element)
+	if !h.now().Before(entry.expires) {
+		return Match{}, false
+	}
+	return entry.match, true
+}
+
+// Len returns the number of entries currently held.
+func (h *Handoff) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.order.Len()
+}
+
+// evictExpired drops expired entries. All entries share the same TTL, so
+// they expire in insertion order.
+func (h *Handoff) evictExpired(now time.Time) {
+	for front := h.order.Front(); front != nil; front = h.order.Front() {
+		if now.Before(front.Value.(*handoffEntry).expires) {
+			return
+		}
+		h.remove(front)
+	}
+}
+
+func (h *Handoff) remove(element *list.Element) *handoffEntry {
+	entry := h.order.Remove(element).(*handoffEntry)
+	delete(h.entries, entry.requestID)
+	return entry
+}
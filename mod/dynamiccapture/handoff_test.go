@@ -0,0 +1,118 @@
+package dynamiccapture
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestHandoffPutTake(t *testing.T) {
+	handoff := NewHandoff(10, time.Minute)
+	ban := decision(1, "203.0.113.10", "ban")
+
+	handoff.Put("", Match{IP: "203.0.113.10", Decision: ban})
+	if handoff.Len() != 0 {
+		t.Fatal("expected empty request IDs to be ignored")
+	}
+
+	handoff.Put("request-1", Match{IP: "203.0.113.10", Decision: ban})
+	match, ok := handoff.Take("request-1")
+	if !ok || match.IP != "203.0.113.10" || match.Decision != ban {
+		t.Fatalf("Take() = %+v, %v, want recorded match", match, ok)
+	}
+	if _, ok := handoff.Take("request-1"); ok {
+		t.Fatal("expected an entry to be claimed only once")
+	}
+}
+
+func TestHandoffExpiresEntries(t *testing.T) {
+	now := time.Now()
+	handoff := NewHandoff(10, time.Second)
+	handoff.now = func() time.Time { return now }
+
+	handoff.Put("request-1", Match{IP: "203.0.113.10"})
+	now = now.Add(2 * time.Second)
+	if _, ok := handoff.Take("request-1"); ok {
+		t.Fatal("expected expired entry to be ignored")
+	}
+
+	handoff.Put("request-2", Match{IP: "203.0.113.10"})
+	now = now.Add(2 * time.Second)
+	handoff.Put("request-3", Match{IP: "203.0.113.10"})
+	if handoff.Len() != 1 {
+		t.Fatalf("Len() = %d, want expired entries to be swept on Put", handoff.Len())
+	}
+}
+
+func TestHandoffEvictsOldestWhenFull(t *testing.T) {
+	handoff := NewHandoff(2, time.Minute)
+	handoff.Put("request-1", Match{IP: "203.0.113.1"})
+	handoff.Put("request-2", Match{IP: "203.0.113.2"})
+	handoff.Put("request-3", Match{IP: "203.0.113.3"})
+
+	if handoff.Len() != 2 {
+		t.Fatalf("Len() = %d, want 2", handoff.Len())
+	}
+	if _, ok := handoff.Take("request-1"); ok {
+		t.Fatal("expected the oldest entry to be evicted")
+	}
+	if _, ok := handoff.Take("request-3"); !ok {
+		t.Fatal("expected the newest entry to be kept")
+	}
+}
+
+func TestSniffHandsDecisionToCapture(t *testing.T) {
+	logger, metricsHandler, pluginConfig, decisionCache := testSetup(t)
+	ban := decision(7, "203.0.113.10", "ban")
+	ban.Scenario = str("crowdsecurity/ssh-bf")
+	ban.Duration = str("1m30.5s")
+	decisionCache.Apply(&models.DecisionsStreamResponse{New: []*models.Decision{ban}})
+	registry := testRegistry(t, nil, nil)
+	handoff := testHandoff()
+
+	// Route the sniff request through the plugin router, which reads the
+	// request ID header the same way it does for requests from Zoraxy.
+	mux := http.NewServeMux()
+	plugin.NewPathRouter().RegisterDynamicSniffHandler("/d_sniff", mux, func(dsfr *plugin.DynamicSniffForwardRequest) plugin.SniffResult {
+		return SniffHandler(logger, metricsHandler, pluginConfig, dsfr, decisionCache, registry, handoff)
+	})
+	payload, _ := json.Marshal(plugin.DynamicSniffForwardRequest{RemoteAddr: "203.0.113.10:5000", Header: map[string][]string{}})
+	sniffRequest := httptest.NewRequest(http.MethodPost, "/d_sniff/", bytes.NewReader(payload))
+	sniffRequest.Header.Set(RequestIDHeader, "request-1")
+	sniffRecorder := httptest.NewRecorder()
+	mux.ServeHTTP(sniffRecorder, sniffRequest)
+	if sniffRecorder.Code != http.StatusOK {
+		t.Fatalf("sniff status = %d, want accept", sniffRecorder.Code)
+	}
+
+	// Remove the decision, so the capture stage can only know about it
+	// through the handoff.
+	decisionCache.Apply(&models.DecisionsStreamResponse{Deleted: []*models.Decision{ban}})
+
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = "203.0.113.10:5000"
+	request.Header.Set(RequestIDHeader, "request-1")
+	request.Header.Set("Accept", "application/json")
+	recorder := httptest.NewRecorder()
+	CaptureHandler(logger, pluginConfig, decisionCache, registry, handoff, recorder, request)
+
+	var page BlockPage
+	if err := json.NewDecoder(recorder.Body).Decode(&page); err != nil {
+		t.Fatalf("unable to decode JSON body: %v", err)
+	}
+	if page.DecisionID != 7 || page.ClientIP != "203.0.113.10" {
+		t.Fatalf("expected handed-over decision, got %+v", page)
+	}
+	if got := recorder.Header().Get("Retry-After"); got != "91" {
+		t.Fatalf("Retry-After = %q, want 91", got)
+	}
+	if handoff.Len() != 0 {
+		t.Fatal("expected the handoff entry to be claimed")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/metrics"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
 	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
 	"github.com/sirupsen/logrus"
@@ -12,26 +13,52 @@ import (
 // The Sniff handler is what decides whether to accept or skip a request
 // It is called for each request
 //
-// TODO: if/when we support captchas, we should maybe add a header to the request, or something
-func SniffHandler(logger *logrus.Logger, metricsHandler *metrics.MetricsHandler, config *config.PluginConfig, dsfr *plugin.DynamicSniffForwardRequest, decisions *decisions.Cache) plugin.SniffResult {
+// Decisions whose remediation is log-only are skipped, as are clients holding
+// a valid captcha cookie while their decision is remediated with a challenge.
+// Requests without a decision are skipped unless the failure policy is
+// engaged for their hostname.
+// Accepted requests have their decision recorded in handoff for the Capture
+// handler.
+func SniffHandler(logger *logrus.Logger, metricsHandler *metrics.MetricsHandler, config *config.PluginConfig, dsfr *plugin.DynamicSniffForwardRequest, decisionSource decisions.Source, registry *remediation.Registry, handoff *Handoff) plugin.SniffResult {
 	defer metricsHandler.MarkRequestProcessed(dsfr.Hostname)
 
-	// Look up the request IP in the local decision cache.
-	ip, err := utils.GetRealIP(logger, dsfr, config.IsProxiedBehindCloudflare)
+	// Look up the request IP, and its country and AS if GeoIP databases are
+	// configured, in the local decision cache, or in LAPI in live mode.
+	ip, err := utils.GetRealIP(logger, dsfr, config.RealIP)
 	if err != nil {
 		logger.Warnf("GetRealIP Got an error: %v for request: %s", err, dsfr.GetRequest().RequestURI)
 		return plugin.SniffResultSkip // Skip the request if there is an error
 	}
 
-	decision := decisions.GetBan(ip)
+	location := config.GeoIP.Resolver.Lookup(ip)
+	decision := decisionSource.Lookup(ip, location)
 	if decision == nil {
-		logger.Debugf("No decision found for IP: %s", ip)
-		return plugin.SniffResultSkip // Skip the request if there is no decision
+		if !registry.Failure.Engaged(dsfr.Hostname) {
+			logger.Debugf("No decision found for IP: %s", ip)
+			return plugin.SniffResultSkip // Skip the request if there is no decision
+		}
+		// The decision stream is stale and the failure mode is closed for
+		// this hostname, so remediate the request as if it had a decision.
+		logger.Debugf("No decision found for IP: %s, but the decision stream is stale", ip)
+		decision = registry.Failure.Decision(ip.String())
 	}
 
-	// This bouncer currently remediates ban decisions by handing the request
-	// to the capture handler, which returns a forbidden response.
-	logger.Debugf("Decision found for IP: %s", ip)
-	metricsHandler.MarkRequestDropped(dsfr.Hostname, decision)
+	action := registry.ActionFor(decision)
+	switch action {
+	case remediation.ActionLog:
+		logger.Infof("Decision %d (%s) found for %s, logging only", decision.ID, *decision.Type, describeClient(ip.String(), location))
+		return plugin.SniffResultSkip // Skip the request if the remediation is log-only
+	case remediation.ActionChallenge:
+		if registry.Challenger.HasValidCookie(dsfr.Header, ip.String()) {
+			logger.Debugf("Decision found for IP: %s, but the client has already solved the challenge", ip)
+			return plugin.SniffResultSkip // Skip the request if the captcha was already solved
+		}
+	}
+
+	// Hand the request to the capture handler, which carries out the
+	// remediation action.
+	logger.Debugf("Decision found for IP: %s, remediation: %s", ip, action)
+	metricsHandler.MarkRequestDropped(dsfr.Hostname, decision, location)
+	handoff.Put(dsfr.GetRequestUUID(), Match{IP: ip.String(), Location: location, Decision: decision})
 	return plugin.SniffResultAccept // Accept the request to be handled by the Capture handler
 }
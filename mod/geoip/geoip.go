@@ -0,0 +1,172 @@
+// Package geoip resolves the country and autonomous system of client IPs
+// with local MaxMind-format databases, such as GeoLite2-Country or
+// GeoLite2-City and GeoLite2-ASN, so that decisions with the country and AS
+// scopes can be enforced.
+package geoip
+
+import (
+	"fmt"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oschwald/maxminddb-golang/v2"
+)
+
+// Location is where a client IP is. Empty fields could not be resolved, e.g.
+// because no database is configured or the IP is not listed in it.
+type Location struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, e.g. FR.
+	Country string
+	// ASN is the number of the autonomous system announcing the IP.
+	ASN          uint32
+	Organization string
+}
+
+// ASNString returns ASN in decimal, the way CrowdSec writes the value of AS
+// decisions, or "" if it is not known.
+func (l Location) ASNString() string {
+	if l.ASN == 0 {
+		return ""
+	}
+	return strconv.FormatUint(uint64(l.ASN), 10)
+}
+
+// String describes l for logs, e.g. "country FR, AS 64496 (Example Org)",
+// or returns "" if nothing is known.
+func (l Location) String() string {
+	var parts []string
+	if l.Country != "" {
+		parts = append(parts, "country "+l.Country)
+	}
+	if l.ASN != 0 {
+		as := "AS " + l.ASNString()
+		if l.Organization != "" {
+			as += " (" + l.Organization + ")"
+		}
+		parts = append(parts, as)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// countryRecord holds the fields read from country and city databases. The
+// registered country is used for IPs without a country, e.g. anycast ones.
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+// asnRecord holds the fields read from ASN databases.
+type asnRecord struct {
+	Number       uint32 `maxminddb:"autonomous_system_number"`
+	Organization string `maxminddb:"autonomous_system_organization"`
+}
+
+// Resolver looks client IPs up in the configured databases. A nil Resolver,
+// or one without databases, resolves nothing.
+//
+// The databases are read into memory, so the files can be replaced while
+// they are in use, e.g. by geoipupdate, and a Resolver stays valid until it
+// is no longer referenced.
+type Resolver struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// Open reads the country and ASN databases at the given paths. Either path
+// may be empty to not resolve that part of the location.
+func Open(countryPath, asnPath string) (*Resolver, error) {
+	resolver := &Resolver{}
+	var err error
+	if countryPath != "" {
+		resolver.country, err = open(countryPath, "Country", "City")
+		if err != nil {
+			return nil, err
+		}
+	}
+	if asnPath != "" {
+		resolver.asn, err = open(asnPath, "ASN")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolver, nil
+}
+
+// open reads the database at path, which must be of one of the given kinds,
+// so that a country database set as the ASN one, or the other way around, is
+// reported rather than resolving nothing.
+func open(path string, kinds ...string) (*maxminddb.Reader, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read GeoIP database: %w", err)
+	}
+	reader, err := maxminddb.OpenBytes(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a MaxMind database: %w", path, err)
+	}
+	databaseType := reader.Metadata.DatabaseType
+	for _, kind := range kinds {
+		if strings.Contains(databaseType, kind) {
+			return reader, nil
+		}
+	}
+	return nil, fmt.Errorf("%s is a %s database, expected a %s one", path, databaseType, strings.Join(kinds, " or "))
+}
+
+// Enabled reports whether r resolves anything.
+func (r *Resolver) Enabled() bool {
+	return r != nil && (r.country != nil || r.asn != nil)
+}
+
+// Lookup returns the location of ip. Errors reading a record leave its
+// fields empty, as the request goes on without them.
+func (r *Resolver) Lookup(ip netip.Addr) Location {
+	var location Location
+	if r == nil || !ip.IsValid() {
+		return location
+	}
+	ip = ip.Unmap()
+
+	if r.country != nil {
+		var record countryRecord
+		if err := r.country.Lookup(ip).Decode(&record); err == nil {
+			location.Country = record.Country.ISOCode
+			if location.Country == "" {
+				location.Country = record.RegisteredCountry.ISOCode
+			}
+		}
+	}
+	if r.asn != nil {
+		var record asnRecord
+		if err := r.asn.Lookup(ip).Decode(&record); err == nil {
+			location.ASN = record.Number
+			location.Organization = record.Organization
+		}
+	}
+	return location
+}
+
+// String describes the loaded databases, e.g. "GeoLite2-Country built
+// 2026-10-14, GeoLite2-ASN built 2026-10-14", so that reloading an updated
+// database can be told apart. It returns "" if there are none.
+func (r *Resolver) String() string {
+	if r == nil {
+		return ""
+	}
+	var databases []string
+	for _, reader := range []*maxminddb.Reader{r.country, r.asn} {
+		if reader == nil {
+			continue
+		}
+		built := time.Unix(int64(reader.Metadata.BuildEpoch), 0).UTC()
+		databases = append(databases, fmt.Sprintf("%s built %s", reader.Metadata.DatabaseType, built.Format(time.DateOnly)))
+	}
+	return strings.Join(databases, ", ")
+}
@@ -0,0 +1,107 @@
+package geoip
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maxmind/mmdbwriter"
+	"github.com/maxmind/mmdbwriter/mmdbtype"
+)
+
+// writeDatabase writes a database of databaseType holding record for each
+// network, and returns its path.
+func writeDatabase(t *testing.T, databaseType string, records map[string]mmdbtype.Map) string {
+	t.Helper()
+	tree, err := mmdbwriter.New(mmdbwriter.Options{DatabaseType: databaseType, IncludeReservedNetworks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for network, record := range records {
+		_, ipNet, err := net.ParseCIDR(network)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := tree.Insert(ipNet, record); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), databaseType+".mmdb")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := tree.WriteTo(file); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func country(isoCode string) mmdbtype.Map {
+	return mmdbtype.Map{"iso_code": mmdbtype.String(isoCode)}
+}
+
+func TestResolverLookup(t *testing.T) {
+	countryPath := writeDatabase(t, "GeoLite2-Country", map[string]mmdbtype.Map{
+		"192.0.2.0/24":    {"country": country("FR"), "registered_country": country("FR")},
+		"198.51.100.0/24": {"registered_country": country("US")},
+	})
+	asnPath := writeDatabase(t, "GeoLite2-ASN", map[string]mmdbtype.Map{
+		"192.0.2.0/25": {"autonomous_system_number": mmdbtype.Uint32(64496), "autonomous_system_organization": mmdbtype.String("Example Org")},
+	})
+	resolver, err := Open(countryPath, asnPath)
+	if err != nil {
+		t.Fatalf("Open() error = %v", err)
+	}
+
+	tests := []struct {
+		ip   string
+		want Location
+	}{
+		{"192.0.2.1", Location{Country: "FR", ASN: 64496, Organization: "Example Org"}},
+		{"::ffff:192.0.2.1", Location{Country: "FR", ASN: 64496, Organization: "Example Org"}},
+		{"192.0.2.200", Location{Country: "FR"}},
+		{"198.51.100.1", Location{Country: "US"}},
+		{"203.0.113.1", Location{}},
+	}
+	for _, tt := range tests {
+		if got := resolver.Lookup(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("Lookup(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	if got := resolver.Lookup(netip.MustParseAddr("192.0.2.1")).String(); got != "country FR, AS 64496 (Example Org)" {
+		t.Errorf("Location.String() = %q", got)
+	}
+	if got := resolver.String(); !strings.HasPrefix(got, "GeoLite2-Country built ") || !strings.Contains(got, ", GeoLite2-ASN built ") {
+		t.Errorf("String() = %q", got)
+	}
+
+	var disabled *Resolver
+	if disabled.Enabled() || disabled.Lookup(netip.MustParseAddr("192.0.2.1")) != (Location{}) {
+		t.Error("a nil Resolver resolved a location")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	asnPath := writeDatabase(t, "GeoLite2-ASN", nil)
+	garbage := filepath.Join(t.TempDir(), "garbage.mmdb")
+	if err := os.WriteFile(garbage, []byte("not a database"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string][2]string{
+		"missing file":            {filepath.Join(t.TempDir(), "missing.mmdb"), ""},
+		"not a database":          {"", garbage},
+		"ASN database as country": {asnPath, ""},
+	}
+	for name, paths := range tests {
+		if _, err := Open(paths[0], paths[1]); err == nil {
+			t.Errorf("%s: Open() expected an error", name)
+		}
+	}
+}
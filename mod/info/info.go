@@ -13,6 +13,9 @@ const (
 	DYNAMIC_CAPTURE_INGRESS = "/d_capture"
 	DYNAMIC_CAPTURE_SNIFF   = "/d_sniff"
 	CONFIGURATION_FILE      = "./config.yaml"
+	BLOCK_PAGE_FILE         = "./ban.html"
+	SNAPSHOT_FILE           = "./decisions.snapshot.json"
+	CLOUDFLARE_IPS_FILE     = "./cloudflare_ips.txt"
 	BOUNCER_TYPE            = "zoraxy-crowdsec-bouncer"
 
 	VERSION_MAJOR  = 1
@@ -0,0 +1,82 @@
+package lapi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+)
+
+// DefaultCheckTimeout bounds a connection check, so that an unreachable LAPI
+// does not hold up saving the configuration.
+const DefaultCheckTimeout = 5 * time.Second
+
+// checkPath is requested by a connection check. Looking up a loopback
+// address needs the bouncer's API key but changes nothing.
+const checkPath = "v1/decisions"
+
+// ConnectionCheck is the outcome of a one-shot authenticated call to LAPI.
+// It has no LAPI version, as LAPI does not report its release to bouncers.
+type ConnectionCheck struct {
+	URL string `json:"url"`
+	// Reachable is true when LAPI answered at all.
+	Reachable bool `json:"reachable"`
+	// Authenticated is true when LAPI accepted the API key or client
+	// certificate.
+	Authenticated bool `json:"authenticated"`
+	StatusCode    int  `json:"statusCode,omitempty"`
+	// Latency is the round-trip time of the call, if LAPI answered.
+	Latency string `json:"latency,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// CheckConnection makes one authenticated call to the LAPI at agentURL with
+// apiKey, using client. An empty apiKey relies on the client certificate of
+// client instead.
+func CheckConnection(ctx context.Context, client *http.Client, agentURL, apiKey string) ConnectionCheck {
+	check := ConnectionCheck{URL: agentURL}
+
+	endpoint, err := url.JoinPath(agentURL, checkPath)
+	if err != nil {
+		check.Error = fmt.Sprintf("invalid agent_url: %v", err)
+		return check
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?ip=127.0.0.1", nil)
+	if err != nil {
+		check.Error = fmt.Sprintf("invalid agent_url: %v", err)
+		return check
+	}
+	if apiKey != "" {
+		request.Header.Set("X-Api-Key", apiKey)
+	}
+	request.Header.Set("User-Agent", info.BOUNCER_USER_AGENT)
+
+	start := time.Now()
+	response, err := client.Do(request)
+	if err != nil {
+		check.Error = err.Error()
+		return check
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 1<<16))
+
+	check.Reachable = true
+	check.Latency = time.Since(start).Round(100 * time.Microsecond).String()
+	check.StatusCode = response.StatusCode
+	switch {
+	case response.StatusCode == http.StatusOK:
+		check.Authenticated = true
+	case response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden:
+		check.Error = "LAPI rejected the API key"
+		if apiKey == "" {
+			check.Error = "LAPI rejected the client certificate"
+		}
+	default:
+		check.Error = fmt.Sprintf("unexpected response from LAPI: %s", response.Status)
+	}
+	return check
+}
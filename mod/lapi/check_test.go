@@ -0,0 +1,58 @@
+package lapi
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+)
+
+// fakeLAPI accepts decision lookups made with the API key "valid".
+func fakeLAPI(t *testing.T) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/decisions" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Header.Get("X-Api-Key") != "valid" || r.Header.Get("User-Agent") != info.BOUNCER_USER_AGENT {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("null"))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCheckConnection(t *testing.T) {
+	server := fakeLAPI(t)
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name              string
+		url, key          string
+		reachable, authed bool
+	}{
+		{"valid credentials", server.URL, "valid", true, true},
+		{"trailing slash", server.URL + "/", "valid", true, true},
+		{"wrong key", server.URL, "wrong", true, false},
+		{"wrong path", server.URL + "/lapi", "valid", true, false},
+		{"unreachable", closed.URL, "valid", false, false},
+	}
+	for _, tt := range tests {
+		check := CheckConnection(context.Background(), server.Client(), tt.url, tt.key)
+		if check.Reachable != tt.reachable || check.Authenticated != tt.authed {
+			t.Errorf("%s: CheckConnection() = %+v, want reachable %v, authenticated %v", tt.name, check, tt.reachable, tt.authed)
+		}
+		if check.Authenticated != (check.Error == "") {
+			t.Errorf("%s: CheckConnection() error = %q", tt.name, check.Error)
+		}
+		if check.Reachable != (check.Latency != "") {
+			t.Errorf("%s: CheckConnection() latency = %q", tt.name, check.Latency)
+		}
+	}
+}
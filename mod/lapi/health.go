@@ -0,0 +1,154 @@
+// Package lapi pulls decisions from, or looks them up in, the CrowdSec Local
+// API and keeps track of how healthy that connection is.
+package lapi
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Health records the outcome of every decision stream pull.
+type Health struct {
+	now func() time.Time
+
+	mu sync.RWMutex
+	// url is the endpoint decisions are pulled from, out of endpoints
+	url                 string
+	endpoints           []string
+	switches            int
+	lastSwitch          time.Time
+	lastAttempt         time.Time
+	lastSuccess         time.Time
+	lastError           string
+	lastErrorAt         time.Time
+	consecutiveFailures int
+	lastAdded           int
+	lastRemoved         int
+	initialSnapshot     time.Time
+}
+
+// Status is a snapshot of the connection health, as reported by
+// /api/lapi-status.
+type Status struct {
+	// Enabled is false while the bouncer is not connecting to LAPI, e.g. in
+	// onboarding mode.
+	Enabled bool `json:"enabled"`
+	// URL is the endpoint decisions are pulled from.
+	URL string `json:"url,omitempty"`
+	// Endpoints are every configured LAPI, in order of preference.
+	Endpoints []string `json:"endpoints,omitempty"`
+	// Switches counts how many times decisions started being pulled from
+	// another endpoint, and LastSwitch is when that last happened.
+	Switches            int        `json:"switches"`
+	LastSwitch          *time.Time `json:"lastSwitch,omitempty"`
+	Connected           bool       `json:"connected"`
+	LastAttempt         *time.Time `json:"lastAttempt,omitempty"`
+	LastSuccess         *time.Time `json:"lastSuccess,omitempty"`
+	LastError           string     `json:"lastError,omitempty"`
+	LastErrorAt         *time.Time `json:"lastErrorAt,omitempty"`
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastAdded           int        `json:"lastAdded"`
+	LastRemoved         int        `json:"lastRemoved"`
+	InitialSnapshot     *time.Time `json:"initialSnapshot,omitempty"`
+}
+
+// NewHealth returns the health of a connection to endpoints, which starts
+// with the first one.
+func NewHealth(endpoints []string) *Health {
+	h := &Health{now: time.Now}
+	h.Reset(endpoints)
+	return h
+}
+
+// Reset forgets every recorded pull, and records that the bouncer now
+// connects to endpoints, starting with the first one. It is used when the
+// bouncer is restarted with new settings.
+func (h *Health) Reset(endpoints []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.endpoints = slices.Clone(endpoints)
+	h.url = ""
+	if len(endpoints) > 0 {
+		h.url = endpoints[0]
+	}
+	h.switches, h.lastSwitch = 0, time.Time{}
+	h.lastAttempt, h.lastSuccess, h.lastErrorAt, h.initialSnapshot = time.Time{}, time.Time{}, time.Time{}, time.Time{}
+	h.lastError = ""
+	h.consecutiveFailures, h.lastAdded, h.lastRemoved = 0, 0, 0
+}
+
+// RecordSuccess records a successful pull that added and removed the given
+// number of decisions. startup marks the initial snapshot.
+func (h *Health) RecordSuccess(added, removed int, startup bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	h.lastAttempt = now
+	h.lastSuccess = now
+	h.consecutiveFailures = 0
+	h.lastAdded = added
+	h.lastRemoved = removed
+	if startup {
+		h.initialSnapshot = now
+	}
+}
+
+// RecordSwitch records that decisions are now pulled from url.
+func (h *Health) RecordSwitch(url string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.url = url
+	h.switches++
+	h.lastSwitch = h.now()
+}
+
+// RecordFailure records a failed pull.
+func (h *Health) RecordFailure(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	h.lastAttempt = now
+	h.lastError = err.Error()
+	h.lastErrorAt = now
+	h.consecutiveFailures++
+}
+
+// Synced reports whether the initial snapshot has been received.
+func (h *Health) Synced() bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return !h.initialSnapshot.IsZero()
+}
+
+// Status returns the current connection health.
+func (h *Health) Status() Status {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return Status{
+		Enabled:             true,
+		URL:                 h.url,
+		Endpoints:           slices.Clone(h.endpoints),
+		Switches:            h.switches,
+		LastSwitch:          timeOrNil(h.lastSwitch),
+		Connected:           !h.lastSuccess.IsZero() && h.consecutiveFailures == 0,
+		LastAttempt:         timeOrNil(h.lastAttempt),
+		LastSuccess:         timeOrNil(h.lastSuccess),
+		LastError:           h.lastError,
+		LastErrorAt:         timeOrNil(h.lastErrorAt),
+		ConsecutiveFailures: h.consecutiveFailures,
+		LastAdded:           h.lastAdded,
+		LastRemoved:         h.lastRemoved,
+		InitialSnapshot:     timeOrNil(h.initialSnapshot),
+	}
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
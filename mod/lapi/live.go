@@ -0,0 +1,384 @@
+package lapi
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/utils"
+	"github.com/crowdsecurity/crowdsec/pkg/apiclient"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/sirupsen/logrus"
+)
+
+// probeIP is looked up to check that a live bouncer can reach LAPI.
+const probeIP = "127.0.0.1"
+
+const (
+	// DefaultLiveCapacity bounds how many answers a Live source caches.
+	DefaultLiveCapacity = 10000
+	// DefaultMaxLiveLookups bounds how many lookups a Live source makes to
+	// LAPI at once.
+	DefaultMaxLiveLookups = 64
+)
+
+// errTooManyLookups fails the lookups that waited for their whole timeout
+// while DefaultMaxLiveLookups others were in flight.
+var errTooManyLookups = errors.New("too many lookups in flight")
+
+// Decision scopes looked up in live mode.
+const (
+	ScopeIP      = "ip"
+	ScopeCountry = "country"
+	ScopeAS      = "as"
+)
+
+// Fetcher asks LAPI for the active decisions applying to value in scope: the
+// IP and range decisions containing an IP for ScopeIP, or the decisions for
+// a country or AS.
+type Fetcher func(ctx context.Context, scope, value string) ([]*models.Decision, error)
+
+// BouncerFetcher looks decisions up with the API client of an initialized
+// live bouncer, and counts the calls in the CrowdSec metrics.
+func BouncerFetcher(bouncer *csbouncer.LiveBouncer) Fetcher {
+	return func(ctx context.Context, scope, value string) ([]*models.Decision, error) {
+		var response *models.GetDecisionsResponse
+		var err error
+		if scope == ScopeIP {
+			response, err = bouncer.Get(ctx, value)
+		} else {
+			response, _, err = bouncer.APIClient.Decisions.List(ctx, apiclient.DecisionsListOpts{ScopeEquals: scope, ValueEquals: value})
+		}
+		csbouncer.TotalLAPICalls.Inc()
+		if err != nil {
+			csbouncer.TotalLAPIError.Inc()
+			return nil, err
+		}
+		if response == nil {
+			return nil, nil
+		}
+		return *response, nil
+	}
+}
+
+// ProbePuller checks that fetch can reach LAPI by looking up a loopback
+// address, and returns an empty update. Run uses it in live mode to track
+// the health of each endpoint and fail over between them, as there is no
+// decision stream.
+func ProbePuller(fetch Fetcher) Puller {
+	return func(ctx context.Context, startup bool) (*models.DecisionsStreamResponse, error) {
+		if _, err := fetch(ctx, ScopeIP, probeIP); err != nil {
+			return nil, err
+		}
+		return &models.DecisionsStreamResponse{}, nil
+	}
+}
+
+// LiveOptions configure the lookups of a Live source.
+type LiveOptions struct {
+	// CacheTTL is how long a decision found for an IP is reused, at most
+	// until the decision expires.
+	CacheTTL time.Duration
+	// NegativeCacheTTL is how long the absence of a decision is reused.
+	NegativeCacheTTL time.Duration
+	// Timeout bounds how long a lookup waits for LAPI.
+	Timeout time.Duration
+	// Filter selects the decisions enforced, as LAPI does not filter
+	// lookups.
+	Filter *decisions.Filter
+}
+
+// liveKey is what is looked up in LAPI: an IP, or the country or AS of a
+// client.
+type liveKey struct {
+	scope string
+	value string
+}
+
+// liveEntry is a cached answer. decision is nil for keys without a decision.
+type liveEntry struct {
+	key      liveKey
+	decision *models.Decision
+	expires  time.Time
+}
+
+// liveCall is a lookup in flight, which concurrent lookups of the same key
+// wait for instead of querying LAPI again.
+type liveCall struct {
+	done     chan struct{}
+	decision *models.Decision
+	err      error
+}
+
+// Live is the decision source in live mode. It asks LAPI about each client
+// IP when it is first seen, rather than keeping every decision locally, and
+// caches the answers, with or without a decision, for a while. The country
+// and AS of the client, when they are known, are looked up and cached the
+// same way, in parallel with the IP.
+//
+// Concurrent lookups of the same key share one call to LAPI, and no lookup
+// waits longer than the configured timeout, so a slow LAPI does not stall
+// the requests going through Zoraxy. A lookup that fails or times out finds
+// no decision, unless an earlier answer for the key is still cached, and the
+// failure policy decides what happens to the request.
+//
+// So that a scan across many addresses cannot exhaust memory or flood LAPI,
+// the least recently used answers are evicted once the cache is full, and
+// lookups made while too many others are in flight wait for one of them to
+// finish, within their timeout.
+type Live struct {
+	logger *logrus.Logger
+	now    func() time.Time
+
+	mu       sync.Mutex
+	fetch    Fetcher
+	options  LiveOptions
+	priority func(decisionType string) int
+	capacity int
+	// slots holds a value for each call to LAPI in flight
+	slots chan struct{}
+	// order holds the cached answers, least recently used first
+	order    *list.List
+	entries  map[liveKey]*list.Element
+	inflight map[liveKey]*liveCall
+	// generation is incremented by Use, so that answers to lookups made
+	// with the previous endpoint are not cached
+	generation uint64
+}
+
+// NewLive returns a Live source without an endpoint, which finds no
+// decisions until Use is called.
+func NewLive(logger *logrus.Logger) *Live {
+	return &Live{
+		logger:   logger,
+		now:      time.Now,
+		priority: decisions.DefaultTypePriority,
+		capacity: DefaultLiveCapacity,
+		slots:    make(chan struct{}, DefaultMaxLiveLookups),
+		order:    list.New(),
+		entries:  make(map[liveKey]*list.Element),
+		inflight: make(map[liveKey]*liveCall),
+	}
+}
+
+// Use makes lookups go through fetch with options, and forgets the cached
+// answers, which may come from another LAPI or from older settings. A nil
+// fetch stops the lookups, e.g. in stream mode.
+func (l *Live) Use(fetch Fetcher, options LiveOptions) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.fetch = fetch
+	l.options = options
+	l.order.Init()
+	l.entries = make(map[liveKey]*list.Element)
+	l.generation++
+}
+
+// SetTypePriority replaces the function used to rank decision types when
+// several decisions match the same IP. Higher values win.
+func (l *Live) SetTypePriority(priority func(decisionType string) int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.priority = priority
+}
+
+// Len returns the number of cached answers, including expired ones that have
+// not been swept yet.
+func (l *Live) Len() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.order.Len()
+}
+
+// GetDecision returns the IP or range decision that should be remediated for
+// ip, if any, from the cache or from LAPI.
+func (l *Live) GetDecision(ip netip.Addr) *models.Decision {
+	return l.Lookup(ip, geoip.Location{})
+}
+
+// pendingLookup is a key whose answer a Lookup waits for, along with the
+// expired answer cached for it, if any.
+type pendingLookup struct {
+	key    liveKey
+	call   *liveCall
+	joined bool
+	entry  liveEntry
+	cached bool
+}
+
+// Lookup returns the decision that should be remediated for a client at ip
+// and location, if any, from the cache or from LAPI, ranked like the
+// lookups of a decisions.Cache.
+func (l *Live) Lookup(ip netip.Addr, location geoip.Location) *models.Decision {
+	if !ip.IsValid() {
+		return nil
+	}
+	ip = utils.NormalizeIP(ip)
+	keys := []liveKey{{scope: ScopeIP, value: ip.String()}}
+	if location.Country != "" {
+		keys = append(keys, liveKey{scope: ScopeCountry, value: location.Country})
+	}
+	if location.ASN != 0 {
+		keys = append(keys, liveKey{scope: ScopeAS, value: location.ASNString()})
+	}
+
+	l.mu.Lock()
+	now := l.now()
+	priority := l.priority
+	found := make([]*models.Decision, 0, len(keys))
+	var pending []pendingLookup
+	for _, key := range keys {
+		var entry liveEntry
+		element, cached := l.entries[key]
+		if cached {
+			l.order.MoveToBack(element)
+			entry = *element.Value.(*liveEntry)
+		}
+		if cached && now.Before(entry.expires) {
+			found = append(found, entry.decision)
+			continue
+		}
+		if l.fetch == nil {
+			continue
+		}
+		call, joined := l.inflight[key]
+		if !joined {
+			call = &liveCall{done: make(chan struct{})}
+			l.inflight[key] = call
+			go l.lookup(ip, location, key, call, l.fetch, l.options, l.generation)
+		}
+		pending = append(pending, pendingLookup{key: key, call: call, joined: joined, entry: entry, cached: cached})
+	}
+	l.mu.Unlock()
+
+	for _, p := range pending {
+		<-p.call.done
+		if p.call.err == nil {
+			found = append(found, p.call.decision)
+			continue
+		}
+		if !p.joined {
+			l.logger.Debugf("Unable to look up decisions for %s %s: %v", p.key.scope, p.key.value, p.call.err)
+		}
+		// an earlier answer is better than none while LAPI is unavailable
+		if p.cached && p.entry.decision != nil {
+			if remaining, ok := decisions.Remaining(p.entry.decision, now); !ok || remaining > 0 {
+				found = append(found, p.entry.decision)
+			}
+		}
+	}
+	return decisions.Best(ip, location, found, priority, now)
+}
+
+// lookup asks LAPI about key within options.Timeout, including the time
+// spent waiting for a slot, and caches the answer, then releases the lookups
+// waiting for call. ip and location are those of the client the lookup is
+// made for, which the answer matches.
+func (l *Live) lookup(ip netip.Addr, location geoip.Location, key liveKey, call *liveCall, fetch Fetcher, options LiveOptions, generation uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), options.Timeout)
+	defer cancel()
+	var found []*models.Decision
+	var err error
+	select {
+	case l.slots <- struct{}{}:
+		found, err = fetch(ctx, key.scope, key.value)
+		<-l.slots
+		if err != nil && ctx.Err() != nil {
+			err = fmt.Errorf("LAPI did not answer within %s: %w", options.Timeout, err)
+		}
+	case <-ctx.Done():
+		err = fmt.Errorf("no slot within %s: %w", options.Timeout, errTooManyLookups)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	defer close(call.done)
+	delete(l.inflight, key)
+	if err != nil {
+		call.err = err
+		return
+	}
+
+	now := l.now()
+	found = slices.DeleteFunc(found, func(decision *models.Decision) bool { return !options.Filter.Match(decision) })
+	call.decision = decisions.Best(ip, location, found, l.priority, now)
+	if generation != l.generation {
+		return
+	}
+	ttl := options.NegativeCacheTTL
+	if call.decision != nil {
+		ttl = options.CacheTTL
+		if remaining, ok := decisions.Remaining(call.decision, now); ok {
+			// record the expiry, so the remaining time is not reported
+			// anew each time the cached decision is used
+			call.decision.Until = now.Add(remaining).UTC().Format(time.RFC3339Nano)
+			ttl = min(ttl, remaining)
+		}
+	}
+	if ttl > 0 {
+		l.store(liveEntry{key: key, decision: call.decision, expires: now.Add(ttl)})
+	}
+}
+
+// store caches entry, evicting the least recently used answers if the cache
+// is full. The caller must hold the lock.
+func (l *Live) store(entry liveEntry) {
+	if element, ok := l.entries[entry.key]; ok {
+		l.remove(element)
+	}
+	for l.order.Len() >= l.capacity && l.order.Len() > 0 {
+		l.remove(l.order.Front())
+	}
+	l.entries[entry.key] = l.order.PushBack(&entry)
+}
+
+// remove drops a cached answer. The caller must hold the lock.
+func (l *Live) remove(element *list.Element) {
+	entry := l.order.Remove(element).(*liveEntry)
+	delete(l.entries, entry.key)
+}
+
+// Sweep removes every cached answer that has expired at now and returns how
+// many were removed. Decisions are kept until they expire themselves, as
+// they are still used while LAPI is unavailable.
+func (l *Live) Sweep(now time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	removed := 0
+	for element := l.order.Front(); element != nil; {
+		next := element.Next()
+		entry := element.Value.(*liveEntry)
+		expired := !now.Before(entry.expires)
+		if remaining, ok := decisions.Remaining(entry.decision, now); expired && (!ok || remaining <= 0) {
+			l.remove(element)
+			removed++
+		}
+		element = next
+	}
+	return removed
+}
+
+// RunExpirySweeper sweeps expired answers every interval until ctx is done.
+// Lookups already ignore expired answers; sweeping frees their memory.
+func (l *Live) RunExpirySweeper(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			l.Sweep(now)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package lapi
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+func liveDecision(id int64, decisionType, scope, value, duration string) *models.Decision {
+	return &models.Decision{ID: id, Type: &decisionType, Scope: &scope, Value: &value, Duration: &duration}
+}
+
+// fakeFetcher answers with the decisions of each looked up value, counting
+// the lookups.
+type fakeFetcher struct {
+	calls   atomic.Int32
+	answers map[string][]*models.Decision
+	// release, if set, holds every lookup until it is closed
+	release chan struct{}
+	err     error
+}
+
+func (f *fakeFetcher) fetch(ctx context.Context, scope, value string) ([]*models.Decision, error) {
+	f.calls.Add(1)
+	if f.release != nil {
+		select {
+		case <-f.release:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	var found []*models.Decision
+	for _, decision := range f.answers[value] {
+		copied := *decision
+		found = append(found, &copied)
+	}
+	return found, nil
+}
+
+func newTestLive(fetcher *fakeFetcher, options LiveOptions) (*Live, *time.Time) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	live := NewLive(logrus.New())
+	live.now = func() time.Time { return now }
+	live.Use(fetcher.fetch, options)
+	return live, &now
+}
+
+func TestLiveCachesAnswers(t *testing.T) {
+	fetcher := &fakeFetcher{answers: map[string][]*models.Decision{
+		"192.0.2.1": {
+			liveDecision(1, "captcha", "Range", "192.0.2.0/24", "4h"),
+			liveDecision(2, "ban", "Ip", "192.0.2.1", "30s"),
+		},
+	}}
+	live, now := newTestLive(fetcher, LiveOptions{CacheTTL: time.Minute, NegativeCacheTTL: 10 * time.Second, Timeout: time.Second})
+	banned, clean := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("198.51.100.1")
+
+	if decision := live.GetDecision(banned); decision == nil || decision.ID != 2 {
+		t.Fatalf("GetDecision() = %+v, want the ban", decision)
+	}
+	if decision := live.GetDecision(clean); decision != nil {
+		t.Fatalf("GetDecision() = %+v, want none", decision)
+	}
+	live.GetDecision(banned)
+	live.GetDecision(clean)
+	if calls := fetcher.calls.Load(); calls != 2 {
+		t.Fatalf("fetched %d times, want the answers to be cached", calls)
+	}
+
+	// the absence of a decision is cached for less time, and a decision no
+	// longer than it lasts
+	*now = now.Add(15 * time.Second)
+	live.GetDecision(banned)
+	live.GetDecision(clean)
+	if calls := fetcher.calls.Load(); calls != 3 {
+		t.Fatalf("fetched %d times, want the negative answer to expire", calls)
+	}
+	*now = now.Add(20 * time.Second)
+	live.GetDecision(banned)
+	if calls := fetcher.calls.Load(); calls != 4 {
+		t.Fatalf("fetched %d times, want the answer to expire with the decision", calls)
+	}
+
+	// another endpoint starts over
+	live.Use(fetcher.fetch, LiveOptions{Timeout: time.Second})
+	if live.Len() != 0 {
+		t.Fatalf("Len() = %d after Use(), want 0", live.Len())
+	}
+}
+
+func TestLiveLooksUpCountryAndAS(t *testing.T) {
+	fetcher := &fakeFetcher{answers: map[string][]*models.Decision{
+		"192.0.2.1": {liveDecision(1, "captcha", "Ip", "192.0.2.1", "4h")},
+		"FR":        {liveDecision(2, "ban", "Country", "FR", "4h")},
+		"64496":     {liveDecision(3, "captcha", "AS", "64496", "4h")},
+	}}
+	live, _ := newTestLive(fetcher, LiveOptions{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute, Timeout: time.Second})
+
+	if decision := live.Lookup(netip.MustParseAddr("192.0.2.1"), geoip.Location{Country: "FR", ASN: 64496}); decision == nil || decision.ID != 2 {
+		t.Fatalf("Lookup() = %+v, want the country ban", decision)
+	}
+	if calls := fetcher.calls.Load(); calls != 3 {
+		t.Fatalf("fetched %d times, want the IP, country and AS looked up", calls)
+	}
+	// another client of the same AS reuses its answer
+	if decision := live.Lookup(netip.MustParseAddr("198.51.100.1"), geoip.Location{ASN: 64496}); decision == nil || decision.ID != 3 {
+		t.Fatalf("Lookup() = %+v, want the AS captcha", decision)
+	}
+	if calls := fetcher.calls.Load(); calls != 4 {
+		t.Fatalf("fetched %d times, want only the new IP looked up", calls)
+	}
+}
+
+func TestLiveFiltersAnswers(t *testing.T) {
+	community := liveDecision(1, "ban", "Ip", "192.0.2.1", "4h")
+	community.Origin = new(string)
+	*community.Origin = "CAPI"
+	fetcher := &fakeFetcher{answers: map[string][]*models.Decision{"192.0.2.1": {community}}}
+	live, _ := newTestLive(fetcher, LiveOptions{Timeout: time.Second, Filter: &decisions.Filter{Origins: []string{"crowdsec", "cscli"}}})
+
+	if decision := live.GetDecision(netip.MustParseAddr("192.0.2.1")); decision != nil {
+		t.Fatalf("GetDecision() = %+v, want the community decision filtered out", decision)
+	}
+}
+
+func TestLiveCoalescesLookups(t *testing.T) {
+	fetcher := &fakeFetcher{release: make(chan struct{})}
+	live, _ := newTestLive(fetcher, LiveOptions{NegativeCacheTTL: time.Minute, Timeout: time.Second})
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() { live.GetDecision(ip) })
+	}
+	// let the lookups pile up on the first one
+	for fetcher.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(fetcher.release)
+	wg.Wait()
+
+	if calls := fetcher.calls.Load(); calls != 1 {
+		t.Fatalf("fetched %d times for concurrent lookups of the same IP, want 1", calls)
+	}
+}
+
+func TestLiveBoundsCacheAndLookups(t *testing.T) {
+	fetcher := &fakeFetcher{answers: map[string][]*models.Decision{
+		"192.0.2.3": {liveDecision(1, "ban", "Ip", "192.0.2.3", "4h")},
+	}}
+	live, _ := newTestLive(fetcher, LiveOptions{CacheTTL: time.Minute, NegativeCacheTTL: time.Minute, Timeout: time.Second})
+	live.capacity = 2
+	first, second, third := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.3")
+
+	// the least recently used answer is evicted
+	live.GetDecision(first)
+	live.GetDecision(second)
+	live.GetDecision(first)
+	live.GetDecision(third)
+	if live.Len() != 2 {
+		t.Fatalf("Len() = %d, want the cache bounded to 2", live.Len())
+	}
+	live.GetDecision(first)
+	if calls := fetcher.calls.Load(); calls != 3 {
+		t.Fatalf("fetched %d times, want the recently used answer kept", calls)
+	}
+	live.GetDecision(second)
+	if calls := fetcher.calls.Load(); calls != 4 {
+		t.Fatalf("fetched %d times, want the least recently used answer evicted", calls)
+	}
+
+	// lookups over the limit wait for a slot
+	live.slots = make(chan struct{}, 1)
+	live.Use(fetcher.fetch, LiveOptions{CacheTTL: time.Minute, Timeout: 5 * time.Second})
+	fetcher.release = make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Go(func() { live.GetDecision(first) })
+	for fetcher.calls.Load() == 4 {
+		time.Sleep(time.Millisecond)
+	}
+	var decision *models.Decision
+	wg.Go(func() { decision = live.GetDecision(third) })
+	time.Sleep(20 * time.Millisecond)
+	if calls := fetcher.calls.Load(); calls != 5 {
+		t.Fatalf("fetched %d times, want the lookup over the limit to wait", calls)
+	}
+	close(fetcher.release)
+	wg.Wait()
+	if decision == nil || decision.ID != 1 {
+		t.Fatalf("GetDecision() = %+v, want the ban once a slot is free", decision)
+	}
+
+	// and fail once their timeout is over
+	live.Use(fetcher.fetch, LiveOptions{Timeout: 20 * time.Millisecond})
+	live.slots <- struct{}{}
+	if decision := live.GetDecision(third); decision != nil {
+		t.Fatalf("GetDecision() = %+v, want none without a free slot", decision)
+	}
+	if calls := fetcher.calls.Load(); calls != 6 {
+		t.Fatalf("fetched %d times, want no call without a free slot", calls)
+	}
+}
+
+func TestLiveTimeout(t *testing.T) {
+	fetcher := &fakeFetcher{answers: map[string][]*models.Decision{
+		"192.0.2.1": {liveDecision(1, "ban", "Ip", "192.0.2.1", "4h")},
+	}}
+	live, now := newTestLive(fetcher, LiveOptions{CacheTTL: time.Minute, Timeout: 20 * time.Millisecond})
+	banned, clean := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("198.51.100.1")
+	if live.GetDecision(banned) == nil {
+		t.Fatal("GetDecision() = nil, want the ban")
+	}
+
+	// LAPI stops answering
+	fetcher.release = make(chan struct{})
+	defer close(fetcher.release)
+	*now = now.Add(2 * time.Minute)
+
+	start := time.Now()
+	if decision := live.GetDecision(clean); decision != nil {
+		t.Fatalf("GetDecision() = %+v, want none when LAPI does not answer", decision)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("GetDecision() took %s, want it bounded by the timeout", elapsed)
+	}
+	if decision := live.GetDecision(banned); decision == nil || decision.ID != 1 {
+		t.Fatalf("GetDecision() = %+v, want the earlier answer while LAPI does not answer", decision)
+	}
+
+	// expired answers are swept, but decisions are kept until they expire
+	if removed := live.Sweep(*now); removed != 0 || live.Len() != 1 {
+		t.Fatalf("Sweep() = %d, Len() = %d, want the ban kept", removed, live.Len())
+	}
+	if removed := live.Sweep(now.Add(5 * time.Hour)); removed != 1 {
+		t.Fatalf("Sweep() = %d, want the expired ban removed", removed)
+	}
+}
+
+func TestProbePuller(t *testing.T) {
+	fetcher := &fakeFetcher{}
+	pull := ProbePuller(fetcher.fetch)
+	if update, err := pull(context.Background(), true); err != nil || update == nil || len(update.New) != 0 {
+		t.Fatalf("pull() = %+v, %v, want an empty update", update, err)
+	}
+	fetcher.err = errors.New("connection refused")
+	if _, err := pull(context.Background(), false); err == nil {
+		t.Fatal("pull() expected an error")
+	}
+}
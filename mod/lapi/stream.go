@@ -0,0 +1,168 @@
+package lapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	csbouncer "github.com/crowdsecurity/go-cs-bouncer"
+	"github.com/sirupsen/logrus"
+)
+
+// initialRetryDelay is how long to wait before retrying a failed startup
+// pull. It is linear rather than exponential, like the upstream stream
+// bouncer, because LAPI being down at boot is usually short-lived.
+var initialRetryDelay = 10 * time.Second
+
+// Puller requests one decision stream update. startup asks LAPI for every
+// active decision rather than the changes since the last pull.
+type Puller func(ctx context.Context, startup bool) (*models.DecisionsStreamResponse, error)
+
+// BouncerPuller pulls decisions with the API client and filters of an
+// initialized stream bouncer, and counts the calls in the CrowdSec metrics.
+func BouncerPuller(bouncer *csbouncer.StreamBouncer) Puller {
+	return func(ctx context.Context, startup bool) (*models.DecisionsStreamResponse, error) {
+		opts := bouncer.Opts
+		opts.Startup = startup
+
+		data, resp, err := bouncer.APIClient.Decisions.GetStream(ctx, opts)
+		if resp != nil && resp.Response != nil {
+			resp.Response.Body.Close()
+		}
+		csbouncer.TotalLAPICalls.Inc()
+		if err != nil {
+			csbouncer.TotalLAPIError.Inc()
+		}
+		return data, err
+	}
+}
+
+// Endpoint is a LAPI decisions can be pulled from.
+type Endpoint struct {
+	URL  string
+	Pull Puller
+}
+
+// failoverAfter is how many pulls in a row must fail before the other
+// endpoints are tried, so that a single dropped request does not cause a
+// full resync from another LAPI.
+var failoverAfter = 2
+
+// failbackInterval is how often the preferred endpoints are tried again
+// while decisions are pulled from a fallback.
+var failbackInterval = time.Minute
+
+// Run pulls decisions every interval until ctx is done, passing each update
+// to handle and recording the outcome in health. The first successful pull
+// is the startup snapshot; until it succeeds, pulls are retried every
+// initialRetryDelay.
+//
+// Decisions are pulled from the first of endpoints, in order of preference.
+// When it fails failoverAfter pulls in a row, or the startup pull, the others
+// are tried in order, and every failbackInterval the preferred ones are tried
+// again. Decision IDs differ between LAPIs, so switching to another endpoint
+// starts over with a startup pull. handle is told the index of the endpoint
+// each update came from.
+//
+// It replaces StreamBouncer.Run, which only logs failed pulls.
+func Run(ctx context.Context, logger *logrus.Logger, endpoints []Endpoint, interval time.Duration, health *Health, handle func(endpoint int, update *models.DecisionsStreamResponse, startup bool)) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	active := 0
+	startup := true
+	failures := 0
+	lastFailback := time.Now()
+	// no delay for the first pull
+	delay := time.After(0)
+
+	// switchTo makes the endpoint that answered a startup pull the active
+	// one
+	switchTo := func(endpoint int, update *models.DecisionsStreamResponse) {
+		logger.Warnf("Switched from LAPI %s to %s, received %d decisions", endpoints[active].URL, endpoints[endpoint].URL, len(update.New))
+		active, startup, failures = endpoint, false, 0
+		lastFailback = time.Now()
+		health.RecordSwitch(endpoints[endpoint].URL)
+		handle(endpoint, update, true)
+		health.RecordSuccess(len(update.New), len(update.Deleted), true)
+		delay = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-delay:
+		}
+
+		// go back to a preferred endpoint once it answers again
+		if active > 0 && !startup && time.Since(lastFailback) >= failbackInterval {
+			lastFailback = time.Now()
+			if endpoint, update := pullFirst(ctx, logger, endpoints, func(i int) bool { return i < active }); update != nil {
+				switchTo(endpoint, update)
+				continue
+			}
+		}
+
+		update, err := endpoints[active].Pull(ctx, startup)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			health.RecordFailure(err)
+			failures++
+			if len(endpoints) > 1 && (startup || failures >= failoverAfter) {
+				logger.Errorf("Failed to pull decisions from LAPI %s, trying the other endpoints: %v", endpoints[active].URL, err)
+				if endpoint, update := pullFirst(ctx, logger, endpoints, func(i int) bool { return i != active }); update != nil {
+					switchTo(endpoint, update)
+					continue
+				}
+			}
+			if startup {
+				logger.Errorf("Failed to connect to LAPI %s, retrying in %s: %v", endpoints[active].URL, initialRetryDelay, err)
+				delay = time.After(initialRetryDelay)
+			} else {
+				logger.Errorf("Failed to pull decisions from LAPI %s: %v", endpoints[active].URL, err)
+				delay = ticker.C
+			}
+			continue
+		}
+
+		if update == nil {
+			update = &models.DecisionsStreamResponse{}
+		}
+		failures = 0
+		handle(active, update, startup)
+		health.RecordSuccess(len(update.New), len(update.Deleted), startup)
+		if startup {
+			logger.Infof("Received initial snapshot of %d decisions from LAPI %s", len(update.New), endpoints[active].URL)
+		}
+
+		startup = false
+		delay = ticker.C
+	}
+}
+
+// pullFirst makes a startup pull from each of the endpoints selected by try,
+// in order, and returns the first one that answers with its update. The
+// update is nil if none does.
+func pullFirst(ctx context.Context, logger *logrus.Logger, endpoints []Endpoint, try func(endpoint int) bool) (int, *models.DecisionsStreamResponse) {
+	for i, endpoint := range endpoints {
+		if !try(i) {
+			continue
+		}
+		update, err := endpoint.Pull(ctx, true)
+		if ctx.Err() != nil {
+			return 0, nil
+		}
+		if err != nil {
+			logger.Debugf("LAPI %s is still unavailable: %v", endpoint.URL, err)
+			continue
+		}
+		if update == nil {
+			update = &models.DecisionsStreamResponse{}
+		}
+		return i, update
+	}
+	return 0, nil
+}
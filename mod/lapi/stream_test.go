@@ -0,0 +1,212 @@
+package lapi
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/sirupsen/logrus"
+)
+
+func TestRunRecordsHealth(t *testing.T) {
+	initialRetryDelay = time.Millisecond
+	t.Cleanup(func() { initialRetryDelay = 10 * time.Second })
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	health := NewHealth([]string{"http://127.0.0.1:8080/"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// fail the startup pull once, then succeed, then fail a delta pull
+	type result struct {
+		update *models.DecisionsStreamResponse
+		err    error
+	}
+	results := []result{
+		{err: errors.New("connection refused")},
+		{update: &models.DecisionsStreamResponse{New: make([]*models.Decision, 3)}},
+		{update: &models.DecisionsStreamResponse{New: make([]*models.Decision, 1), Deleted: make([]*models.Decision, 2)}},
+		{err: errors.New("timeout")},
+	}
+	var startups []bool
+	pulled := make(chan struct{})
+	pull := func(ctx context.Context, startup bool) (*models.DecisionsStreamResponse, error) {
+		if len(results) == 0 {
+			// every result has been handled, wait to be stopped
+			close(pulled)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		startups = append(startups, startup)
+		next := results[0]
+		results = results[1:]
+		return next.update, next.err
+	}
+
+	var handled []bool
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, logger, []Endpoint{{URL: "http://127.0.0.1:8080/", Pull: pull}}, time.Millisecond, health, func(endpoint int, update *models.DecisionsStreamResponse, startup bool) {
+			handled = append(handled, startup)
+		})
+	}()
+
+	select {
+	case <-pulled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for pulls")
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	if want := []bool{true, true, false, false}; !equalBools(startups, want) {
+		t.Fatalf("startup flags = %v, want %v", startups, want)
+	}
+	if want := []bool{true, false}; !equalBools(handled, want) {
+		t.Fatalf("handled updates = %v, want %v", handled, want)
+	}
+
+	status := health.Status()
+	if !health.Synced() || status.InitialSnapshot == nil {
+		t.Fatal("expected the initial snapshot to be recorded")
+	}
+	if status.Connected || status.ConsecutiveFailures != 1 || status.LastError != "timeout" {
+		t.Fatalf("expected the failed delta pull to be recorded, got %+v", status)
+	}
+	if status.LastAdded != 1 || status.LastRemoved != 2 {
+		t.Fatalf("last delta = +%d/-%d, want +1/-2", status.LastAdded, status.LastRemoved)
+	}
+}
+
+func TestHealthReportsNotSyncedUntilSnapshot(t *testing.T) {
+	health := NewHealth([]string{"http://127.0.0.1:8080/"})
+	health.RecordFailure(errors.New("connection refused"))
+	health.RecordFailure(errors.New("connection refused"))
+
+	status := health.Status()
+	if health.Synced() || status.Connected || status.ConsecutiveFailures != 2 || status.LastSuccess != nil {
+		t.Fatalf("unexpected status before the first pull: %+v", status)
+	}
+
+	health.RecordSuccess(5, 0, true)
+	status = health.Status()
+	if !health.Synced() || !status.Connected || status.ConsecutiveFailures != 0 || status.LastError != "connection refused" {
+		t.Fatalf("unexpected status after the first pull: %+v", status)
+	}
+}
+
+func equalBools(a, b []bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestHealthReset(t *testing.T) {
+	health := NewHealth([]string{"http://127.0.0.1:8080", "http://10.0.0.3:8080"})
+	health.RecordSuccess(3, 1, true)
+	health.RecordFailure(errors.New("connection refused"))
+	health.RecordSwitch("http://10.0.0.3:8080")
+
+	health.Reset([]string{"http://10.0.0.2:8080"})
+	status := health.Status()
+	if health.Synced() || status.URL != "http://10.0.0.2:8080" || len(status.Endpoints) != 1 || status.Switches != 0 || status.LastSuccess != nil || status.LastError != "" || status.ConsecutiveFailures != 0 {
+		t.Fatalf("Status() after Reset() = %+v", status)
+	}
+}
+
+func TestRunFailsOver(t *testing.T) {
+	failbackInterval = 20 * time.Millisecond
+	t.Cleanup(func() { failbackInterval = time.Minute })
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the primary fails while it is down, and the secondary always answers
+	var mu sync.Mutex
+	primaryUp := true
+	var secondaryStartups int
+	primary := func(ctx context.Context, startup bool) (*models.DecisionsStreamResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if !primaryUp {
+			return nil, errors.New("connection refused")
+		}
+		return &models.DecisionsStreamResponse{New: make([]*models.Decision, 2)}, nil
+	}
+	secondary := func(ctx context.Context, startup bool) (*models.DecisionsStreamResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if startup {
+			secondaryStartups++
+			return &models.DecisionsStreamResponse{New: make([]*models.Decision, 3)}, nil
+		}
+		return &models.DecisionsStreamResponse{}, nil
+	}
+	endpoints := []Endpoint{{URL: "http://lapi-1:8080", Pull: primary}, {URL: "http://lapi-2:8080", Pull: secondary}}
+	health := NewHealth([]string{endpoints[0].URL, endpoints[1].URL})
+
+	type handled struct {
+		endpoint int
+		startup  bool
+	}
+	updates := make(chan handled, 100)
+	done := make(chan error)
+	go func() {
+		done <- Run(ctx, logger, endpoints, time.Millisecond, health, func(endpoint int, update *models.DecisionsStreamResponse, startup bool) {
+			updates <- handled{endpoint, startup}
+		})
+	}()
+
+	// waitFor returns once the next full resync comes from endpoint
+	waitFor := func(endpoint int) {
+		t.Helper()
+		for {
+			select {
+			case update := <-updates:
+				if update.startup && update.endpoint == endpoint {
+					return
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for a resync from endpoint %d", endpoint)
+			}
+		}
+	}
+	waitFor(0)
+	mu.Lock()
+	primaryUp = false
+	mu.Unlock()
+	waitFor(1)
+	if status := health.Status(); status.URL != endpoints[1].URL || status.Switches != 1 || !status.Connected {
+		t.Fatalf("Status() after failover = %+v", status)
+	}
+
+	mu.Lock()
+	primaryUp = true
+	mu.Unlock()
+	waitFor(0)
+	if status := health.Status(); status.URL != endpoints[0].URL || status.Switches != 2 {
+		t.Fatalf("Status() after failback = %+v", status)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+	if secondaryStartups != 1 {
+		t.Fatalf("secondary startup pulls = %d, want 1", secondaryStartups)
+	}
+}
@@ -0,0 +1,75 @@
+package lapi
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSOptions configure the TLS connection to LAPI. A client certificate, set
+// with CertPath and KeyPath, authenticates the bouncer instead of an API key.
+type TLSOptions struct {
+	CertPath   string
+	KeyPath    string
+	CACertPath string
+	// InsecureSkipVerify disables the verification of LAPI's certificate.
+	InsecureSkipVerify bool
+}
+
+// HasClientCertificate reports whether a client certificate is configured.
+func (o TLSOptions) HasClientCertificate() bool {
+	return o.CertPath != "" && o.KeyPath != ""
+}
+
+// LoadCAPool returns the system certificate pool with the PEM certificates
+// in the file at path added, which is how the stream bouncer verifies LAPI.
+// An empty path returns the system pool.
+func LoadCAPool(path string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		return nil, fmt.Errorf("unable to load system CA certificates: %w", err)
+	}
+	if path == "" {
+		return pool, nil
+	}
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read CA certificate: %w", err)
+	}
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no PEM certificate found in %s", path)
+	}
+	return pool, nil
+}
+
+// Config loads the certificates into a TLS configuration.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	pool, err := LoadCAPool(o.CACertPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{RootCAs: pool, InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.HasClientCertificate() {
+		certificate, err := tls.LoadX509KeyPair(o.CertPath, o.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// HTTPClient returns a client for one-off calls to LAPI, such as
+// CheckConnection, that connects the way the stream bouncer does.
+func (o TLSOptions) HTTPClient() (*http.Client, error) {
+	config, err := o.Config()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = config
+	return &http.Client{Transport: transport}, nil
+}
@@ -0,0 +1,152 @@
+package lapi
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// issue creates a certificate for template signed by parent, or self-signed
+// if parent is nil, and writes it and its key to PEM files in dir.
+func issue(t *testing.T, dir, name string, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, crypto.Signer, string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certificate, key, certPath, keyPath
+}
+
+// fakeTLSLAPI accepts decision lookups from clients presenting a certificate
+// signed by the CA it returns the path of, along with the paths of such a
+// client certificate and key.
+func fakeTLSLAPI(t *testing.T) (server *httptest.Server, caPath, certPath, keyPath string) {
+	t.Helper()
+	dir := t.TempDir()
+	ca, caKey, caPath, _ := issue(t, dir, "ca", &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil, nil)
+	_, _, serverCertPath, serverKeyPath := issue(t, dir, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "lapi"},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1)},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey)
+	_, _, certPath, keyPath = issue(t, dir, "bouncer", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "bouncer", OrganizationalUnit: []string{"bouncer-ou"}},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	serverCertificate, err := tls.LoadX509KeyPair(serverCertPath, serverKeyPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca)
+
+	server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.TLS.VerifiedChains) == 0 || r.Header.Get("X-Api-Key") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("null"))
+	}))
+	// the unknown CA case fails the handshake, which the server logs
+	server.Config.ErrorLog = log.New(io.Discard, "", 0)
+	server.TLS = &tls.Config{
+		Certificates: []tls.Certificate{serverCertificate},
+		ClientCAs:    clientCAs,
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+	}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, caPath, certPath, keyPath
+}
+
+func TestCheckConnectionWithClientCertificate(t *testing.T) {
+	server, caPath, certPath, keyPath := fakeTLSLAPI(t)
+
+	tests := []struct {
+		name              string
+		options           TLSOptions
+		reachable, authed bool
+	}{
+		{"client certificate", TLSOptions{CertPath: certPath, KeyPath: keyPath, CACertPath: caPath}, true, true},
+		{"skip verify", TLSOptions{CertPath: certPath, KeyPath: keyPath, InsecureSkipVerify: true}, true, true},
+		{"no client certificate", TLSOptions{CACertPath: caPath}, true, false},
+		{"unknown CA", TLSOptions{CertPath: certPath, KeyPath: keyPath}, false, false},
+	}
+	for _, tt := range tests {
+		client, err := tt.options.HTTPClient()
+		if err != nil {
+			t.Fatalf("%s: HTTPClient() error = %v", tt.name, err)
+		}
+		check := CheckConnection(context.Background(), client, server.URL, "")
+		if check.Reachable != tt.reachable || check.Authenticated != tt.authed {
+			t.Errorf("%s: CheckConnection() = %+v, want reachable %v, authenticated %v", tt.name, check, tt.reachable, tt.authed)
+		}
+		if tt.reachable && !tt.authed && check.Error != "LAPI rejected the client certificate" {
+			t.Errorf("%s: CheckConnection() error = %q", tt.name, check.Error)
+		}
+	}
+}
+
+func TestTLSOptionsConfigErrors(t *testing.T) {
+	_, _, certPath, keyPath := fakeTLSLAPI(t)
+
+	for name, options := range map[string]TLSOptions{
+		"missing CA":       {CACertPath: filepath.Join(t.TempDir(), "missing.pem")},
+		"CA without PEM":   {CACertPath: keyPath},
+		"mismatched pair":  {CertPath: certPath, KeyPath: certPath},
+		"missing key file": {CertPath: certPath, KeyPath: filepath.Join(t.TempDir(), "missing.pem")},
+	} {
+		if _, err := options.Config(); err == nil {
+			t.Errorf("%s: Config() expected an error", name)
+		}
+	}
+}
@@ -6,9 +6,11 @@ package metrics
 // Both it, and this repo, are licensed under the MIT license, so this is fine.
 
 import (
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
 	"github.com/crowdsecurity/crowdsec/pkg/models"
 	"github.com/crowdsecurity/go-cs-lib/ptr"
 	"github.com/prometheus/client_golang/prometheus"
@@ -49,11 +51,11 @@ var Map = metricMap{
 		Gauge: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: string(DROPPED_REQUESTS),
 			Help: "Denotes the total number of requests dropped by the Zoraxy bouncer",
-		}, []string{"origin", "hostname"}),
-		LabelKeys:    []string{"origin", "hostname"},
+		}, []string{"origin", "hostname", "country", "as"}),
+		LabelKeys:    []string{"origin", "hostname", "country", "as"},
 		LastValueMap: make(map[string]float64),
 		KeyFunc: func(labels []*io_prometheus_client.LabelPair) string {
-			return getLabelValue(labels, "origin") + getLabelValue(labels, "hostname")
+			return labelKey(labels, "origin", "hostname", "country", "as")
 		},
 	},
 	PROCESSED_REQUESTS: {
@@ -71,6 +73,16 @@ var Map = metricMap{
 	},
 }
 
+// labelKey joins the values of the given labels, separated so that distinct
+// label sets never share a key.
+func labelKey(labels []*io_prometheus_client.LabelPair, keys ...string) string {
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = getLabelValue(labels, key)
+	}
+	return strings.Join(values, "\x00")
+}
+
 func getLabelValue(labels []*io_prometheus_client.LabelPair, key string) string {
 	for _, label := range labels {
 		if label.GetName() == key {
@@ -81,28 +93,63 @@ func getLabelValue(labels []*io_prometheus_client.LabelPair, key string) string
 	return ""
 }
 
+const (
+	// MaxASLabels bounds how many ASes get their own value of the as label
+	// of the dropped requests, as every series is sent to LAPI on each push.
+	MaxASLabels = 100
+	// OtherAS is the as label of the requests from the ASes past MaxASLabels.
+	OtherAS = "other"
+)
+
 type MetricsHandler struct {
 	Lock   sync.RWMutex
 	logger *logrus.Logger
+	// asLabels are the ASes that have their own as label
+	asLabels map[string]struct{}
 }
 
 func NewMetricsHandler(logger *logrus.Logger) *MetricsHandler {
 	// Initialization logic for MetricsHandler if needed
 	mh := &MetricsHandler{
-		logger: logger,
-		Lock:   sync.RWMutex{},
+		logger:   logger,
+		Lock:     sync.RWMutex{},
+		asLabels: make(map[string]struct{}),
 	}
 
 	return mh
 }
 
-func (mh *MetricsHandler) MarkRequestDropped(hostname string, decision *models.Decision) {
+// MarkRequestDropped counts a request remediated because of decision. The
+// country and AS of the client are empty when they are not known. The first
+// MaxASLabels ASes seen are labelled with their number, later ones with
+// OtherAS.
+func (mh *MetricsHandler) MarkRequestDropped(hostname string, decision *models.Decision, location geoip.Location) {
 	mh.Lock.Lock()
 	defer mh.Lock.Unlock()
 
 	// Increment the dropped requests metric
 	// This is a simple counter, so we just increment the value
-	Map[DROPPED_REQUESTS].Gauge.With(prometheus.Labels{"origin": *decision.Origin, "hostname": hostname}).Inc()
+	Map[DROPPED_REQUESTS].Gauge.With(prometheus.Labels{
+		"origin":   *decision.Origin,
+		"hostname": hostname,
+		"country":  location.Country,
+		"as":       mh.asLabel(location.ASNString()),
+	}).Inc()
+}
+
+// asLabel returns the as label of the requests from as. The caller must hold
+// the lock.
+func (mh *MetricsHandler) asLabel(as string) string {
+	if as == "" {
+		return ""
+	}
+	if _, ok := mh.asLabels[as]; !ok {
+		if len(mh.asLabels) >= MaxASLabels {
+			return OtherAS
+		}
+		mh.asLabels[as] = struct{}{}
+	}
+	return as
 }
 
 func (mh *MetricsHandler) MarkRequestProcessed(hostname string) {
@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"io"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/geoip"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+	"github.com/crowdsecurity/go-cs-lib/ptr"
+	"github.com/sirupsen/logrus"
+)
+
+func TestMetricsUpdaterSendsDeltas(t *testing.T) {
+	Map.MustRegisterAll()
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	handler := NewMetricsHandler(logger)
+
+	update := func() map[string]float64 {
+		t.Helper()
+		met := &models.RemediationComponentsMetrics{}
+		handler.MetricsUpdater(met, time.Minute)
+		sent := make(map[string]float64)
+		for _, item := range met.Metrics[0].Items {
+			key := *item.Name + " " + item.Labels["hostname"] + " " + item.Labels["country"] + " " + item.Labels["as"]
+			if _, ok := sent[key]; ok {
+				t.Fatalf("%s sent twice", key)
+			}
+			sent[key] = *item.Value
+		}
+		return sent
+	}
+
+	// label values that would run together without a separator
+	decision := &models.Decision{Origin: ptr.Of("crowdsec")}
+	handler.MarkRequestDropped("h:8080", decision, geoip.Location{})
+	handler.MarkRequestDropped("h:80", decision, geoip.Location{Country: "80"})
+	handler.MarkRequestDropped("h:80", decision, geoip.Location{Country: "80"})
+	handler.MarkRequestProcessed("h:80")
+
+	want := map[string]float64{"dropped h:8080  ": 1, "dropped h:80 80 ": 2, "processed h:80  ": 1}
+	sent := update()
+	if len(sent) != len(want) {
+		t.Fatalf("first update sent %v, want %v", sent, want)
+	}
+	for key, value := range want {
+		if sent[key] != value {
+			t.Fatalf("first update sent %v, want %v", sent, want)
+		}
+	}
+
+	// every series is sent again, with what changed since the last push
+	handler.MarkRequestDropped("h:8080", decision, geoip.Location{})
+	if sent := update(); len(sent) != 3 || sent["dropped h:8080  "] != 1 || sent["dropped h:80 80 "] != 0 {
+		t.Fatalf("second update sent %v, want the deltas of every series", sent)
+	}
+}
+
+func TestDroppedRequestsBoundASLabels(t *testing.T) {
+	handler := NewMetricsHandler(logrus.New())
+	for as := range MaxASLabels {
+		if got := handler.asLabel(strconv.Itoa(as + 1)); got != strconv.Itoa(as+1) {
+			t.Fatalf("asLabel(%d) = %q, want its number", as+1, got)
+		}
+	}
+	if got := handler.asLabel("64496"); got != OtherAS {
+		t.Fatalf("asLabel() past MaxASLabels = %q, want %q", got, OtherAS)
+	}
+	if got := handler.asLabel("1"); got != "1" {
+		t.Fatalf("asLabel() of a labelled AS = %q, want its number", got)
+	}
+	if got := handler.asLabel(""); got != "" {
+		t.Fatalf("asLabel() of an unknown AS = %q, want none", got)
+	}
+}
@@ -0,0 +1,186 @@
+package remediation
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// FailureMode decides what happens to requests without a matching decision
+// while the decision stream is stale.
+type FailureMode string
+
+const (
+	// FailureOpen lets requests through, trusting the last known decisions.
+	FailureOpen FailureMode = "open"
+	// FailureClosed remediates every request.
+	FailureClosed FailureMode = "closed"
+	// FailureClosedForHosts remediates requests for the listed hostnames and
+	// lets every other request through.
+	FailureClosedForHosts FailureMode = "closed_for_hosts"
+)
+
+// FailureOrigin is the origin of the decisions made up for requests that are
+// remediated because the decision stream is stale.
+const FailureOrigin = "failure-mode"
+
+// FailureScenario is the scenario of the decisions made up for requests that
+// are remediated because the decision stream is stale.
+const FailureScenario = "lapi-unavailable"
+
+// FailurePolicy tracks when the decision stream last synced, and decides
+// which requests are remediated once it has been stale for longer than
+// StaleAfter. Until the first sync, staleness is measured from the time the
+// policy was created.
+type FailurePolicy struct {
+	Mode       FailureMode
+	Action     Action
+	StaleAfter time.Duration
+
+	hostnames map[string]struct{}
+	started   time.Time
+	now       func() time.Time
+
+	mu       sync.RWMutex
+	lastSync time.Time
+}
+
+// FailureStatus describes the failure policy and whether it is in effect.
+type FailureStatus struct {
+	Mode       FailureMode `json:"mode"`
+	Action     Action      `json:"action"`
+	Hostnames  []string    `json:"hostnames,omitempty"`
+	StaleAfter string      `json:"staleAfter"`
+	LastSync   *time.Time  `json:"lastSync,omitempty"`
+	Stale      bool        `json:"stale"`
+	// Engaged is true when requests are being remediated because of the
+	// failure mode.
+	Engaged bool `json:"engaged"`
+}
+
+// NewFailurePolicy creates a failure policy from its configuration. The
+// action must be block or challenge.
+func NewFailurePolicy(mode, action string, hostnames []string, staleAfter time.Duration) (*FailurePolicy, error) {
+	failureMode := FailureMode(strings.ToLower(strings.TrimSpace(mode)))
+	switch failureMode {
+	case FailureOpen, FailureClosed:
+	case FailureClosedForHosts:
+		if len(hostnames) == 0 {
+			return nil, fmt.Errorf("failure mode %q requires at least one hostname", failureMode)
+		}
+	default:
+		return nil, fmt.Errorf("unknown failure mode %q (available: %s, %s, %s)", mode, FailureOpen, FailureClosed, FailureClosedForHosts)
+	}
+
+	failureAction, err := ParseAction(action)
+	if err != nil {
+		return nil, fmt.Errorf("failure action: %w", err)
+	}
+	if failureAction != ActionBlock && failureAction != ActionChallenge {
+		return nil, fmt.Errorf("failure action must be %s or %s, got %q", ActionBlock, ActionChallenge, action)
+	}
+
+	policy := &FailurePolicy{
+		Mode:       failureMode,
+		Action:     failureAction,
+		StaleAfter: staleAfter,
+		hostnames:  make(map[string]struct{}, len(hostnames)),
+		now:        time.Now,
+	}
+	for _, hostname := range hostnames {
+		policy.hostnames[normalizeHostname(hostname)] = struct{}{}
+	}
+	policy.started = policy.now()
+	return policy, nil
+}
+
+// RecordSync marks a successful decision stream update.
+func (p *FailurePolicy) RecordSync() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastSync = p.now()
+}
+
+// Stale reports whether the decision stream has not synced for StaleAfter.
+func (p *FailurePolicy) Stale() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.staleLocked()
+}
+
+func (p *FailurePolicy) staleLocked() bool {
+	since := p.started
+	if !p.lastSync.IsZero() {
+		since = p.lastSync
+	}
+	return p.now().Sub(since) >= p.StaleAfter
+}
+
+// Engaged reports whether a request for hostname without a matching
+// decision must be remediated.
+func (p *FailurePolicy) Engaged(hostname string) bool {
+	if p == nil || p.Mode == FailureOpen || !p.Stale() {
+		return false
+	}
+	if p.Mode == FailureClosedForHosts {
+		_, ok := p.hostnames[normalizeHostname(hostname)]
+		return ok
+	}
+	return true
+}
+
+// Decision makes up the decision remediated for ip while the policy is
+// engaged.
+func (p *FailurePolicy) Decision(ip string) *models.Decision {
+	origin, scenario, scope := FailureOrigin, FailureScenario, "ip"
+	decisionType := string(p.Action)
+	return &models.Decision{
+		Origin:   &origin,
+		Scenario: &scenario,
+		Scope:    &scope,
+		Type:     &decisionType,
+		Value:    &ip,
+	}
+}
+
+// Status reports the policy configuration and its current state.
+func (p *FailurePolicy) Status() FailureStatus {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	status := FailureStatus{
+		Mode:       p.Mode,
+		Action:     p.Action,
+		StaleAfter: p.StaleAfter.String(),
+		Stale:      p.staleLocked(),
+	}
+	for hostname := range p.hostnames {
+		status.Hostnames = append(status.Hostnames, hostname)
+	}
+	slices.Sort(status.Hostnames)
+	if !p.lastSync.IsZero() {
+		lastSync := p.lastSync
+		status.LastSync = &lastSync
+	}
+	status.Engaged = status.Stale && p.Mode != FailureOpen
+	return status
+}
+
+// IsFailureDecision reports whether decision was made up by a failure policy.
+func IsFailureDecision(decision *models.Decision) bool {
+	return decision != nil && decision.Origin != nil && *decision.Origin == FailureOrigin
+}
+
+// normalizeHostname lowercases hostname and strips its port, if any.
+func normalizeHostname(hostname string) string {
+	hostname = strings.ToLower(strings.TrimSpace(hostname))
+	if host, _, err := net.SplitHostPort(hostname); err == nil {
+		return host
+	}
+	return hostname
+}
@@ -0,0 +1,150 @@
+// Package remediation maps CrowdSec decision types to the action the bouncer
+// takes for a matching request.
+//
+// CrowdSec ships "ban" and "captcha" decisions, but profiles can emit any
+// custom type (for example "throttle"). Every type is resolved through a
+// Registry, and types without an explicit entry fall back to its default
+// action.
+package remediation
+
+import (
+	"fmt"
+	"html/template"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+// Action is what the bouncer does with a request matching a decision.
+type Action string
+
+const (
+	// ActionBlock rejects the request with 403 Forbidden.
+	ActionBlock Action = "block"
+	// ActionChallenge serves a captcha challenge.
+	ActionChallenge Action = "challenge"
+	// ActionTarpit delays the request, then rejects it with 429 Too Many Requests.
+	ActionTarpit Action = "tarpit"
+	// ActionRedirect redirects the request to a configured URL.
+	ActionRedirect Action = "redirect"
+	// ActionLog logs the match and lets the request through.
+	ActionLog Action = "log"
+)
+
+// actionSeverity orders actions from least to most restrictive. When several
+// decisions match a request, the one whose action is most severe wins.
+var actionSeverity = map[Action]int{
+	ActionLog:       0,
+	ActionChallenge: 1,
+	ActionTarpit:    2,
+	ActionRedirect:  3,
+	ActionBlock:     4,
+}
+
+// DefaultTypes are the decision type mappings used unless overridden.
+var DefaultTypes = map[string]Action{
+	"ban":      ActionBlock,
+	"captcha":  ActionChallenge,
+	"throttle": ActionTarpit,
+}
+
+// ParseAction parses an action name, ignoring case and surrounding spaces.
+func ParseAction(name string) (Action, error) {
+	action := Action(strings.ToLower(strings.TrimSpace(name)))
+	if _, ok := actionSeverity[action]; !ok {
+		return "", fmt.Errorf("unknown remediation action %q (available: %s)", name, strings.Join(ActionNames(), ", "))
+	}
+	return action, nil
+}
+
+// ActionNames returns the names of all actions, sorted.
+func ActionNames() []string {
+	names := make([]string, 0, len(actionSeverity))
+	for action := range actionSeverity {
+		names = append(names, string(action))
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Registry resolves decision types to actions, and carries the settings the
+// actions need.
+type Registry struct {
+	DefaultAction Action
+	TarpitDelay   time.Duration
+	RedirectURL   string
+	// BlockPage renders the block action. If nil, the built-in page is used.
+	BlockPage *template.Template
+	// Challenger serves the challenge action. If nil, challenges are blocked.
+	Challenger *captcha.Challenger
+	// Failure decides what happens while the decision stream is stale. If
+	// nil, requests without a decision are always let through.
+	Failure *FailurePolicy
+
+	actions map[string]Action
+}
+
+// NewRegistry creates a registry from the configured default action and
+// per-type actions. DefaultTypes are included unless types overrides them.
+func NewRegistry(defaultAction string, types map[string]string) (*Registry, error) {
+	fallback, err := ParseAction(defaultAction)
+	if err != nil {
+		return nil, fmt.Errorf("default action: %w", err)
+	}
+
+	actions := make(map[string]Action, len(DefaultTypes)+len(types))
+	for decisionType, action := range DefaultTypes {
+		actions[decisionType] = action
+	}
+	for decisionType, name := range types {
+		action, err := ParseAction(name)
+		if err != nil {
+			return nil, fmt.Errorf("decision type %q: %w", decisionType, err)
+		}
+		actions[strings.ToLower(strings.TrimSpace(decisionType))] = action
+	}
+
+	return &Registry{DefaultAction: fallback, actions: actions}, nil
+}
+
+// ActionForType returns the configured action for a decision type.
+func (r *Registry) ActionForType(decisionType string) Action {
+	if action, ok := r.actions[strings.ToLower(decisionType)]; ok {
+		return action
+	}
+	return r.DefaultAction
+}
+
+// ActionFor returns the action to take for decision. Decisions made up by the
+// failure policy use its action. Actions that cannot be carried out with the
+// current settings, such as a challenge without a captcha provider, fall back
+// to ActionBlock.
+func (r *Registry) ActionFor(decision *models.Decision) Action {
+	if decision == nil || decision.Type == nil {
+		return r.effective(r.DefaultAction)
+	}
+	if IsFailureDecision(decision) && r.Failure != nil {
+		return r.effective(r.Failure.Action)
+	}
+
+	return r.effective(r.ActionForType(*decision.Type))
+}
+
+// Priority ranks a decision type by the severity of its action, for use with
+// decisions.Cache.SetTypePriority.
+func (r *Registry) Priority(decisionType string) int {
+	return actionSeverity[r.effective(r.ActionForType(decisionType))]
+}
+
+func (r *Registry) effective(action Action) Action {
+	switch {
+	case action == ActionChallenge && r.Challenger == nil:
+		return ActionBlock
+	case action == ActionRedirect && r.RedirectURL == "":
+		return ActionBlock
+	}
+	return action
+}
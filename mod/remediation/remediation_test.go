@@ -0,0 +1,182 @@
+package remediation
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/captcha"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func decisionOfType(decisionType string) *models.Decision {
+	return &models.Decision{Type: &decisionType}
+}
+
+func TestRegistryResolvesActions(t *testing.T) {
+	registry, err := NewRegistry("log", map[string]string{"ban": "tarpit", "Custom": " Redirect "})
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	registry.RedirectURL = "https://example.com"
+
+	tests := []struct {
+		decisionType string
+		want         Action
+	}{
+		{decisionType: "ban", want: ActionTarpit},
+		{decisionType: "BAN", want: ActionTarpit},
+		{decisionType: "custom", want: ActionRedirect},
+		{decisionType: "throttle", want: ActionTarpit},
+		{decisionType: "captcha", want: ActionBlock}, // no challenger configured
+		{decisionType: "unknown", want: ActionLog},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.decisionType, func(t *testing.T) {
+			if got := registry.ActionFor(decisionOfType(tc.decisionType)); got != tc.want {
+				t.Fatalf("ActionFor(%q) = %q, want %q", tc.decisionType, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRegistryFallsBackToBlock(t *testing.T) {
+	registry, err := NewRegistry("redirect", nil)
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+
+	if got := registry.ActionFor(decisionOfType("unknown")); got != ActionBlock {
+		t.Fatalf("redirect without a URL = %q, want %q", got, ActionBlock)
+	}
+	if got := registry.ActionFor(decisionOfType("captcha")); got != ActionBlock {
+		t.Fatalf("challenge without a challenger = %q, want %q", got, ActionBlock)
+	}
+
+	registry.Challenger = &captcha.Challenger{}
+	if got := registry.ActionFor(decisionOfType("captcha")); got != ActionChallenge {
+		t.Fatalf("challenge with a challenger = %q, want %q", got, ActionChallenge)
+	}
+}
+
+func TestRegistryPriorityFollowsSeverity(t *testing.T) {
+	registry, err := NewRegistry("log", map[string]string{"watch": "log"})
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	registry.Challenger = &captcha.Challenger{}
+
+	if !(registry.Priority("ban") > registry.Priority("throttle") &&
+		registry.Priority("throttle") > registry.Priority("captcha") &&
+		registry.Priority("captcha") > registry.Priority("watch")) {
+		t.Fatal("expected priorities to follow action severity: block > tarpit > challenge > log")
+	}
+}
+
+func TestNewRegistryRejectsUnknownActions(t *testing.T) {
+	if _, err := NewRegistry("explode", nil); err == nil {
+		t.Fatal("expected an error for an unknown default action")
+	}
+	if _, err := NewRegistry("block", map[string]string{"ban": "explode"}); err == nil {
+		t.Fatal("expected an error for an unknown type action")
+	}
+}
+
+func TestFailurePolicyEngagesWhenStale(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	newPolicy := func(mode string, hostnames ...string) *FailurePolicy {
+		t.Helper()
+		policy, err := NewFailurePolicy(mode, "block", hostnames, 5*time.Minute)
+		if err != nil {
+			t.Fatalf("NewFailurePolicy(%q) error = %v", mode, err)
+		}
+		policy.now = func() time.Time { return now }
+		policy.started = now
+		return policy
+	}
+
+	open := newPolicy("open")
+	closed := newPolicy("closed")
+	closedForHosts := newPolicy("closed_for_hosts", "Admin.Example.com")
+
+	// never synced, but not stale yet
+	if closed.Engaged("example.com") {
+		t.Fatal("expected closed policy to wait for the staleness threshold")
+	}
+
+	now = now.Add(5 * time.Minute)
+	if open.Engaged("example.com") {
+		t.Fatal("expected open policy never to engage")
+	}
+	if !closed.Engaged("example.com") {
+		t.Fatal("expected closed policy to engage when never synced")
+	}
+	if !closedForHosts.Engaged("admin.example.com:443") || closedForHosts.Engaged("www.example.com") {
+		t.Fatal("expected closed_for_hosts policy to engage for listed hostnames only")
+	}
+
+	closed.RecordSync()
+	if closed.Engaged("example.com") || closed.Status().Engaged {
+		t.Fatal("expected closed policy to disengage after a sync")
+	}
+	now = now.Add(5 * time.Minute)
+	status := closed.Status()
+	if !closed.Engaged("example.com") || !status.Stale || !status.Engaged || status.LastSync == nil {
+		t.Fatalf("expected closed policy to engage once the stream is stale again, status %+v", status)
+	}
+}
+
+func TestFailurePolicyStatusSortsHostnames(t *testing.T) {
+	policy, err := NewFailurePolicy("closed_for_hosts", "block", []string{"www.example.com", "Admin.Example.com", "api.example.com"}, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFailurePolicy() error = %v", err)
+	}
+	want := []string{"admin.example.com", "api.example.com", "www.example.com"}
+	if got := policy.Status().Hostnames; !slices.Equal(got, want) {
+		t.Fatalf("Status().Hostnames = %v, want %v", got, want)
+	}
+}
+
+func TestFailurePolicyDecisionUsesFailureAction(t *testing.T) {
+	registry, err := NewRegistry("log", nil)
+	if err != nil {
+		t.Fatalf("NewRegistry() error = %v", err)
+	}
+	registry.Failure, err = NewFailurePolicy("closed", "challenge", nil, time.Minute)
+	if err != nil {
+		t.Fatalf("NewFailurePolicy() error = %v", err)
+	}
+
+	decision := registry.Failure.Decision("203.0.113.10")
+	if !IsFailureDecision(decision) {
+		t.Fatal("expected a failure decision")
+	}
+	// challenges fall back to block without a captcha provider
+	if got := registry.ActionFor(decision); got != ActionBlock {
+		t.Fatalf("ActionFor(failure decision) = %q, want %q", got, ActionBlock)
+	}
+	registry.Challenger = &captcha.Challenger{}
+	if got := registry.ActionFor(decision); got != ActionChallenge {
+		t.Fatalf("ActionFor(failure decision) = %q, want %q", got, ActionChallenge)
+	}
+}
+
+func TestNewFailurePolicyRejectsInvalidSettings(t *testing.T) {
+	tests := map[string]struct {
+		mode, action string
+		hostnames    []string
+	}{
+		"unknown mode":         {mode: "sometimes", action: "block"},
+		"hosts without a list": {mode: "closed_for_hosts", action: "block"},
+		"unknown action":       {mode: "closed", action: "explode"},
+		"unsupported action":   {mode: "closed", action: "tarpit"},
+	}
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewFailurePolicy(tc.mode, tc.action, tc.hostnames, time.Minute); err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bufio"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// CloudflareConnectingIPHeader is set by Cloudflare to the address of the
+// client that connected to it.
+const CloudflareConnectingIPHeader = "CF-Connecting-IP"
+
+//go:embed cloudflare_ips.txt
+var embeddedCloudflareRanges string
+
+var defaultCloudflareRanges = mustParseCIDRList(embeddedCloudflareRanges)
+
+// DefaultCloudflareRanges returns the Cloudflare IP ranges embedded in the
+// plugin.
+func DefaultCloudflareRanges() []netip.Prefix {
+	return append([]netip.Prefix(nil), defaultCloudflareRanges...)
+}
+
+// LoadCloudflareRanges reads Cloudflare's IP ranges from path, one CIDR range
+// per line, as published at https://www.cloudflare.com/ips-v4 and
+// https://www.cloudflare.com/ips-v6. If the file does not exist, the embedded
+// ranges are returned.
+func LoadCloudflareRanges(path string) ([]netip.Prefix, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return DefaultCloudflareRanges(), nil
+		}
+		return nil, fmt.Errorf("unable to open Cloudflare ranges: %w", err)
+	}
+	defer file.Close()
+
+	ranges, err := ParseCIDRList(file)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse Cloudflare ranges in %s: %w", path, err)
+	}
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("no Cloudflare ranges found in %s", path)
+	}
+	return ranges, nil
+}
+
+// ParseCIDRList parses one CIDR range per line. Blank lines and lines starting
+// with # are skipped.
+func ParseCIDRList(r io.Reader) ([]netip.Prefix, error) {
+	var ranges []netip.Prefix
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		ranges = append(ranges, prefix.Masked())
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return ranges, nil
+}
+
+func mustParseCIDRList(list string) []netip.Prefix {
+	ranges, err := ParseCIDRList(strings.NewReader(list))
+	if err != nil {
+		panic(fmt.Sprintf("invalid embedded CIDR list: %v", err))
+	}
+	return ranges
+}
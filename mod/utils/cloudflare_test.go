@@ -0,0 +1,189 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/sirupsen/logrus"
+)
+
+func TestGetRealIPCloudflare(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		isProxied  bool
+		expected   string
+	}{
+		{
+			name:       "Cloudflare peer sets CF-Connecting-IP",
+			remoteAddr: "104.16.0.1:443",
+			headers:    map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+			isProxied:  true,
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "Cloudflare IPv6 peer sets CF-Connecting-IP",
+			remoteAddr: "[2606:4700::1]:443",
+			headers:    map[string][]string{"CF-Connecting-IP": {"2001:db8::1"}},
+			isProxied:  true,
+			expected:   "2001:db8::1",
+		},
+		{
+			name:       "IPv4-mapped Cloudflare peer sets CF-Connecting-IP",
+			remoteAddr: "[::ffff:104.16.0.1]:443",
+			headers:    map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+			isProxied:  true,
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "Direct client cannot spoof CF-Connecting-IP",
+			remoteAddr: "198.51.100.7:5000",
+			headers:    map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+			isProxied:  true,
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "Trusted proxy cannot set CF-Connecting-IP",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+			isProxied:  true,
+			expected:   "10.0.0.2",
+		},
+		{
+			name:       "Cloudflare peer ignored when not proxied behind Cloudflare",
+			remoteAddr: "104.16.0.1:443",
+			headers:    map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+			isProxied:  false,
+			expected:   "104.16.0.1",
+		},
+		{
+			name:       "Cloudflare peer cannot pass on other headers",
+			remoteAddr: "104.16.0.1:443",
+			headers: map[string][]string{
+				"X-Real-IP":        {"192.0.2.1"},
+				"CF-Connecting-IP": {"203.0.113.10"},
+			},
+			isProxied: true,
+			expected:  "203.0.113.10",
+		},
+		{
+			name:       "Cloudflare peer without CF-Connecting-IP is the client",
+			remoteAddr: "104.16.0.1:443",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1"}},
+			isProxied:  true,
+			expected:   "104.16.0.1",
+		},
+		{
+			name:       "Cloudflare hop is skipped behind a trusted proxy",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"192.0.2.1, 203.0.113.10, 104.16.0.1"}},
+			isProxied:  true,
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "Cloudflare hop is the client when not proxied behind Cloudflare",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.10, 104.16.0.1"}},
+			isProxied:  false,
+			expected:   "104.16.0.1",
+		},
+	}
+
+	logger := logrus.StandardLogger()
+	logger.SetLevel(LOG_LEVEL)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsfr := &plugin.DynamicSniffForwardRequest{
+				RemoteAddr: tt.remoteAddr,
+				Header:     tt.headers,
+			}
+			config := RealIPConfig{IsProxiedBehindCloudflare: tt.isProxied, TrustedProxies: privateProxies}
+			result, err := GetRealIP(logger, dsfr, config)
+			if err != nil {
+				t.Fatalf("GetRealIP() error = %v", err)
+			}
+			if result.String() != tt.expected {
+				t.Errorf("GetRealIP() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetRealIPCustomCloudflareRanges(t *testing.T) {
+	logger := logrus.StandardLogger()
+	logger.SetLevel(LOG_LEVEL)
+	config := RealIPConfig{
+		IsProxiedBehindCloudflare: true,
+		CloudflareRanges:          mustPrefixes("198.51.100.0/24"),
+	}
+
+	for remoteAddr, expected := range map[string]string{
+		"198.51.100.7:443": "203.0.113.10",
+		"104.16.0.1:443":   "104.16.0.1",
+	} {
+		dsfr := &plugin.DynamicSniffForwardRequest{
+			RemoteAddr: remoteAddr,
+			Header:     map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+		}
+		result, err := GetRealIP(logger, dsfr, config)
+		if err != nil {
+			t.Fatalf("GetRealIP() error = %v", err)
+		}
+		if result.String() != expected {
+			t.Errorf("GetRealIP() from %s = %q, expected %q", remoteAddr, result, expected)
+		}
+	}
+}
+
+func TestLoadCloudflareRanges(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Missing file uses the embedded ranges", func(t *testing.T) {
+		ranges, err := LoadCloudflareRanges(filepath.Join(dir, "missing.txt"))
+		if err != nil {
+			t.Fatalf("LoadCloudflareRanges() error = %v", err)
+		}
+		if !reflect.DeepEqual(ranges, DefaultCloudflareRanges()) {
+			t.Errorf("LoadCloudflareRanges() = %v, expected the embedded ranges", ranges)
+		}
+		if len(ranges) == 0 {
+			t.Error("expected embedded Cloudflare ranges")
+		}
+	})
+
+	t.Run("File replaces the embedded ranges", func(t *testing.T) {
+		path := filepath.Join(dir, "ips.txt")
+		content := "# refreshed\n198.51.100.0/24\n\n2001:db8::1/32\n"
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		ranges, err := LoadCloudflareRanges(path)
+		if err != nil {
+			t.Fatalf("LoadCloudflareRanges() error = %v", err)
+		}
+		expected := mustPrefixes("198.51.100.0/24", "2001:db8::/32")
+		if !reflect.DeepEqual(ranges, expected) {
+			t.Errorf("LoadCloudflareRanges() = %v, expected %v", ranges, expected)
+		}
+	})
+
+	for name, content := range map[string]string{
+		"Invalid range is rejected": "198.51.100.0/24\nnot-a-range\n",
+		"Empty file is rejected":    "# nothing here\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(name, " ", "_")+".txt")
+			if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if ranges, err := LoadCloudflareRanges(path); err == nil {
+				t.Errorf("LoadCloudflareRanges() = %v, expected an error", ranges)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ForwardedHeader is the standard header defined by RFC 7239.
+const ForwardedHeader = "Forwarded"
+
+// ForwardedElement is one hop of a `Forwarded` header, as added by one proxy.
+// Values are unquoted, but otherwise kept as sent: For and By are node names
+// such as `192.0.2.60`, `[2001:db8::1]:443`, `unknown` or an obfuscated
+// identifier like `_hidden`.
+type ForwardedElement struct {
+	For   string
+	By    string
+	Host  string
+	Proto string
+}
+
+// ParseForwarded parses the values of one or more `Forwarded` headers into
+// their elements, from the first hop to the last. Unknown parameters are
+// ignored, and empty list elements are skipped.
+func ParseForwarded(values []string) ([]ForwardedElement, error) {
+	var elements []ForwardedElement
+	for _, value := range values {
+		parsed, err := parseForwardedValue(value)
+		if err != nil {
+			return nil, err
+		}
+		elements = append(elements, parsed...)
+	}
+	return elements, nil
+}
+
+func parseForwardedValue(value string) ([]ForwardedElement, error) {
+	var elements []ForwardedElement
+	var element ForwardedElement
+	seen := map[string]bool{}
+	empty := true
+
+	pos := 0
+	for {
+		pos = skipSpace(value, pos)
+		if pos >= len(value) {
+			break
+		}
+		switch value[pos] {
+		case ',':
+			if !empty {
+				elements = append(elements, element)
+			}
+			element, seen, empty = ForwardedElement{}, map[string]bool{}, true
+			pos++
+			continue
+		case ';':
+			pos++
+			continue
+		}
+
+		// forwarded-pair = token "=" value
+		start := pos
+		for pos < len(value) && isTokenChar(value[pos]) {
+			pos++
+		}
+		if pos == start {
+			return nil, fmt.Errorf("invalid character %q at offset %d in Forwarded header", value[pos], pos)
+		}
+		name := strings.ToLower(value[start:pos])
+		if pos >= len(value) || value[pos] != '=' {
+			return nil, fmt.Errorf("missing value for parameter %q in Forwarded header", name)
+		}
+		pos++
+
+		var parameter string
+		var err error
+		parameter, pos, err = parseForwardedParameter(value, pos)
+		if err != nil {
+			return nil, err
+		}
+
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate parameter %q in Forwarded header element", name)
+		}
+		seen[name] = true
+		empty = false
+		switch name {
+		case "for":
+			element.For = parameter
+		case "by":
+			element.By = parameter
+		case "host":
+			element.Host = parameter
+		case "proto":
+			element.Proto = parameter
+		}
+
+		pos = skipSpace(value, pos)
+		if pos < len(value) && value[pos] != ';' && value[pos] != ',' {
+			return nil, fmt.Errorf("unexpected character %q at offset %d in Forwarded header", value[pos], pos)
+		}
+	}
+	if !empty {
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// parseForwardedParameter parses a token or quoted-string value starting at
+// pos, and returns it with the offset following it.
+func parseForwardedParameter(value string, pos int) (string, int, error) {
+	if pos < len(value) && value[pos] == '"' {
+		var unquoted strings.Builder
+		for pos++; pos < len(value); pos++ {
+			switch c := value[pos]; c {
+			case '"':
+				return unquoted.String(), pos + 1, nil
+			case '\\':
+				pos++
+				if pos >= len(value) {
+					return "", pos, fmt.Errorf("unterminated quoted string in Forwarded header")
+				}
+				unquoted.WriteByte(value[pos])
+			default:
+				unquoted.WriteByte(c)
+			}
+		}
+		return "", pos, fmt.Errorf("unterminated quoted string in Forwarded header")
+	}
+
+	start := pos
+	for pos < len(value) && isTokenChar(value[pos]) {
+		pos++
+	}
+	if pos == start {
+		return "", pos, fmt.Errorf("empty parameter value at offset %d in Forwarded header", pos)
+	}
+	return value[start:pos], pos, nil
+}
+
+// forwardedFor returns the `for` node of every element of a `Forwarded`
+// header value, converted with forwardedNodeAddr. Elements without a `for`
+// parameter are reported as `unknown`.
+func forwardedFor(value string) ([]string, error) {
+	elements, err := ParseForwarded([]string{value})
+	if err != nil {
+		return nil, err
+	}
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("empty Forwarded header")
+	}
+
+	nodes := make([]string, 0, len(elements))
+	for _, element := range elements {
+		if element.For == "" {
+			nodes = append(nodes, "unknown")
+			continue
+		}
+		nodes = append(nodes, forwardedNodeAddr(element.For))
+	}
+	return nodes, nil
+}
+
+// forwardedNodeAddr turns a `for` or `by` node name into an address that
+// parseIP understands. Bracketed IPv6 addresses without a port lose their
+// brackets; `unknown` and obfuscated identifiers are returned unchanged, and
+// fail to parse.
+func forwardedNodeAddr(node string) string {
+	if strings.HasPrefix(node, "[") && strings.HasSuffix(node, "]") {
+		return node[1 : len(node)-1]
+	}
+	return node
+}
+
+func skipSpace(value string, pos int) int {
+	for pos < len(value) && (value[pos] == ' ' || value[pos] == '\t') {
+		pos++
+	}
+	return pos
+}
+
+// isTokenChar reports whether c is a tchar, as defined by RFC 7230.
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) >= 0
+}
@@ -0,0 +1,199 @@
+package utils
+
+import (
+	"reflect"
+	"testing"
+
+	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/sirupsen/logrus"
+)
+
+func TestParseForwarded(t *testing.T) {
+	tests := []struct {
+		name     string
+		values   []string
+		expected []ForwardedElement
+	}{
+		{
+			name:     "Single hop",
+			values:   []string{"for=192.0.2.60;proto=http;by=203.0.113.43"},
+			expected: []ForwardedElement{{For: "192.0.2.60", Proto: "http", By: "203.0.113.43"}},
+		},
+		{
+			name:     "Quoted IPv6 with port",
+			values:   []string{`For="[2001:db8:cafe::17]:4711"`},
+			expected: []ForwardedElement{{For: "[2001:db8:cafe::17]:4711"}},
+		},
+		{
+			name:     "Multiple hops",
+			values:   []string{"for=192.0.2.43, for=198.51.100.17;by=203.0.113.60;proto=https;host=example.com"},
+			expected: []ForwardedElement{{For: "192.0.2.43"}, {For: "198.51.100.17", By: "203.0.113.60", Proto: "https", Host: "example.com"}},
+		},
+		{
+			name:     "Multiple headers",
+			values:   []string{"for=192.0.2.43", `for="[2001:db8::1]"`},
+			expected: []ForwardedElement{{For: "192.0.2.43"}, {For: "[2001:db8::1]"}},
+		},
+		{
+			name:     "Obfuscated and unknown nodes",
+			values:   []string{`for=_hidden, for=unknown, for="_SEVKISEK:_abc"`},
+			expected: []ForwardedElement{{For: "_hidden"}, {For: "unknown"}, {For: "_SEVKISEK:_abc"}},
+		},
+		{
+			name:     "Whitespace, empty elements and unknown parameters",
+			values:   []string{" , for=192.0.2.43 ; secret=abc ,, "},
+			expected: []ForwardedElement{{For: "192.0.2.43"}},
+		},
+		{
+			name:     "Quoted comma and escape",
+			values:   []string{`host="a,b\"c";for=192.0.2.43`},
+			expected: []ForwardedElement{{Host: `a,b"c`, For: "192.0.2.43"}},
+		},
+		{
+			name:     "Empty header",
+			values:   []string{""},
+			expected: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elements, err := ParseForwarded(tt.values)
+			if err != nil {
+				t.Fatalf("ParseForwarded() error = %v", err)
+			}
+			if !reflect.DeepEqual(elements, tt.expected) {
+				t.Errorf("ParseForwarded() = %+v, expected %+v", elements, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseForwardedRejectsMalformedInput(t *testing.T) {
+	for _, value := range []string{
+		"for",
+		"for=",
+		"=192.0.2.43",
+		`for="[2001:db8::1]`,
+		`for="\`,
+		"for=192.0.2.43;for=192.0.2.44",
+		"for=[2001:db8::1]",
+		"for=192.0.2.43 proto=http",
+		"for=@",
+	} {
+		if elements, err := ParseForwarded([]string{value}); err == nil {
+			t.Errorf("ParseForwarded(%q) = %+v, expected an error", value, elements)
+		}
+	}
+}
+
+func TestGetRealIPForwarded(t *testing.T) {
+	tests := []struct {
+		name     string
+		value    string
+		pick     IPPick
+		expected string
+	}{
+		{
+			name:     "Quoted IPv6 with port",
+			value:    `for="[2001:db8::1]:443"`,
+			expected: "2001:db8::1",
+		},
+		{
+			name:     "Quoted IPv6 without port",
+			value:    `for="[2001:db8::1]"`,
+			expected: "2001:db8::1",
+		},
+		{
+			name:     "Trusted hops are skipped",
+			value:    "for=203.0.113.10, for=198.51.100.7, for=10.0.0.3",
+			expected: "198.51.100.7",
+		},
+		{
+			name:     "Leftmost hop",
+			value:    "for=203.0.113.10, for=198.51.100.7",
+			pick:     PickLeftmost,
+			expected: "203.0.113.10",
+		},
+		{
+			name:     "Obfuscated hop stops the walk",
+			value:    "for=203.0.113.10, for=_hidden, for=10.0.0.3",
+			expected: "10.0.0.3",
+		},
+		{
+			name:     "Unknown client falls back to the peer",
+			value:    "for=unknown",
+			expected: "10.0.0.2",
+		},
+		{
+			name:     "Malformed header falls back to the peer",
+			value:    `for="[2001:db8::1]`,
+			expected: "10.0.0.2",
+		},
+	}
+
+	logger := logrus.StandardLogger()
+	logger.SetLevel(LOG_LEVEL)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsfr := &plugin.DynamicSniffForwardRequest{
+				RemoteAddr: "10.0.0.2:5000",
+				Header:     map[string][]string{"Forwarded": {tt.value}},
+			}
+			config := RealIPConfig{
+				TrustedProxies: privateProxies,
+				Headers:        []IPHeader{{Name: ForwardedHeader, Pick: tt.pick}},
+			}
+			result, err := GetRealIP(logger, dsfr, config)
+			if err != nil {
+				t.Fatalf("GetRealIP() error = %v", err)
+			}
+			if result.String() != tt.expected {
+				t.Errorf("GetRealIP() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func FuzzParseForwarded(f *testing.F) {
+	for _, seed := range []string{
+		"for=192.0.2.60;proto=http;by=203.0.113.43",
+		`For="[2001:db8:cafe::17]:4711"`,
+		"for=192.0.2.43, for=198.51.100.17",
+		`for=_hidden, for=unknown, for="_SEVKISEK:_abc"`,
+		`host="a,b\"c";for=192.0.2.43`,
+		`for="[2001:db8::1]`,
+		" , ;; ,",
+		`for="\`,
+	} {
+		f.Add(seed)
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.PanicLevel)
+	config := RealIPConfig{
+		TrustedProxies: privateProxies,
+		Headers:        []IPHeader{{Name: ForwardedHeader}, {Name: ForwardedHeader, Pick: PickLeftmost}, {Name: ForwardedHeader, Pick: PickRightmost}},
+	}
+
+	f.Fuzz(func(t *testing.T, value string) {
+		elements, err := ParseForwarded([]string{value})
+		if err != nil && elements != nil {
+			t.Fatalf("ParseForwarded(%q) returned elements with an error", value)
+		}
+
+		// the resolved IP is always a valid, normalized address, whatever the
+		// header holds
+		dsfr := &plugin.DynamicSniffForwardRequest{
+			RemoteAddr: "10.0.0.2:5000",
+			Header:     map[string][]string{"Forwarded": {value}},
+		}
+		ip, err := GetRealIP(logger, dsfr, config)
+		if err != nil {
+			t.Fatalf("GetRealIP() error = %v", err)
+		}
+		if !ip.IsValid() || ip != NormalizeIP(ip) {
+			t.Fatalf("GetRealIP() returned an invalid address %q", ip)
+		}
+	})
+}
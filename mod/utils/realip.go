@@ -3,83 +3,284 @@ package utils
 import (
 	"fmt"
 	"net"
+	"net/http"
+	"net/netip"
 	"strings"
 
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
 	"github.com/sirupsen/logrus"
 )
 
-// GetRealIP extracts the real IP address from the request headers.
-// It checks for the `X-Real-IP`, `CF-Connecting-IP`, and `X-Forwarded-For` headers
+// IPPick selects which address of a header holding a list of addresses,
+// such as `X-Forwarded-For`, is the client.
+type IPPick string
+
+const (
+	// PickRightmostUntrusted walks the list from the right, skipping trusted
+	// proxies, and picks the first address that is not one.
+	PickRightmostUntrusted IPPick = "rightmost_untrusted"
+	// PickLeftmost picks the first address. It can be spoofed by the client
+	// unless every proxy in front of Zoraxy overwrites the header.
+	PickLeftmost IPPick = "leftmost"
+	// PickRightmost picks the last address, which was added by the nearest
+	// proxy.
+	PickRightmost IPPick = "rightmost"
+)
+
+// ParseIPPick parses the name of an IPPick, ignoring case. An empty name
+// selects PickRightmostUntrusted.
+func ParseIPPick(name string) (IPPick, error) {
+	pick := IPPick(strings.ToLower(strings.TrimSpace(name)))
+	switch pick {
+	case "":
+		return PickRightmostUntrusted, nil
+	case PickRightmostUntrusted, PickLeftmost, PickRightmost:
+		return pick, nil
+	}
+	return "", fmt.Errorf("unknown address pick %q (available: %s, %s, %s)", name, PickRightmostUntrusted, PickLeftmost, PickRightmost)
+}
+
+// IPHeader is a request header that carries the client IP.
+type IPHeader struct {
+	Name string
+	Pick IPPick
+}
+
+// DefaultIPHeaders are the headers checked when none are configured.
+var DefaultIPHeaders = []IPHeader{
+	{Name: "X-Real-IP", Pick: PickRightmostUntrusted},
+	{Name: CloudflareConnectingIPHeader, Pick: PickRightmostUntrusted},
+	{Name: "X-Forwarded-For", Pick: PickRightmostUntrusted},
+}
+
+// RealIPConfig controls which forwarding headers GetRealIP honors.
+type RealIPConfig struct {
+	// IsProxiedBehindCloudflare enables the `CF-Connecting-IP` header. It is
+	// only honored when the peer belongs to CloudflareRanges.
+	IsProxiedBehindCloudflare bool
+	// CloudflareRanges are Cloudflare's IP ranges. If nil, the ranges embedded
+	// in the plugin are used.
+	CloudflareRanges []netip.Prefix
+	// TrustedProxies are the peers allowed to set forwarding headers. Headers
+	// sent by any other peer are ignored.
+	TrustedProxies []netip.Prefix
+	// Headers are checked in order, and the first one holding a valid address
+	// wins. If nil, DefaultIPHeaders are used.
+	Headers []IPHeader
+}
+
+// IsTrustedProxy reports whether ip belongs to one of the trusted proxies.
+func (c RealIPConfig) IsTrustedProxy(ip netip.Addr) bool {
+	ip = NormalizeIP(ip)
+	for _, prefix := range c.TrustedProxies {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCloudflare reports whether ip belongs to Cloudflare's IP ranges.
+func (c RealIPConfig) IsCloudflare(ip netip.Addr) bool {
+	ranges := c.CloudflareRanges
+	if ranges == nil {
+		ranges = defaultCloudflareRanges
+	}
+	ip = NormalizeIP(ip)
+	for _, prefix := range ranges {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForwardedProtoHeader carries the scheme the client used to reach the
+// proxy in front of Zoraxy.
+const ForwardedProtoHeader = "X-Forwarded-Proto"
+
+// IsHTTPS reports whether the client reached Zoraxy over HTTPS: either the
+// request itself came over TLS, or a trusted proxy says so in the
+// `X-Forwarded-Proto` header. When the header lists several schemes, the
+// first one, set by the proxy nearest to the client, is used.
+func IsHTTPS(r *http.Request, config RealIPConfig) bool {
+	if r.TLS != nil {
+		return true
+	}
+	proto := r.Header.Get(ForwardedProtoHeader)
+	if proto == "" {
+		return false
+	}
+	peer, err := parseIP(r.RemoteAddr)
+	if err != nil || !config.IsTrustedProxy(peer) {
+		return false
+	}
+	proto, _, _ = strings.Cut(proto, ",")
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// GetRealIP extracts the real IP address of the client that sent a request.
+//
+// Forwarding headers are only honored when the immediate peer (RemoteAddr) is
+// a trusted proxy, since any client can set them. In that case the configured
+// headers are checked in order, by default `X-Real-IP`, `CF-Connecting-IP`
+// and `X-Forwarded-For`, and the first one holding a valid address wins. The
+// standard `Forwarded` header can be configured as well.
+// `CF-Connecting-IP` is the exception: it is only honored when Zoraxy is
+// proxied behind Cloudflare and the peer is one of Cloudflare's servers,
+// whether or not it is a trusted proxy.
+// Otherwise, or if no header is set, the peer is the client.
+//
+// The returned address is normalized with NormalizeIP, so it can be compared
+// with the decision cache as is.
 //
 // # Arguments:
 //   - dsfr: The DynamicSniffForwardRequest object containing the request headers and remote
-//   - isProxiedBehindCloudflare: If true, it will prioritize the `CF-Connecting-IP` header
-//   - debug: If true, it will print extra debug information to the console
-func GetRealIP(logger *logrus.Logger, dsfr *zoraxy_plugin.DynamicSniffForwardRequest, isProxiedBehindCloudflare bool) (string, error) {
-	// Get the real IP address from the request
-	realIP := ""
-
-	// Check for the `X-Real-IP`, `CF-Connecting-IP`, and `X-Forwarded-For` headers
-	if headers := dsfr.Header; headers != nil {
-		// Check for X-Real-IP header, we don't really expect to see this so we won't log an error if it is not found
-		X_Real_IP, err := ExtractHeader(headers, "X-Real-IP", false)
-		if err == nil && X_Real_IP != "" {
-			// Use X-Real-IP header
-			realIP = X_Real_IP
-			goto IPFound
+//   - config: Which peers are trusted, and which headers to check
+func GetRealIP(logger *logrus.Logger, dsfr *zoraxy_plugin.DynamicSniffForwardRequest, config RealIPConfig) (netip.Addr, error) {
+	peer, err := parseIP(dsfr.RemoteAddr)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("no valid IP address found in RemoteAddr: %w", err)
+	}
+
+	headers := config.Headers
+	if headers == nil {
+		headers = DefaultIPHeaders
+	}
+
+	trusted := config.IsTrustedProxy(peer)
+	fromCloudflare := config.IsProxiedBehindCloudflare && config.IsCloudflare(peer)
+	if !trusted && !fromCloudflare {
+		if dsfr.Header != nil && hasForwardingHeaders(dsfr.Header, headers) {
+			logger.Debugf("GetRealIP ignoring forwarding headers from untrusted peer %s for request with UUID %s", peer, dsfr.GetRequestUUID())
 		}
+		return peer, nil
+	}
+
+	if dsfr.Header != nil {
+		for _, header := range headers {
+			// CF-Connecting-IP can only be trusted from Cloudflare, and
+			// Cloudflare passes every other header on from the client
+			isCloudflareHeader := strings.EqualFold(header.Name, CloudflareConnectingIPHeader)
+			if isCloudflareHeader && !fromCloudflare || !isCloudflareHeader && !trusted {
+				continue
+			}
+
+			value, err := ExtractHeader(dsfr.Header, header.Name, true)
+			if err != nil || value == "" {
+				if isCloudflareHeader {
+					logger.Debugf("GetRealIP failed to extract CF-Connecting-IP for request with UUID %s: %v", dsfr.GetRequestUUID(), err)
+				}
+				continue
+			}
 
-		// Check for CF-Connecting-IP header
-		CF_Connecting_IP, err := ExtractHeader(headers, "CF-Connecting-IP", isProxiedBehindCloudflare)
-		if err != nil && isProxiedBehindCloudflare {
-			logger.Debugf("GetRealIP failed to extract CF-Connecting-IP for request with UUID %s: %v", dsfr.GetRequestUUID(), err)
-		} else if CF_Connecting_IP == "" {
-			logger.Debugf("GetRealIP got an empty string for CF-Connecting-IP for request with UUID %s", dsfr.GetRequestUUID())
-		} else if CF_Connecting_IP != "" {
-			// Use CF Connecting IP
-			realIP = CF_Connecting_IP
-			goto IPFound
+			entries := strings.Split(value, ",")
+			if strings.EqualFold(header.Name, ForwardedHeader) {
+				entries, err = forwardedFor(value)
+				if err != nil {
+					logger.Debugf("GetRealIP failed to parse Forwarded for request with UUID %s: %v", dsfr.GetRequestUUID(), err)
+					continue
+				}
+			}
+
+			ip, err := pickIP(config, peer, entries, header.Pick)
+			if err != nil {
+				logger.Debugf("GetRealIP got an invalid %s %q for request with UUID %s", header.Name, value, dsfr.GetRequestUUID())
+				continue
+			}
+			return ip, nil
 		}
+	}
+
+	// If no headers are found, the trusted proxy is the client
+	logger.Debugf("GetRealIP using RemoteAddr for request with UUID %s: %s", dsfr.GetRequestUUID(), dsfr.RemoteAddr)
+	return peer, nil
+}
+
+// pickIP selects the client address from the entries of a header. For the
+// `Forwarded` header, the entries are the `for` nodes of its elements.
+func pickIP(config RealIPConfig, peer netip.Addr, entries []string, pick IPPick) (netip.Addr, error) {
+	switch pick {
+	case PickLeftmost:
+		return parseIP(entries[0])
+	case PickRightmost:
+		return parseIP(entries[len(entries)-1])
+	default:
+		return walkForwardedFor(config, peer, entries)
+	}
+}
 
-		// Check for X-Forwarded-For header
-		// We take the first IP in the list, as it is the original client IP
-		X_Forwarded_For, err := ExtractHeader(headers, "X-Forwarded-For", true)
+// walkForwardedFor returns the first untrusted hop of an `X-Forwarded-For`
+// list, starting from the right, which is the hop closest to us. Each hop
+// can only vouch for the hop to its left if it is trusted, so the walk stops
+// at the first untrusted or malformed entry. When proxied behind Cloudflare,
+// Cloudflare's servers are trusted hops too, since they append the address
+// that connected to them. If every hop is trusted, the leftmost one is
+// returned. An error is returned only if the rightmost entry is malformed.
+func walkForwardedFor(config RealIPConfig, peer netip.Addr, hops []string) (netip.Addr, error) {
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip, err := parseIP(hops[i])
 		if err != nil {
-			logger.Debugf("GetRealIP failed to extract X-Forwarded-For for request with UUID %s: %v", dsfr.GetRequestUUID(), err)
-		} else if X_Forwarded_For == "" {
-			logger.Debugf("GetRealIP got an empty string for X-Forwarded-For for request with UUID %s", dsfr.GetRequestUUID())
-		} else if X_Forwarded_For != "" {
-			// Use X-Forwarded-For header
-			// We take the first IP in the list, as it is the original client IP
-			ips := strings.Split(X_Forwarded_For, ",")
-			if len(ips) > 0 {
-				realIP = strings.TrimSpace(ips[0])
+			if i == len(hops)-1 {
+				return netip.Addr{}, err
 			}
-			goto IPFound
+			// the chain is broken, so nothing to the left can be trusted
+			return client, nil
+		}
+		client = ip
+		if !config.IsTrustedProxy(ip) && !(config.IsProxiedBehindCloudflare && config.IsCloudflare(ip)) {
+			return client, nil
 		}
 	}
-	// If no headers are found, we will use the RemoteAddr, if it is not empty
-	if dsfr.RemoteAddr != "" {
-		logger.Debugf("GetRealIP using RemoteAddr for request with UUID %s: %s", dsfr.GetRequestUUID(), dsfr.RemoteAddr)
-		realIP = dsfr.RemoteAddr
-	} else {
-		return "", fmt.Errorf("no valid IP address found in headers")
+	return client, nil
+}
+
+// hasForwardingHeaders reports whether any of the given headers is set.
+func hasForwardingHeaders(headers map[string][]string, ipHeaders []IPHeader) bool {
+	for _, header := range ipHeaders {
+		if value, err := ExtractHeader(headers, header.Name, true); err == nil && value != "" {
+			return true
+		}
 	}
-IPFound:
-	realIP = strings.TrimSpace(realIP)
+	return false
+}
+
+// NormalizeIP returns the canonical form of ip: IPv4-mapped IPv6 addresses
+// such as ::ffff:192.0.2.1 become plain IPv4 addresses, and IPv6 zones such as
+// %eth0 are dropped. A client reaching Zoraxy over a dual-stack socket is then
+// matched against decisions for its IPv4 address.
+func NormalizeIP(ip netip.Addr) netip.Addr {
+	return ip.Unmap().WithZone("")
+}
+
+// NormalizePrefix returns the canonical form of prefix, consistent with
+// NormalizeIP: a range of IPv4-mapped IPv6 addresses such as
+// ::ffff:192.0.2.0/120 becomes the IPv4 range 192.0.2.0/24. The result is
+// masked.
+func NormalizePrefix(prefix netip.Prefix) netip.Prefix {
+	addr := prefix.Addr()
+	if addr.Is4In6() && prefix.Bits() >= 96 {
+		return netip.PrefixFrom(addr.Unmap(), prefix.Bits()-96).Masked()
+	}
+	return prefix.Masked()
+}
+
+// parseIP parses an IP address that may carry a port, as in "1.2.3.4:80" or
+// "[2001:db8::1]:443", and normalizes it with NormalizeIP.
+func parseIP(raw string) (netip.Addr, error) {
+	raw = strings.TrimSpace(raw)
 
 	// extract the IP address from what is potentially a host:port format
-	ip, _, err := net.SplitHostPort(realIP)
+	host, _, err := net.SplitHostPort(raw)
 	if err != nil {
 		// If SplitHostPort fails, it means there is no port, so we can use the whole string as the IP
-		ip = realIP
+		host = raw
 	}
 
-	// Validate the IP address
-	if net.ParseIP(ip) == nil {
-		return "", fmt.Errorf("invalid IP address: %s", ip)
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid IP address: %s", host)
 	}
-
-	return ip, nil
+	return NormalizeIP(ip), nil
 }
@@ -60,3 +60,23 @@ func StartSignalHandler(logger *logrus.Logger, g *errgroup.Group, ctx context.Co
 		return nil
 	})
 }
+
+// StartReloadHandler calls reload every time the process receives SIGHUP,
+// until ctx is done.
+func StartReloadHandler(logger *logrus.Logger, g *errgroup.Group, ctx context.Context, reload func()) {
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGHUP)
+
+	g.Go(func() error {
+		defer signal.Stop(signalChan)
+		for {
+			select {
+			case <-signalChan:
+				logger.Info("Received SIGHUP, reloading configuration")
+				reload()
+			case <-ctx.Done():
+				return nil
+			}
+		}
+	})
+}
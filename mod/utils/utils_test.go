@@ -1,7 +1,11 @@
 package utils
 
 import (
+	"crypto/tls"
 	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
 	"testing"
 
 	plugin "github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
@@ -10,6 +14,17 @@ import (
 
 const LOG_LEVEL = logrus.WarnLevel
 
+// privateProxies trusts loopback and private ranges, like the default config.
+var privateProxies = mustPrefixes("127.0.0.0/8", "::1/128", "10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "fc00::/7")
+
+func mustPrefixes(raw ...string) []netip.Prefix {
+	prefixes := make([]netip.Prefix, 0, len(raw))
+	for _, r := range raw {
+		prefixes = append(prefixes, netip.MustParsePrefix(r))
+	}
+	return prefixes
+}
+
 func TestGetRealIP(t *testing.T) {
 	tests := []struct {
 		name       string
@@ -59,7 +74,7 @@ func TestGetRealIP(t *testing.T) {
 		},
 		{
 			name:       "CF-Connecting-IP when X-Real-IP is empty",
-			remoteAddr: "192.168.1.100:8080",
+			remoteAddr: "173.245.48.10:8080",
 			headers: map[string][]string{
 				"X-Real-IP":        {""},
 				"CF-Connecting-IP": {"203.0.113.10"},
@@ -69,7 +84,7 @@ func TestGetRealIP(t *testing.T) {
 		},
 		{
 			name:       "CF-Connecting-IP when X-Real-IP is nil",
-			remoteAddr: "192.168.1.100:8080",
+			remoteAddr: "173.245.48.10:8080",
 			headers: map[string][]string{
 				"X-Real-IP":        nil,
 				"CF-Connecting-IP": {"203.0.113.10"},
@@ -79,7 +94,7 @@ func TestGetRealIP(t *testing.T) {
 		},
 		{
 			name:       "CF-Connecting-IP with port",
-			remoteAddr: "192.168.1.100:8080",
+			remoteAddr: "173.245.48.10:8080",
 			headers: map[string][]string{
 				"CF-Connecting-IP": {"203.0.113.10:443"},
 			},
@@ -88,7 +103,7 @@ func TestGetRealIP(t *testing.T) {
 		},
 		{
 			name:       "CF-Connecting-IP with port, different casing",
-			remoteAddr: "192.168.1.100:8080",
+			remoteAddr: "173.245.48.10:8080",
 			headers: map[string][]string{
 				"cf-connecting-ip": {"203.0.113.10:443"},
 			},
@@ -107,7 +122,7 @@ func TestGetRealIP(t *testing.T) {
 		},
 		{
 			name:       "CF-Connecting-IP takes precedence over X-Forwarded-For",
-			remoteAddr: "192.168.1.100:8080",
+			remoteAddr: "173.245.48.10:8080",
 			headers: map[string][]string{
 				"CF-Connecting-IP": {"203.0.113.10"},
 				"X-Forwarded-For":  {"1.2.3.4"},
@@ -142,25 +157,25 @@ func TestGetRealIP(t *testing.T) {
 		},
 		{
 			name:       "X-Forwarded-For with multiple IPs",
-			remoteAddr: "",
+			remoteAddr: "192.168.1.100:8080",
 			headers: map[string][]string{
 				"X-Forwarded-For": {"1.2.3.4", "5.6.7.8"},
 			},
 			isProxied: false,
-			expected:  "1.2.3.4",
+			expected:  "5.6.7.8",
 		},
 		{
 			name:       "X-Forwarded-For with multiple IPs one string",
-			remoteAddr: "",
+			remoteAddr: "192.168.1.100:8080",
 			headers: map[string][]string{
 				"X-Forwarded-For": {"1.2.3.4, 5.6.7.8"},
 			},
 			isProxied: false,
-			expected:  "1.2.3.4",
+			expected:  "5.6.7.8",
 		},
 		{
 			name:       "X-Forwarded-For with single IP",
-			remoteAddr: "",
+			remoteAddr: "192.168.1.100:8080",
 			headers: map[string][]string{
 				"X-Forwarded-For": {"1.2.3.4"},
 			},
@@ -183,13 +198,13 @@ func TestGetRealIP(t *testing.T) {
 			logger.SetLevel(LOG_LEVEL)
 
 			// Call the function
-			result, err := GetRealIP(logger, dsfr, tt.isProxied)
+			result, err := GetRealIP(logger, dsfr, RealIPConfig{IsProxiedBehindCloudflare: tt.isProxied, TrustedProxies: privateProxies})
 			if err != nil {
 				t.Errorf("GetRealIP() error = %v", err)
 			}
 
 			// Check the result
-			if result != tt.expected {
+			if result.String() != tt.expected {
 				t.Errorf("GetRealIP() = %q, expected %q", result, tt.expected)
 			}
 		})
@@ -209,7 +224,7 @@ func BenchmarkGetRealIP(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		GetRealIP(logger, dsfr, false)
+		GetRealIP(logger, dsfr, RealIPConfig{TrustedProxies: privateProxies})
 	}
 }
 
@@ -230,12 +245,335 @@ func TestGetRealIPEdgeCases(t *testing.T) {
 		logger := logrus.StandardLogger()
 		logger.SetLevel(LOG_LEVEL)
 
-		result, err := GetRealIP(logger, dsfr, false)
+		result, err := GetRealIP(logger, dsfr, RealIPConfig{TrustedProxies: privateProxies})
 		if err != nil {
 			t.Errorf("GetRealIP returned an error: %v", err)
 		}
-		if result != "192.168.1.100" {
+		if result.String() != "192.168.1.100" {
 			t.Errorf("Expected fallback to RemoteAddr, got %q", result)
 		}
 	})
 }
+
+func TestGetRealIPTrustedProxies(t *testing.T) {
+	tests := []struct {
+		name           string
+		remoteAddr     string
+		headers        map[string][]string
+		trustedProxies []netip.Prefix
+		expected       string
+	}{
+		{
+			name:           "Untrusted peer cannot spoof X-Real-IP",
+			remoteAddr:     "198.51.100.7:5000",
+			headers:        map[string][]string{"X-Real-IP": {"203.0.113.10"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "Untrusted peer cannot spoof CF-Connecting-IP",
+			remoteAddr:     "198.51.100.7:5000",
+			headers:        map[string][]string{"CF-Connecting-IP": {"203.0.113.10"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "Untrusted peer cannot spoof X-Forwarded-For",
+			remoteAddr:     "198.51.100.7:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "No trusted proxies ignores every header",
+			remoteAddr:     "127.0.0.1:5000",
+			headers:        map[string][]string{"X-Real-IP": {"203.0.113.10"}},
+			trustedProxies: nil,
+			expected:       "127.0.0.1",
+		},
+		{
+			name:           "Spoofed leftmost X-Forwarded-For entry is ignored",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10, 198.51.100.7"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "Trusted hops are skipped from the right",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10, 198.51.100.7, 10.0.0.3, 192.168.1.1"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "Spoofed private address left of the client is ignored",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"10.0.0.99, 198.51.100.7"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "Every hop trusted returns the leftmost",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"192.168.1.50, 10.0.0.3"}},
+			trustedProxies: privateProxies,
+			expected:       "192.168.1.50",
+		},
+		{
+			name:           "Malformed hop stops the walk",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10, not-an-ip, 10.0.0.3"}},
+			trustedProxies: privateProxies,
+			expected:       "10.0.0.3",
+		},
+		{
+			name:           "Multiple X-Forwarded-For headers are one list",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10", "198.51.100.7", "10.0.0.3"}},
+			trustedProxies: privateProxies,
+			expected:       "198.51.100.7",
+		},
+		{
+			name:           "Single trusted proxy address",
+			remoteAddr:     "198.51.100.1:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10"}},
+			trustedProxies: mustPrefixes("198.51.100.1/32"),
+			expected:       "203.0.113.10",
+		},
+		{
+			name:           "IPv4-mapped trusted peer",
+			remoteAddr:     "[::ffff:10.0.0.2]:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"203.0.113.10"}},
+			trustedProxies: privateProxies,
+			expected:       "203.0.113.10",
+		},
+		{
+			name:           "IPv6 hops",
+			remoteAddr:     "[fd00::2]:5000",
+			headers:        map[string][]string{"X-Forwarded-For": {"2001:db8::66, 2001:db8::1, fd00::3"}},
+			trustedProxies: privateProxies,
+			expected:       "2001:db8::1",
+		},
+		{
+			name:           "Invalid X-Real-IP falls through to X-Forwarded-For",
+			remoteAddr:     "10.0.0.2:5000",
+			headers:        map[string][]string{"X-Real-IP": {"garbage"}, "X-Forwarded-For": {"203.0.113.10"}},
+			trustedProxies: privateProxies,
+			expected:       "203.0.113.10",
+		},
+	}
+
+	logger := logrus.StandardLogger()
+	logger.SetLevel(LOG_LEVEL)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: tt.remoteAddr, Header: tt.headers}
+			result, err := GetRealIP(logger, dsfr, RealIPConfig{TrustedProxies: tt.trustedProxies})
+			if err != nil {
+				t.Fatalf("GetRealIP() error = %v", err)
+			}
+			if result.String() != tt.expected {
+				t.Errorf("GetRealIP() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestGetRealIPRejectsMissingRemoteAddr(t *testing.T) {
+	dsfr := &plugin.DynamicSniffForwardRequest{Header: map[string][]string{"X-Forwarded-For": {"203.0.113.10"}}}
+	if _, err := GetRealIP(logrus.StandardLogger(), dsfr, RealIPConfig{TrustedProxies: privateProxies}); err == nil {
+		t.Fatal("expected an error without RemoteAddr")
+	}
+}
+
+func TestGetRealIPHeaderOrder(t *testing.T) {
+	headers := map[string][]string{
+		"X-Real-Ip":        {"203.0.113.1"},
+		"True-Client-Ip":   {"203.0.113.2"},
+		"Fastly-Client-Ip": {"203.0.113.3"},
+		"X-Forwarded-For":  {"203.0.113.4, 198.51.100.7, 10.0.0.3"},
+	}
+	tests := []struct {
+		name     string
+		headers  []IPHeader
+		expected string
+	}{
+		{
+			name:     "Default order",
+			headers:  nil,
+			expected: "203.0.113.1",
+		},
+		{
+			name:     "Custom header first",
+			headers:  []IPHeader{{Name: "True-Client-IP"}, {Name: "X-Real-IP"}},
+			expected: "203.0.113.2",
+		},
+		{
+			name:     "Header names are case-insensitive",
+			headers:  []IPHeader{{Name: "fastly-client-ip"}},
+			expected: "203.0.113.3",
+		},
+		{
+			name:     "Missing header falls through",
+			headers:  []IPHeader{{Name: "Fly-Client-IP"}, {Name: "X-Client-IP"}, {Name: "X-Forwarded-For"}},
+			expected: "198.51.100.7",
+		},
+		{
+			name:     "Leftmost address",
+			headers:  []IPHeader{{Name: "X-Forwarded-For", Pick: PickLeftmost}},
+			expected: "203.0.113.4",
+		},
+		{
+			name:     "Rightmost address",
+			headers:  []IPHeader{{Name: "X-Forwarded-For", Pick: PickRightmost}},
+			expected: "10.0.0.3",
+		},
+		{
+			name:     "Rightmost untrusted address",
+			headers:  []IPHeader{{Name: "X-Forwarded-For", Pick: PickRightmostUntrusted}},
+			expected: "198.51.100.7",
+		},
+		{
+			name:     "No headers uses the peer",
+			headers:  []IPHeader{},
+			expected: "10.0.0.2",
+		},
+	}
+
+	logger := logrus.StandardLogger()
+	logger.SetLevel(LOG_LEVEL)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: "10.0.0.2:5000", Header: headers}
+			result, err := GetRealIP(logger, dsfr, RealIPConfig{TrustedProxies: privateProxies, Headers: tt.headers})
+			if err != nil {
+				t.Fatalf("GetRealIP() error = %v", err)
+			}
+			if result.String() != tt.expected {
+				t.Errorf("GetRealIP() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseIPPick(t *testing.T) {
+	for name, want := range map[string]IPPick{
+		"":                    PickRightmostUntrusted,
+		"Leftmost":            PickLeftmost,
+		" rightmost ":         PickRightmost,
+		"rightmost_untrusted": PickRightmostUntrusted,
+	} {
+		if got, err := ParseIPPick(name); err != nil || got != want {
+			t.Errorf("ParseIPPick(%q) = %q, %v, want %q", name, got, err, want)
+		}
+	}
+	if _, err := ParseIPPick("middle"); err == nil {
+		t.Error("expected an error for an unknown pick")
+	}
+}
+
+func TestGetRealIPNormalizesAddresses(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{
+			name:       "IPv4-mapped peer",
+			remoteAddr: "[::ffff:198.51.100.7]:5000",
+			expected:   "198.51.100.7",
+		},
+		{
+			name:       "Zoned peer",
+			remoteAddr: "[fe80::1%eth0]:5000",
+			expected:   "fe80::1",
+		},
+		{
+			name:       "IPv4-mapped trusted peer",
+			remoteAddr: "[::ffff:10.0.0.2]:5000",
+			headers:    map[string][]string{"X-Real-IP": {"203.0.113.10"}},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "IPv4-mapped header",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string][]string{"X-Real-IP": {"::ffff:203.0.113.10"}},
+			expected:   "203.0.113.10",
+		},
+		{
+			name:       "Zoned header",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string][]string{"X-Real-IP": {"[fe80::2%eth0]:443"}},
+			expected:   "fe80::2",
+		},
+		{
+			name:       "IPv4-mapped trusted hop is skipped",
+			remoteAddr: "10.0.0.2:5000",
+			headers:    map[string][]string{"X-Forwarded-For": {"203.0.113.10, ::ffff:10.0.0.3"}},
+			expected:   "203.0.113.10",
+		},
+	}
+
+	logger := logrus.StandardLogger()
+	logger.SetLevel(LOG_LEVEL)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsfr := &plugin.DynamicSniffForwardRequest{RemoteAddr: tt.remoteAddr, Header: tt.headers}
+			result, err := GetRealIP(logger, dsfr, RealIPConfig{TrustedProxies: privateProxies})
+			if err != nil {
+				t.Fatalf("GetRealIP() error = %v", err)
+			}
+			if result.String() != tt.expected {
+				t.Errorf("GetRealIP() = %q, expected %q", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestNormalizePrefix(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"::ffff:198.51.100.0/120": "198.51.100.0/24",
+		"::ffff:198.51.100.7/128": "198.51.100.7/32",
+		"::ffff:0.0.0.0/80":       "::/80",
+		"10.1.2.3/8":              "10.0.0.0/8",
+		"2001:db8::1/32":          "2001:db8::/32",
+	} {
+		if got := NormalizePrefix(netip.MustParsePrefix(raw)); got.String() != expected {
+			t.Errorf("NormalizePrefix(%s) = %s, expected %s", raw, got, expected)
+		}
+	}
+}
+
+func TestIsHTTPS(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		tls        bool
+		proto      string
+		expected   bool
+	}{
+		{name: "TLS request", remoteAddr: "198.51.100.7:5000", tls: true, expected: true},
+		{name: "Plain request", remoteAddr: "198.51.100.7:5000", expected: false},
+		{name: "Trusted proxy says https", remoteAddr: "10.0.0.2:5000", proto: "HTTPS", expected: true},
+		{name: "Trusted proxy says http", remoteAddr: "10.0.0.2:5000", proto: "http", expected: false},
+		{name: "First scheme of a list wins", remoteAddr: "10.0.0.2:5000", proto: "https, http", expected: true},
+		{name: "Untrusted peer cannot claim https", remoteAddr: "198.51.100.7:5000", proto: "https", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remoteAddr
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			if tt.proto != "" {
+				r.Header.Set(ForwardedProtoHeader, tt.proto)
+			}
+			if got := IsHTTPS(r, RealIPConfig{TrustedProxies: privateProxies}); got != tt.expected {
+				t.Errorf("IsHTTPS() = %v, expected %v", got, tt.expected)
+			}
+		})
+	}
+}
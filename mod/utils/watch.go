@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// DefaultWatchInterval is how often watched files are checked for changes.
+const DefaultWatchInterval = 2 * time.Second
+
+// WatchFile checks path every interval, and calls onChange when its size or
+// modification time changed since the last check, or when it reappears after
+// being removed. It returns when ctx is done.
+//
+// Editors often replace a file by writing a new one and renaming it, so the
+// file is polled rather than watched through its inode.
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func()) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	last, lastErr := os.Stat(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+
+		current, err := os.Stat(path)
+		if err != nil {
+			// wait for the file to be written again
+			last, lastErr = nil, err
+			continue
+		}
+		if lastErr != nil || current.Size() != last.Size() || !current.ModTime().Equal(last.ModTime()) {
+			onChange()
+		}
+		last, lastErr = current, nil
+	}
+}
@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("log_level: warning\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := make(chan struct{}, 10)
+	done := make(chan error)
+	go func() {
+		done <- WatchFile(ctx, path, 5*time.Millisecond, func() { changes <- struct{}{} })
+	}()
+
+	expectChange := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+		case <-time.After(time.Second):
+			t.Fatalf("no change reported after %s", what)
+		}
+	}
+	expectNoChange := func(what string) {
+		t.Helper()
+		select {
+		case <-changes:
+			t.Fatalf("change reported after %s", what)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+
+	expectNoChange("starting")
+
+	if err := os.WriteFile(path, []byte("log_level: debug\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("writing the file")
+	expectNoChange("leaving the file alone")
+
+	// editors save by renaming a new file over the old one
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte("log_level: info\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("replacing the file")
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	expectNoChange("removing the file")
+	if err := os.WriteFile(path, []byte("log_level: info\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	expectChange("recreating the file")
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("WatchFile() error = %v", err)
+	}
+}
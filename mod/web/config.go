@@ -0,0 +1,212 @@
+package web
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+)
+
+// ConfigManager reads and updates the running configuration.
+type ConfigManager interface {
+	// Config returns the running configuration.
+	Config() *config.PluginConfig
+	// Update validates, saves and applies a configuration. Validation errors
+	// wrap config.ErrInvalidConfig.
+	Update(updated *config.PluginConfig) (config.Changes, error)
+}
+
+type ConfigResponse struct {
+	Config *config.PluginConfig `json:"config"`
+	Path   string               `json:"path"`
+	// Sources tells where the value of each setting comes from, by YAML
+	// path.
+	Sources map[string]config.ValueSource `json:"sources"`
+
+	// set in response to an update
+	Applied          []string `json:"applied,omitempty"`
+	RestartRequired  []string `json:"restartRequired,omitempty"`
+	BouncerRestarted bool     `json:"bouncerRestarted,omitempty"`
+}
+
+type ConfigErrorResponse struct {
+	Error  string             `json:"error"`
+	Errors config.FieldErrors `json:"errors"`
+}
+
+// maxConfigSize bounds the size of a configuration sent to /api/config.
+const maxConfigSize = 1 << 20
+
+const (
+	// zoraxyCSRFHeader is set by Zoraxy on every request it forwards to the
+	// plugin UI, after checking the admin session.
+	zoraxyCSRFHeader = "X-Zoraxy-Csrf"
+	// csrfTokenHeader carries the CSRF token of the UI page. Zoraxy rejects
+	// state-changing requests without it.
+	csrfTokenHeader = "X-CSRF-Token"
+)
+
+func apiConfigHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	manager, ok := authorizeConfigRequest(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(newConfigResponse(manager.Config()))
+	case http.MethodPut:
+		updateConfig(w, r, manager)
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func updateConfig(w http.ResponseWriter, r *http.Request, manager ConfigManager) {
+	if !requireCSRFToken(w, r) {
+		return
+	}
+	updated, ok := decodeConfig(w, r, manager.Config())
+	if !ok {
+		return
+	}
+	if err := updated.PostProcess(); err != nil {
+		writeConfigErrors(w, err)
+		return
+	}
+
+	changes, err := manager.Update(updated)
+	if errors.Is(err, config.ErrInvalidConfig) {
+		writeConfigErrors(w, err)
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	response := newConfigResponse(manager.Config())
+	response.Applied = changes.Live
+	response.RestartRequired = changes.Restart
+	response.BouncerRestarted = changes.Bouncer
+	json.NewEncoder(w).Encode(response)
+}
+
+func newConfigResponse(running *config.PluginConfig) ConfigResponse {
+	return ConfigResponse{
+		Config:  running.Masked(),
+		Path:    info.CONFIGURATION_FILE,
+		Sources: running.Sources,
+	}
+}
+
+// apiConfigTestHandler validates a configuration and checks that LAPI accepts
+// its credentials, without saving it. The configuration is sent like to PUT
+// /api/config; without a body, the running configuration is checked.
+func apiConfigTestHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	manager, ok := authorizeConfigRequest(w, r)
+	if !ok {
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if !requireCSRFToken(w, r) {
+		return
+	}
+
+	proposed := manager.Config()
+	if r.ContentLength != 0 {
+		if proposed, ok = decodeConfig(w, r, proposed); !ok {
+			return
+		}
+		if err := proposed.PostProcess(); err != nil {
+			json.NewEncoder(w).Encode(config.Validation{Errors: config.AsFieldErrors(err)})
+			return
+		}
+	}
+
+	json.NewEncoder(w).Encode(proposed.Validate(r.Context(), true))
+}
+
+// authorizeConfigRequest checks that r went through Zoraxy's admin
+// authentication and comes from the UI page, and returns the configuration
+// manager.
+func authorizeConfigRequest(w http.ResponseWriter, r *http.Request) (ConfigManager, bool) {
+	// the web server only listens on localhost, so requests without the
+	// header did not go through Zoraxy
+	if r.Header.Get(zoraxyCSRFHeader) == "" {
+		writeError(w, http.StatusUnauthorized, "requests must go through the Zoraxy admin UI")
+		return nil, false
+	}
+	// any local process can set the header, but only the UI page served
+	// by Zoraxy knows the token
+	if !validUIToken(r) {
+		writeError(w, http.StatusForbidden, "invalid UI token")
+		return nil, false
+	}
+	manager := runtimeConfigManager
+	if manager == nil {
+		writeError(w, http.StatusServiceUnavailable, "the configuration cannot be edited")
+		return nil, false
+	}
+	return manager, true
+}
+
+// requireCSRFToken checks that a request changing state carries the CSRF
+// token of the UI page. Zoraxy checks its value before forwarding the
+// request; the plugin cannot, as it does not know the admin session.
+func requireCSRFToken(w http.ResponseWriter, r *http.Request) bool {
+	if r.Header.Get(csrfTokenHeader) == "" {
+		writeError(w, http.StatusForbidden, "missing CSRF token")
+		return false
+	}
+	return true
+}
+
+// decodeConfig reads a configuration sent as JSON by the UI, and restores
+// the secrets it left masked from running. It rejects secrets left masked
+// for another server. The caller post-processes the configuration.
+func decodeConfig(w http.ResponseWriter, r *http.Request, running *config.PluginConfig) (*config.PluginConfig, bool) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, "the configuration must be sent as application/json")
+		return nil, false
+	}
+
+	decoded := &config.PluginConfig{}
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxConfigSize))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(decoded); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid configuration: "+err.Error())
+		return nil, false
+	}
+	if err := decoded.RestoreSecrets(running); err != nil {
+		writeConfigErrors(w, err)
+		return nil, false
+	}
+	return decoded, true
+}
+
+// writeConfigErrors rejects an invalid configuration, listing every problem
+// found in it.
+func writeConfigErrors(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ConfigErrorResponse{
+		Error:  "invalid configuration: " + err.Error(),
+		Errors: config.AsFieldErrors(err),
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
@@ -0,0 +1,211 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
+)
+
+// fakeConfigManager accepts any configuration whose agent_url is set.
+type fakeConfigManager struct {
+	running *config.PluginConfig
+}
+
+func (m *fakeConfigManager) Config() *config.PluginConfig { return m.running }
+
+func (m *fakeConfigManager) Update(updated *config.PluginConfig) (config.Changes, error) {
+	if updated.AgentUrl == "" {
+		return config.Changes{}, fmt.Errorf("%w: missing agent_url", config.ErrInvalidConfig)
+	}
+	changes := config.Diff(m.running, updated)
+	m.running = updated
+	return changes, nil
+}
+
+func newFakeConfigManager(t *testing.T) *fakeConfigManager {
+	t.Helper()
+	running := &config.PluginConfig{APIKey: "secret-api-key", AgentUrl: "http://127.0.0.1:8080", LogLevelString: "warning"}
+	if err := running.PostProcess(); err != nil {
+		t.Fatal(err)
+	}
+	return &fakeConfigManager{running: running}
+}
+
+func configRequest(method, body string, headers map[string]string) *http.Request {
+	r := httptest.NewRequest(method, "/api/config", strings.NewReader(body))
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestConfigHandlerRequiresZoraxy(t *testing.T) {
+	manager := newFakeConfigManager(t)
+	runtimeConfigManager = manager
+	t.Cleanup(func() { runtimeConfigManager = nil })
+
+	zoraxy := map[string]string{zoraxyCSRFHeader: "token", uiTokenHeader: uiToken}
+	put := map[string]string{zoraxyCSRFHeader: "token", uiTokenHeader: uiToken, "Content-Type": "application/json"}
+	wrongToken := map[string]string{zoraxyCSRFHeader: "token", csrfTokenHeader: "token", uiTokenHeader: "guessed", "Content-Type": "application/json"}
+	tests := []struct {
+		name string
+		r    *http.Request
+		want int
+	}{
+		{"GET outside Zoraxy", configRequest(http.MethodGet, "", nil), http.StatusUnauthorized},
+		{"PUT outside Zoraxy", configRequest(http.MethodPut, "{}", map[string]string{"Content-Type": "application/json"}), http.StatusUnauthorized},
+		{"PUT without CSRF token", configRequest(http.MethodPut, "{}", put), http.StatusForbidden},
+		{"GET without UI token", configRequest(http.MethodGet, "", map[string]string{zoraxyCSRFHeader: "token"}), http.StatusForbidden},
+		{"GET with a wrong UI token", configRequest(http.MethodGet, "", wrongToken), http.StatusForbidden},
+		{"PUT with a wrong UI token", configRequest(http.MethodPut, `{"api_key": "stolen"}`, wrongToken), http.StatusForbidden},
+		{"POST", configRequest(http.MethodPost, "{}", zoraxy), http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		apiConfigHandler(w, tt.r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.want)
+		}
+	}
+	if manager.running.APIKey != "secret-api-key" {
+		t.Fatalf("rejected requests changed the configuration")
+	}
+}
+
+func TestConfigHandlerMasksAndUpdates(t *testing.T) {
+	manager := newFakeConfigManager(t)
+	runtimeConfigManager = manager
+	t.Cleanup(func() { runtimeConfigManager = nil })
+	headers := map[string]string{zoraxyCSRFHeader: "token", csrfTokenHeader: "token", uiTokenHeader: uiToken, "Content-Type": "application/json"}
+
+	w := httptest.NewRecorder()
+	apiConfigHandler(w, configRequest(http.MethodGet, "", headers))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "secret-api-key") {
+		t.Fatalf("GET = %d %s, want the API key masked", w.Code, w.Body.String())
+	}
+	var response ConfigResponse
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if source := response.Sources["api_key"]; source.Kind != config.SourceConfigFile {
+		t.Fatalf("GET sources[api_key] = %+v", source)
+	}
+
+	// the masked API key is sent back unchanged, and keeps its value
+	response.Config.LogLevelString = "debug"
+	body, err := json.Marshal(response.Config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	apiConfigHandler(w, configRequest(http.MethodPut, string(body), headers))
+	if w.Code != http.StatusOK {
+		t.Fatalf("PUT = %d %s", w.Code, w.Body.String())
+	}
+	if manager.running.APIKey != "secret-api-key" || manager.running.LogLevelString != "debug" {
+		t.Fatalf("PUT applied %+v", manager.running)
+	}
+	if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Applied) != 1 || response.Applied[0] != "log_level" {
+		t.Fatalf("PUT applied = %v, want [log_level]", response.Applied)
+	}
+
+	for name, body := range map[string]string{
+		"unknown field":                   `{"agent_url": "http://127.0.0.1:8080", "api_kye": "typo"}`,
+		"bad log level":                   `{"agent_url": "http://127.0.0.1:8080", "log_level": "loud"}`,
+		"rejected update":                 `{"agent_url": ""}`,
+		"masked API key for another LAPI": `{"agent_url": "http://attacker.example:8080", "api_key": "` + config.MaskedSecret + `"}`,
+	} {
+		w = httptest.NewRecorder()
+		apiConfigHandler(w, configRequest(http.MethodPut, body, headers))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("PUT %s = %d, want %d", name, w.Code, http.StatusBadRequest)
+		}
+	}
+	if manager.running.LogLevelString != "debug" {
+		t.Fatalf("invalid updates changed the configuration")
+	}
+
+	// every problem is listed by setting
+	w = httptest.NewRecorder()
+	apiConfigHandler(w, configRequest(http.MethodPut, `{"agent_url": "ftp://lapi", "log_level": "loud"}`, headers))
+	var rejected ConfigErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&rejected); err != nil {
+		t.Fatal(err)
+	}
+	if len(rejected.Errors) != 2 || rejected.Errors[0].Field != "log_level" || rejected.Errors[1].Field != "agent_url" {
+		t.Fatalf("PUT errors = %+v, want log_level and agent_url", rejected.Errors)
+	}
+}
+
+func TestConfigTestHandler(t *testing.T) {
+	lapiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "secret-api-key" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("null"))
+	}))
+	defer lapiServer.Close()
+
+	manager := newFakeConfigManager(t)
+	manager.running.AgentUrl = lapiServer.URL
+	if err := manager.running.PostProcess(); err != nil {
+		t.Fatal(err)
+	}
+	runtimeConfigManager = manager
+	t.Cleanup(func() { runtimeConfigManager = nil })
+	headers := map[string]string{zoraxyCSRFHeader: "token", csrfTokenHeader: "token", uiTokenHeader: uiToken, "Content-Type": "application/json"}
+
+	test := func(body string) config.Validation {
+		t.Helper()
+		w := httptest.NewRecorder()
+		apiConfigTestHandler(w, configRequest(http.MethodPost, body, headers))
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST %s = %d %s", body, w.Code, w.Body.String())
+		}
+		var validation config.Validation
+		if err := json.NewDecoder(w.Body).Decode(&validation); err != nil {
+			t.Fatal(err)
+		}
+		return validation
+	}
+
+	// without a body, the running configuration is checked
+	if validation := test(""); validation.Err() != nil || len(validation.Connections) != 1 || !validation.Connections[0].Authenticated {
+		t.Fatalf("running configuration: %+v", validation)
+	}
+	// a masked API key is the running one
+	proposed := fmt.Sprintf(`{"api_key": %q, "agent_url": %q}`, config.MaskedSecret, lapiServer.URL)
+	if validation := test(proposed); len(validation.Connections) != 1 || !validation.Connections[0].Authenticated {
+		t.Fatalf("masked API key: %+v", validation)
+	}
+	// but it is not sent to another LAPI
+	w := httptest.NewRecorder()
+	proposed = fmt.Sprintf(`{"api_key": %q, "agent_url": %q}`, config.MaskedSecret, lapiServer.URL+"/other")
+	apiConfigTestHandler(w, configRequest(http.MethodPost, proposed, headers))
+	var rejected ConfigErrorResponse
+	if err := json.NewDecoder(w.Body).Decode(&rejected); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != http.StatusBadRequest || len(rejected.Errors) != 1 || rejected.Errors[0].Field != "api_key" {
+		t.Fatalf("masked API key for another LAPI = %d %+v", w.Code, rejected)
+	}
+	proposed = fmt.Sprintf(`{"api_key": "wrong", "agent_url": %q}`, lapiServer.URL)
+	if validation := test(proposed); validation.Err() == nil || validation.Connections[0].Authenticated {
+		t.Fatalf("wrong API key: %+v", validation)
+	}
+	if validation := test(`{"api_key": "wrong", "log_level": "loud"}`); len(validation.Errors) != 1 {
+		t.Fatalf("bad log level: %+v", validation)
+	}
+	if manager.running.APIKey != "secret-api-key" {
+		t.Fatalf("testing a configuration changed it")
+	}
+}
@@ -0,0 +1,56 @@
+package web
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+const (
+	// uiTokenHeader carries the token of the UI page. It authenticates the
+	// configuration endpoints, which the web server would otherwise serve
+	// to any local process claiming to be Zoraxy.
+	uiTokenHeader = "X-Bouncer-UI-Token"
+	// uiTokenPlaceholder is replaced by the token in the HTML pages of the
+	// UI, which Zoraxy only serves to its administrators.
+	uiTokenPlaceholder = "{{.uiToken}}"
+)
+
+// uiToken is generated once per process, so that it cannot be guessed and
+// a token from an earlier run is not accepted.
+var uiToken = rand.Text()
+
+// validUIToken reports whether r carries the token of the UI page.
+func validUIToken(r *http.Request) bool {
+	return subtle.ConstantTimeCompare([]byte(r.Header.Get(uiTokenHeader)), []byte(uiToken)) == 1
+}
+
+// withUIToken fills the token in the HTML pages served by next.
+func withUIToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/") && !strings.HasSuffix(r.URL.Path, ".html") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		page := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(page, r)
+		body := bytes.ReplaceAll(page.body.Bytes(), []byte(uiTokenPlaceholder), []byte(uiToken))
+		w.Header().Del("Content-Length")
+		w.WriteHeader(page.status)
+		w.Write(body)
+	})
+}
+
+// bufferedResponse holds back the body of a response, so that it can be
+// edited before it is sent.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) { b.status = status }
+
+func (b *bufferedResponse) Write(p []byte) (int, error) { return b.body.Write(p) }
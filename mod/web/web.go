@@ -6,11 +6,18 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/config"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/lapi"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/metrics"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/remediation"
 	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
@@ -45,13 +52,94 @@ type ConfigStatusResponse struct {
 	BlockingEnabled bool     `json:"blockingEnabled"`
 	Message         string   `json:"message,omitempty"`
 	MissingFields   []string `json:"missingFields,omitempty"`
+
+	FailureMode *remediation.FailureStatus `json:"failureMode,omitempty"`
+	// ConfigErrors are the problems that got the last change to the
+	// configuration file rejected. The running configuration is unchanged.
+	ConfigErrors config.FieldErrors `json:"configErrors,omitempty"`
+	// RestartRequired lists the changed settings that take effect once the
+	// plugin restarts.
+	RestartRequired []string `json:"restartRequired,omitempty"`
+}
+
+type DecisionInfo struct {
+	ID       int64  `json:"id"`
+	Type     string `json:"type"`
+	Scope    string `json:"scope"`
+	Value    string `json:"value"`
+	Scenario string `json:"scenario,omitempty"`
+	Origin   string `json:"origin,omitempty"`
+	// Endpoint is the LAPI the decision was pulled from.
+	Endpoint string `json:"endpoint,omitempty"`
+	Until    string `json:"until,omitempty"`
+	// Remaining is the number of seconds until the decision expires, or
+	// omitted if it does not expire.
+	Remaining *int64 `json:"remaining,omitempty"`
 }
 
+type DecisionsResponse struct {
+	Total     int            `json:"total"`
+	Decisions []DecisionInfo `json:"decisions"`
+}
+
+// defaultDecisionsLimit is how many decisions /api/decisions returns unless
+// the limit query parameter says otherwise.
+const defaultDecisionsLimit = 100
+
+// runtimeMu guards the runtime state that changes when onboarding completes.
+var runtimeMu sync.RWMutex
+
 var runtimeConfigStatus = ConfigStatusResponse{
 	Onboarding:      false,
 	BlockingEnabled: true,
 }
 
+var runtimeDecisionCache *decisions.Cache
+
+var runtimeFailurePolicy *remediation.FailurePolicy
+
+var runtimeLAPIHealth *lapi.Health
+
+var runtimeConfigManager ConfigManager
+
+// EnableBlocking leaves onboarding mode once the bouncer has been started
+// with a complete configuration.
+func EnableBlocking(failurePolicy *remediation.FailurePolicy, lapiHealth *lapi.Health) {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+
+	runtimeConfigStatus = ConfigStatusResponse{
+		Onboarding:      false,
+		BlockingEnabled: true,
+	}
+	runtimeFailurePolicy = failurePolicy
+	runtimeLAPIHealth = lapiHealth
+}
+
+// SetConfigErrors reports the problems that got a change to the
+// configuration file rejected, or clears them once a change is applied.
+func SetConfigErrors(problems config.FieldErrors) {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	runtimeConfigStatus.ConfigErrors = problems
+}
+
+// SetRestartRequired reports the changed settings that take effect once the
+// plugin restarts, or clears them.
+func SetRestartRequired(settings []string) {
+	runtimeMu.Lock()
+	defer runtimeMu.Unlock()
+	runtimeConfigStatus.RestartRequired = settings
+}
+
+// runtimeState returns the runtime state that changes when onboarding
+// completes.
+func runtimeState() (ConfigStatusResponse, *remediation.FailurePolicy, *lapi.Health) {
+	runtimeMu.RLock()
+	defer runtimeMu.RUnlock()
+	return runtimeConfigStatus, runtimeFailurePolicy, runtimeLAPIHealth
+}
+
 // API handlers
 func apiVersionHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -159,7 +247,95 @@ func apiHeadersHandler(w http.ResponseWriter, r *http.Request) {
 
 func apiConfigStatusHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(runtimeConfigStatus)
+
+	response, failurePolicy, lapiHealth := runtimeState()
+	// blocking starts once the first decisions have been received from LAPI,
+	// or earlier with the decisions restored from the snapshot, which are
+	// enforced until LAPI answers
+	if response.BlockingEnabled && lapiHealth != nil && !lapiHealth.Synced() {
+		restored := 0
+		if runtimeDecisionCache != nil {
+			restored = len(runtimeDecisionCache.Active())
+		}
+		if restored > 0 {
+			response.Message = fmt.Sprintf("Enforcing %d decisions restored from the snapshot, waiting for the first decision update from CrowdSec LAPI.", restored)
+		} else {
+			response.BlockingEnabled = false
+			response.Message = "Waiting for the first decision update from CrowdSec LAPI."
+		}
+		if lastError := lapiHealth.Status().LastError; lastError != "" {
+			response.Message += " Last error: " + lastError
+		}
+	}
+	if failurePolicy != nil {
+		status := failurePolicy.Status()
+		response.FailureMode = &status
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+func apiDecisionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	limit := defaultDecisionsLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed < 0 {
+			writeError(w, http.StatusBadRequest, "limit must be a non-negative integer")
+			return
+		}
+		limit = parsed
+	}
+
+	response := DecisionsResponse{Decisions: []DecisionInfo{}}
+	if runtimeDecisionCache == nil {
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	// newest decisions first
+	active := runtimeDecisionCache.Active()
+	sort.Slice(active, func(i, j int) bool { return active[i].ID > active[j].ID })
+	response.Total = len(active)
+
+	now := time.Now()
+	for _, decision := range active[:min(limit, len(active))] {
+		item := DecisionInfo{
+			ID:       decision.ID,
+			Type:     stringValue(decision.Type),
+			Scope:    stringValue(decision.Scope),
+			Value:    stringValue(decision.Value),
+			Scenario: stringValue(decision.Scenario),
+			Origin:   stringValue(decision.Origin),
+			Endpoint: runtimeDecisionCache.Endpoint(decision.ID),
+			Until:    decision.Until,
+		}
+		if remaining, ok := decisions.Remaining(decision, now); ok {
+			seconds := int64(remaining.Round(time.Second).Seconds())
+			item.Remaining = &seconds
+		}
+		response.Decisions = append(response.Decisions, item)
+	}
+
+	json.NewEncoder(w).Encode(response)
+}
+
+func stringValue(value *string) string {
+	if value == nil {
+		return ""
+	}
+	return *value
+}
+
+func apiLAPIStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	_, _, lapiHealth := runtimeState()
+	if lapiHealth == nil {
+		json.NewEncoder(w).Encode(lapi.Status{Enabled: false})
+		return
+	}
+	json.NewEncoder(w).Encode(lapiHealth.Status())
 }
 
 // Version checking with caching
@@ -253,21 +429,32 @@ func versionCheck() (string, error) {
 // InitWebServer initializes the web server and serves the plugin UI.
 // Also sets up a shutdown handler for graceful shutdown.
 //
-// Runs everything on the default serve mux.
-func InitWebServer(logger *logrus.Logger, g *errgroup.Group, ctx context.Context, port int, configStatus ConfigStatusResponse) {
+// Runs everything on the default serve mux. If configManager is nil, the
+// configuration cannot be viewed or edited from the UI.
+func InitWebServer(logger *logrus.Logger, g *errgroup.Group, ctx context.Context, port int, configStatus ConfigStatusResponse, decisionCache *decisions.Cache, failurePolicy *remediation.FailurePolicy, lapiHealth *lapi.Health, configManager ConfigManager) {
+	runtimeMu.Lock()
 	runtimeConfigStatus = configStatus
+	runtimeFailurePolicy = failurePolicy
+	runtimeLAPIHealth = lapiHealth
+	runtimeMu.Unlock()
+	runtimeDecisionCache = decisionCache
+	runtimeConfigManager = configManager
 
 	mux := http.DefaultServeMux
 
 	// webui and API
 	embedWebRouter := zoraxy_plugin.NewPluginEmbedUIRouter(info.PLUGIN_ID, &content, info.WEB_ROOT, info.UI_PATH)
-	embedWebRouter.AttachHandlerToMux(mux)
+	mux.Handle(strings.TrimSuffix(info.UI_PATH, "/")+"/", withUIToken(embedWebRouter.Handler()))
 
 	// Add API endpoints
 	mux.HandleFunc(info.UI_PATH+"api/version", apiVersionHandler)
 	mux.HandleFunc(info.UI_PATH+"api/metrics", apiMetricsHandler)
 	mux.HandleFunc(info.UI_PATH+"api/headers", apiHeadersHandler)
 	mux.HandleFunc(info.UI_PATH+"api/config-status", apiConfigStatusHandler)
+	mux.HandleFunc(info.UI_PATH+"api/decisions", apiDecisionsHandler)
+	mux.HandleFunc(info.UI_PATH+"api/lapi-status", apiLAPIStatusHandler)
+	mux.HandleFunc(info.UI_PATH+"api/config", apiConfigHandler)
+	mux.HandleFunc(info.UI_PATH+"api/config/test", apiConfigTestHandler)
 
 	serverAddr := fmt.Sprintf("127.0.0.1:%d", port)
 	server := &http.Server{
@@ -0,0 +1,68 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/decisions"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/info"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/lapi"
+	"github.com/AnthonyMichaelTDM/zoraxycrowdsecbouncer/mod/zoraxy_plugin"
+	"github.com/crowdsecurity/crowdsec/pkg/models"
+)
+
+func TestConfigStatusReportsRestoredDecisions(t *testing.T) {
+	cache := decisions.NewCache()
+	health := lapi.NewHealth([]string{"http://127.0.0.1:8080"})
+	runtimeDecisionCache = cache
+	EnableBlocking(nil, health)
+	t.Cleanup(func() {
+		runtimeDecisionCache = nil
+		EnableBlocking(nil, nil)
+	})
+
+	status := func() ConfigStatusResponse {
+		t.Helper()
+		w := httptest.NewRecorder()
+		apiConfigStatusHandler(w, httptest.NewRequest(http.MethodGet, "/api/config-status", nil))
+		var response ConfigStatusResponse
+		if err := json.NewDecoder(w.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	if response := status(); response.BlockingEnabled {
+		t.Fatalf("empty cache before the first update: %+v, want blocking not enabled", response)
+	}
+
+	// decisions restored from the snapshot are enforced before LAPI answers
+	scope, value, decisionType, duration := "Ip", "192.0.2.1", "ban", "1h"
+	cache.Apply(&models.DecisionsStreamResponse{New: models.GetDecisionsResponse{
+		{ID: 1, Scope: &scope, Value: &value, Type: &decisionType, Duration: &duration},
+	}})
+	if response := status(); !response.BlockingEnabled || !strings.Contains(response.Message, "restored from the snapshot") {
+		t.Fatalf("restored decisions: %+v, want blocking enabled", response)
+	}
+
+	health.RecordSuccess(1, 0, true)
+	if response := status(); !response.BlockingEnabled || response.Message != "" {
+		t.Fatalf("after the first update: %+v", response)
+	}
+}
+
+func TestUIPageCarriesUIToken(t *testing.T) {
+	router := zoraxy_plugin.NewPluginEmbedUIRouter(info.PLUGIN_ID, &content, info.WEB_ROOT, info.UI_PATH)
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, info.UI_PATH, nil)
+	r.Header.Set(zoraxyCSRFHeader, "token")
+	withUIToken(router.Handler()).ServeHTTP(w, r)
+
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.Contains(body, uiToken) || strings.Contains(body, uiTokenPlaceholder) {
+		t.Fatalf("GET %s = %d, want the page with the UI token filled in", info.UI_PATH, w.Code)
+	}
+}